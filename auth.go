@@ -30,8 +30,8 @@ type claims struct {
 }
 
 func authHandlers() {
-	r.POST("/api/auth/login", loginHandler)
-	r.POST("/api/auth/signup", signupHandler)
+	r.POST("/api/auth/login", rateLimit("login"), loginHandler)
+	r.POST("/api/auth/signup", rateLimit("signup"), signupHandler)
 }
 
 func loginHandler(c *gin.Context) {
@@ -179,3 +179,35 @@ func jwtAuth(c *gin.Context) {
 		c.Abort()
 	}
 }
+
+// adminAuth must be used after jwtAuth,
+// only the users listed in "admins" config are allowed
+func adminAuth(c *gin.Context) {
+	name := c.GetString("username")
+	for _, admin := range viper.GetStringSlice("admins") {
+		if admin == name {
+			c.Next()
+			return
+		}
+	}
+
+	permissionError(c, errAuthFailed)
+	c.Abort()
+}
+
+// moderatorAuth must be used after jwtAuth,
+// the users listed in "moderators" or "admins" config are allowed
+func moderatorAuth(c *gin.Context) {
+	name := c.GetString("username")
+	for _, key := range []string{"moderators", "admins"} {
+		for _, m := range viper.GetStringSlice(key) {
+			if m == name {
+				c.Next()
+				return
+			}
+		}
+	}
+
+	permissionError(c, errAuthFailed)
+	c.Abort()
+}
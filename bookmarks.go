@@ -0,0 +1,159 @@
+package dream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// user's private bookmark of the dream, unlike the likes, it's never shown to the others
+type bookmark struct {
+	User  string    `json:"user" bson:"user"`
+	Dream string    `json:"dream" bson:"dream"`
+	Saved time.Time `json:"saved" bson:"saved"`
+}
+
+func bookmarksHandlers() {
+	r.GET("/api/bookmarks", jwtAuth, bookmarksHandler)
+	r.GET("/api/bookmarks/add/:dreamId", jwtAuth, addBookmarkHandler)
+	r.GET("/api/bookmarks/remove/:dreamId", jwtAuth, removeBookmarkHandler)
+}
+
+func addBookmarkHandler(c *gin.Context) {
+	uid := c.GetString("uuid")
+	d, err := getVisibleDream(c.Param("dreamId"), uid)
+	if err == errDreamNotFound {
+		badRequest(c, err)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	// saved again if it's already bookmarked
+	if _, err = bookmarks.UpdateOne(context.TODO(),
+		bson.M{"user": uid, "dream": d.ID},
+		bson.M{"$set": bson.M{"saved": time.Now()}},
+		options.Update().SetUpsert(true),
+	); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	ok(c)
+}
+
+func removeBookmarkHandler(c *gin.Context) {
+	if _, err := bookmarks.DeleteOne(context.TODO(), bson.M{"user": c.GetString("uuid"), "dream": c.Param("dreamId")}); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	ok(c)
+}
+
+// list user's saved dreams, the latest saved first
+func bookmarksHandler(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "0"))
+	if err != nil || page < 0 {
+		badRequest(c, errors.New("invalid.input"))
+		return
+	}
+
+	uid := c.GetString("uuid")
+	ds, err := getBookmarks(uid, page)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if _, err = censorDreams(uid, ds); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":     true,
+		"dreams": ds,
+	})
+}
+
+func getBookmarks(uid string, page int) ([]*dream, error) {
+	perPage := int64(viper.GetInt("bookmarksPerPage"))
+	opts := options.Find().
+		SetSort(bson.M{"saved": -1}).
+		SetSkip(perPage * int64(page)).
+		SetLimit(perPage)
+
+	ctx := context.TODO()
+	cursor, err := bookmarks.Find(ctx, bson.M{"user": uid}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var bs []bookmark
+	if err = cursor.All(ctx, &bs); err != nil {
+		return nil, err
+	}
+
+	ds := make([]*dream, 0, len(bs))
+	for _, b := range bs {
+		d, err := getVisibleDream(b.Dream, uid)
+		if err == errDreamNotFound {
+			continue // deleted or not visible any more
+		} else if err != nil {
+			return nil, err
+		}
+
+		d.Bookmarked = true
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// set the "bookmarked" flags of the dreams for the user
+func markBookmarked(uid string, ds []*dream) error {
+	if len(ds) == 0 {
+		return nil
+	}
+
+	ids := make(bson.A, len(ds))
+	for i, d := range ds {
+		ids[i] = d.ID
+	}
+
+	ctx := context.TODO()
+	cursor, err := bookmarks.Find(ctx, bson.M{"user": uid, "dream": bson.M{"$in": ids}},
+		options.Find().SetProjection(bson.M{"dream": 1}))
+	if err != nil {
+		return err
+	}
+
+	var bs []bookmark
+	if err = cursor.All(ctx, &bs); err != nil {
+		return err
+	}
+
+	saved := make(map[string]bool, len(bs))
+	for _, b := range bs {
+		saved[b.Dream] = true
+	}
+
+	for _, d := range ds {
+		d.Bookmarked = saved[d.ID]
+	}
+	return nil
+}
+
+// remove the deleted dream from everyone's bookmarks
+func removeBookmarks(ctx context.Context, id string) error {
+	_, err := bookmarks.DeleteMany(ctx, bson.M{"dream": id})
+	return err
+}
@@ -0,0 +1,91 @@
+package dream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestBookmarks(t *testing.T) {
+	testSetup()
+
+	defer func() {
+		if err := delUsrByName("tester046"); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	w := testLogin(t, "tester046")
+	token, c := testJwtToken(t, w)
+
+	ctx := context.TODO()
+	defer bookmarks.DeleteMany(ctx, bson.M{"user": c.ID})
+
+	newDream := func() *dream {
+		now := time.Now()
+		d := &dream{
+			ID: uuid.New().String(), AuthorID: c.ID, Author: "tester046",
+			Status: dsDone, Visibility: visPublic, Created: now, Finished: now,
+			Likes: make([]string, 0), Images: make([]string, 0),
+		}
+		if _, err := dreams.InsertOne(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+		if err := addFeed(d); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	first := newDream()
+	second := newDream()
+	defer dreams.DeleteMany(ctx, bson.M{"authorId": c.ID})
+
+	get := func(addr string) map[string]interface{} {
+		req, _ := http.NewRequest("GET", addr, nil)
+		req.AddCookie(token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return assertOK(t, w)
+	}
+
+	get("/api/bookmarks/add/" + second.ID)
+	get("/api/bookmarks/add/" + first.ID)
+	get("/api/bookmarks/add/" + first.ID) // saved again
+
+	// the latest saved first
+	ds := get("/api/bookmarks")["dreams"].([]interface{})
+	assert.Equal(t, 2, len(ds))
+	assert.Equal(t, first.ID, ds[0].(map[string]interface{})["_id"])
+	assert.Equal(t, true, ds[0].(map[string]interface{})["bookmarked"])
+
+	get("/api/bookmarks/remove/" + second.ID)
+	ds = get("/api/bookmarks")["dreams"].([]interface{})
+	assert.Equal(t, 1, len(ds))
+
+	// flagged in the feeds
+	feeds, err := getFeeds(c.ID, time.Now().Add(-time.Hour))
+	assert.Nil(t, err)
+	flags := map[string]bool{}
+	for _, d := range feeds {
+		flags[d.ID] = d.Bookmarked
+	}
+	assert.Equal(t, map[string]bool{first.ID: true, second.ID: false}, flags)
+
+	// the flag is never cached
+	d, err := getDreamById(first.ID)
+	assert.Nil(t, err)
+	assert.False(t, d.Bookmarked)
+
+	req, _ := http.NewRequest("GET", "/api/bookmarks/add/not-found", nil)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertNotOK(t, w)
+}
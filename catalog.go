@@ -0,0 +1,247 @@
+package dream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v9"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	errModelNotFound = errors.New("model.notFound")
+	errModelInUse    = errors.New("model.inUse") // dreams are still waiting in its queue
+)
+
+// stable diffusion model (checkpoint) and its allowed params
+type sdModel struct {
+	Name    string `json:"name" bson:"_id" mapstructure:"name"`
+	Version string `json:"version" bson:"version" mapstructure:"version"`
+	Enabled bool   `json:"enabled" bson:"enabled" mapstructure:"enabled"`
+
+	// default params
+	Steps  int     `json:"steps" bson:"steps" mapstructure:"steps"`
+	Scale  float32 `json:"scale" bson:"scale" mapstructure:"scale"`
+	Width  int     `json:"width" bson:"width" mapstructure:"width"`
+	Height int     `json:"height" bson:"height" mapstructure:"height"`
+
+	// limits
+	MaxWidth    int      `json:"maxWidth" bson:"maxWidth" mapstructure:"maxWidth"`
+	MaxHeight   int      `json:"maxHeight" bson:"maxHeight" mapstructure:"maxHeight"`
+	Samplers    []string `json:"samplers" bson:"samplers" mapstructure:"samplers"` // the first one is the default sampler
+	ClipSkipMax int      `json:"clipSkipMax" bson:"clipSkipMax" mapstructure:"clipSkipMax"`
+	BatchMax    int      `json:"batchMax" bson:"batchMax" mapstructure:"batchMax"`
+
+	Nsfw string `json:"nsfw" bson:"nsfw" mapstructure:"nsfw"` // nsfw policy: "allow" or "moderate"
+
+	Updated time.Time `json:"updated" bson:"updated"`
+}
+
+func catalogHandlers() {
+	r.GET("/api/models", jwtAuth, listModelsHandler)
+	r.GET("/api/admin/models", jwtAuth, adminAuth, listAllModelsHandler)
+	r.POST("/api/admin/models", jwtAuth, adminAuth, saveModelHandler)
+	r.DELETE("/api/admin/models/:name", jwtAuth, adminAuth, removeModelHandler)
+}
+
+// list the enabled models
+func listModelsHandler(c *gin.Context) {
+	ms, err := listModels(true)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":     true,
+		"models": ms,
+	})
+}
+
+// list all the models, including the disabled ones
+func listAllModelsHandler(c *gin.Context) {
+	ms, err := listModels(false)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":     true,
+		"models": ms,
+	})
+}
+
+// create or update the model
+func saveModelHandler(c *gin.Context) {
+	m := &sdModel{}
+	if err := c.ShouldBindJSON(m); err != nil || len(m.Name) == 0 {
+		badRequest(c, errors.New("model.invalid.params"))
+		return
+	}
+
+	if err := validateModel(m); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	if err := saveModel(m); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	ok(c)
+}
+
+func removeModelHandler(c *gin.Context) {
+	err := removeModel(c.Request.Context(), c.Param("name"))
+	if err == errModelNotFound || err == errModelInUse {
+		badRequest(c, err)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	ok(c)
+}
+
+// validateModel checks the model's defaults are inside its own limits
+func validateModel(m *sdModel) error {
+	if len(m.Samplers) == 0 || m.ClipSkipMax < 1 || m.BatchMax < 1 || m.MaxWidth < 1 || m.MaxHeight < 1 {
+		return errors.New("model.invalid.limits")
+	}
+
+	if !validSize(m.MaxWidth, viper.GetInt("sizeMax")) || !validSize(m.MaxHeight, viper.GetInt("sizeMax")) {
+		return errors.New("model.invalid.limits")
+	}
+
+	// zero defaults fall back to the global ones, the others must pass validateDream too
+	if (m.Width != 0 && !validSize(m.Width, m.MaxWidth)) || (m.Height != 0 && !validSize(m.Height, m.MaxHeight)) {
+		return errors.New("model.invalid.defaults")
+	}
+
+	if m.Steps != 0 && (m.Steps < viper.GetInt("stepsMin") || m.Steps > viper.GetInt("stepsMax")) {
+		return errors.New("model.invalid.defaults")
+	}
+
+	if m.Scale != 0 && (float64(m.Scale) < viper.GetFloat64("scaleMin") || float64(m.Scale) > viper.GetFloat64("scaleMax")) {
+		return errors.New("model.invalid.defaults")
+	}
+
+	if m.Nsfw != "allow" && m.Nsfw != "moderate" {
+		return errors.New("model.invalid.nsfw")
+	}
+	return nil
+}
+
+func getModel(name string) (m *sdModel, err error) {
+	err = getCache("m:"+name, &m)
+	if err == nil {
+		return
+	}
+
+	if err != redis.Nil {
+		return
+	}
+
+	err = sdModels.FindOne(context.TODO(), bson.M{"_id": name}).Decode(&m)
+	if err == mongo.ErrNoDocuments {
+		return nil, errModelNotFound
+	} else if err != nil {
+		return
+	}
+
+	err = setCache("m:"+name, m, viper.GetDuration("expModel"))
+	return
+}
+
+func listModels(enabledOnly bool) ([]sdModel, error) {
+	match := bson.M{}
+	if enabledOnly {
+		match["enabled"] = true
+	}
+
+	ctx := context.TODO()
+	cursor, err := sdModels.Find(ctx, match, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	ms := make([]sdModel, 0)
+	err = cursor.All(ctx, &ms)
+	return ms, err
+}
+
+func saveModel(m *sdModel) error {
+	m.Updated = time.Now()
+
+	_, err := sdModels.ReplaceOne(context.TODO(), bson.M{"_id": m.Name}, m, options.Replace().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+
+	l.Infoln("SAVE_MODEL", m.Name, m.Version, "enabled:", m.Enabled)
+	return delCache("m:" + m.Name)
+}
+
+// removeModel deletes the model, it's refused while any dream is waiting for it,
+// so disable the model first, and remove it after its queue is drained
+func removeModel(ctx context.Context, name string) error {
+	queued, err := isModelQueued(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if queued {
+		return errModelInUse
+	}
+
+	res, err := sdModels.DeleteOne(ctx, bson.M{"_id": name})
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return errModelNotFound
+	}
+
+	l.Infoln("REMOVE_MODEL", name)
+	return delCache("m:" + name)
+}
+
+// whether any dream of the model is in flight: queued, claimed, waiting to retry or held for review
+func isModelQueued(ctx context.Context, name string) (bool, error) {
+	n, err := rdb.LLen(ctx, queueOf(name)).Result()
+	if err != nil || n > 0 {
+		return n > 0, err
+	}
+
+	n, err = dreams.CountDocuments(ctx, bson.M{
+		"model":  name,
+		"status": bson.M{"$in": bson.A{dsPending, dsProcessing, dsReview}},
+	}, options.Count().SetLimit(1))
+	return n > 0, err
+}
+
+// seedModels inserts the models of "modelSeeds" config if they don't exist
+func seedModels() {
+	var seeds []sdModel
+	if err := viper.UnmarshalKey("modelSeeds", &seeds); err != nil {
+		panic(err)
+	}
+
+	for _, m := range seeds {
+		m.Updated = time.Now()
+		_, err := sdModels.UpdateOne(context.TODO(), bson.M{"_id": m.Name}, bson.M{"$setOnInsert": m}, options.Update().SetUpsert(true))
+		if err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package dream
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestModel(name string) *sdModel {
+	return &sdModel{
+		Name:        name,
+		Version:     "1.0",
+		Enabled:     true,
+		Steps:       30,
+		Scale:       9,
+		Width:       768,
+		Height:      768,
+		MaxWidth:    768,
+		MaxHeight:   768,
+		Samplers:    []string{"ddim"},
+		ClipSkipMax: 1,
+		BatchMax:    1,
+		Nsfw:        "moderate",
+	}
+}
+
+func TestModelCatalog(t *testing.T) {
+	testWorkerSetup()
+
+	viper.Set("admins", []string{"tester026"})
+
+	defer func() {
+		removeModel(context.TODO(), "tester-model")
+		if err := delUsrByName("tester026"); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	w := testLogin(t, "tester026")
+	token, _ := testJwtToken(t, w)
+
+	// the seeded model
+	m, err := getModel(testModel)
+	assert.Nil(t, err)
+	assert.True(t, m.Enabled)
+
+	// invalid model
+	invalid := newTestModel("tester-model")
+	invalid.Width = 1024
+	req, _ := postJsonReq("/api/admin/models", invalid)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertNotOK(t, w)
+
+	// defaults outside the global limits
+	invalid = newTestModel("tester-model")
+	invalid.Steps = viper.GetInt("stepsMax") + 1
+	assert.NotNil(t, validateModel(invalid))
+
+	for _, size := range []int{500, viper.GetInt("sizeMin") - viper.GetInt("sizeMultiple")} {
+		invalid = newTestModel("tester-model")
+		invalid.Width = size
+		assert.NotNil(t, validateModel(invalid), size)
+	}
+
+	invalid = newTestModel("tester-model")
+	invalid.MaxHeight = viper.GetInt("sizeMax") + viper.GetInt("sizeMultiple")
+	assert.NotNil(t, validateModel(invalid))
+
+	// create a model
+	req, _ = postJsonReq("/api/admin/models", newTestModel("tester-model"))
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertOK(t, w)
+
+	req, _ = http.NewRequest("GET", "/api/models", nil)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	body := assertOK(t, w)
+	assert.GreaterOrEqual(t, len(body["models"].([]interface{})), 2)
+
+	// model's defaults and limits
+	d := &dream{Prompt: "Hello", Model: "tester-model"}
+	assert.Nil(t, fillDefaults(d))
+	assert.Equal(t, 30, d.Steps)
+	assert.Equal(t, float32(9), d.Scale)
+	assert.Equal(t, 768, d.Width)
+	assert.Equal(t, "ddim", d.Sampler)
+	assert.Nil(t, validateDream(d))
+
+	d.Width = 1024
+	assert.Equal(t, errInvalidWidth, validateDream(d))
+
+	// workers only claim the dreams of their models
+	rdb.Del(context.TODO(), queueOf("tester-model"))
+
+	id := testPostDream(t, token, &dream{Prompt: "Hello", Model: "tester-model"})
+
+	w = claimReq()
+	body = assertOK(t, w)
+	if job, ok := body["job"].(map[string]interface{}); ok {
+		assert.NotEqual(t, id, job["_id"])
+	}
+
+	w = workerReq("POST", "/api/worker/claim", bytes.NewBufferString("models=tester-model"), "application/x-www-form-urlencoded")
+	body = assertOK(t, w)
+	assert.Equal(t, id, body["job"].(map[string]interface{})["_id"])
+
+	// disable the model
+	m = newTestModel("tester-model")
+	m.Enabled = false
+	assert.Nil(t, saveModel(m))
+
+	d = &dream{Prompt: "Hello", Model: "tester-model"}
+	assert.Nil(t, fillDefaults(d))
+	assert.Equal(t, errInvalidModel, validateDream(d))
+
+	// can't be removed while the dreams are waiting for it
+	assert.Nil(t, rdb.RPush(context.TODO(), queueOf("tester-model"), "queued").Err())
+
+	req, _ = http.NewRequest("DELETE", "/api/admin/models/tester-model", nil)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertNotOK(t, w)
+
+	rdb.Del(context.TODO(), queueOf("tester-model"))
+
+	// nor while the claimed dream is generating
+	assert.Equal(t, errModelInUse, removeModel(context.TODO(), "tester-model"))
+	assert.Nil(t, completeJob(context.TODO(), "tester-worker", id))
+	assert.Nil(t, setDreamStatus(id, dsDone))
+
+	// remove the model
+	req, _ = http.NewRequest("DELETE", "/api/admin/models/tester-model", nil)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertOK(t, w)
+
+	_, err = getModel("tester-model")
+	assert.Equal(t, errModelNotFound, err)
+}
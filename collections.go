@@ -0,0 +1,530 @@
+package dream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	errCollectionNotFound = errors.New("collection.notFound")
+	errCollectionParams   = errors.New("collection.invalid.params")
+)
+
+// user's collection of the dreams, both their own and the others'
+type collection struct {
+	ID          string           `json:"_id" bson:"_id"`
+	Owner       string           `json:"owner" bson:"owner"` // owner's id
+	Name        string           `json:"name" bson:"name"`
+	Description string           `json:"description" bson:"description"`
+	Visibility  string           `json:"visibility" bson:"visibility"` // "public" or "private"
+	Items       []collectionItem `json:"items" bson:"items"`           // ordered by the owner
+	Created     time.Time        `json:"created" bson:"created"`
+	Updated     time.Time        `json:"updated" bson:"updated"`
+}
+
+type collectionItem struct {
+	Dream string    `json:"dream" bson:"dream"`
+	Added time.Time `json:"added" bson:"added"`
+}
+
+// params of creating or updating the collection, omitted fields are not changed
+type collectionParams struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Visibility  *string `json:"visibility"`
+}
+
+func collectionsHandlers() {
+	r.POST("/api/collections", jwtAuth, createCollectionHandler)
+	r.GET("/api/collections/:id", jwtAuth, getCollectionHandler)
+	r.POST("/api/collections/:id", jwtAuth, updateCollectionHandler)
+	r.DELETE("/api/collections/:id", jwtAuth, deleteCollectionHandler)
+	r.POST("/api/collections/:id/items", jwtAuth, addCollectionItemHandler)
+	r.DELETE("/api/collections/:id/items/:dream", jwtAuth, removeCollectionItemHandler)
+	r.POST("/api/collections/:id/order", jwtAuth, orderCollectionHandler)
+	r.GET("/api/users/:id/collections", jwtAuth, userCollectionsHandler)
+}
+
+func validateCollection(p *collectionParams) error {
+	if p.Name != nil {
+		*p.Name = strings.TrimSpace(*p.Name)
+		if len(*p.Name) == 0 || utf8.RuneCountInString(*p.Name) > viper.GetInt("collectionNameMaxLen") {
+			return errors.New("collection.invalid.name")
+		}
+	}
+
+	if p.Description != nil {
+		*p.Description = strings.TrimSpace(*p.Description)
+		if utf8.RuneCountInString(*p.Description) > viper.GetInt("collectionDescMaxLen") {
+			return errors.New("collection.invalid.description")
+		}
+	}
+
+	if p.Visibility != nil && *p.Visibility != visPublic && *p.Visibility != visPrivate {
+		return errors.New("collection.invalid.visibility")
+	}
+	return nil
+}
+
+// get collection by id and cache it
+func getCollectionById(id string) (co *collection, err error) {
+	err = getCache("c:"+id, &co)
+	if err == nil {
+		return
+	}
+
+	if err != redis.Nil {
+		return
+	}
+
+	err = collections.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&co)
+	if err == mongo.ErrNoDocuments {
+		return nil, errCollectionNotFound
+	} else if err != nil {
+		return
+	}
+
+	err = setCache("c:"+id, co, viper.GetDuration("expCollection"))
+	return
+}
+
+// the private collections of the others are treated as not found
+func getVisibleCollection(id string, uid string) (*collection, error) {
+	co, err := getCollectionById(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if co.Visibility == visPrivate && co.Owner != uid {
+		return nil, errCollectionNotFound
+	}
+	return co, nil
+}
+
+// get the collection owned by the user
+func getOwnCollection(id string, uid string) (*collection, error) {
+	co, err := getCollectionById(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if co.Owner != uid {
+		return nil, errCollectionNotFound
+	}
+	return co, nil
+}
+
+// clear the caches of the collection, and the counts of its owner
+func expireCollection(co *collection) error {
+	for _, key := range []string{"c:" + co.ID, "u:" + co.Owner + ":collections"} {
+		if err := expires(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// respond the error of the collection
+func collectionError(c *gin.Context, err error) {
+	if err == errCollectionNotFound || err == errDreamNotFound {
+		badRequest(c, err)
+	} else {
+		internalError(c, err)
+	}
+}
+
+func createCollectionHandler(c *gin.Context) {
+	var p collectionParams
+	if err := c.ShouldBindJSON(&p); err != nil || p.Name == nil {
+		badRequest(c, errCollectionParams)
+		return
+	}
+
+	if err := validateCollection(&p); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	uid := c.GetString("uuid")
+	n, err := collections.CountDocuments(context.TODO(), bson.M{"owner": uid})
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if n >= viper.GetInt64("collectionsMax") {
+		badRequest(c, errors.New("collection.tooMany"))
+		return
+	}
+
+	co := &collection{
+		ID:         uuid.New().String(),
+		Owner:      uid,
+		Name:       *p.Name,
+		Visibility: visPublic,
+		Items:      make([]collectionItem, 0),
+		Created:    time.Now(),
+	}
+	co.Updated = co.Created
+	if p.Description != nil {
+		co.Description = *p.Description
+	}
+	if p.Visibility != nil {
+		co.Visibility = *p.Visibility
+	}
+
+	if _, err = collections.InsertOne(context.TODO(), co); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if err = expireCollection(co); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":         true,
+		"collection": co,
+	})
+}
+
+// get the collection with its dreams which the user can see
+func getCollectionHandler(c *gin.Context) {
+	uid := c.GetString("uuid")
+	co, err := getVisibleCollection(c.Param("id"), uid)
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+
+	ds := make([]*dream, 0, len(co.Items))
+	for _, item := range co.Items {
+		d, err := getVisibleDream(item.Dream, uid)
+		if err == errDreamNotFound {
+			continue
+		} else if err != nil {
+			internalError(c, err)
+			return
+		}
+		ds = append(ds, d)
+	}
+
+	if _, err = censorDreams(uid, ds); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":         true,
+		"collection": co,
+		"dreams":     ds,
+	})
+}
+
+func updateCollectionHandler(c *gin.Context) {
+	var p collectionParams
+	if err := c.ShouldBindJSON(&p); err != nil {
+		badRequest(c, errCollectionParams)
+		return
+	}
+
+	if err := validateCollection(&p); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	co, err := getOwnCollection(c.Param("id"), c.GetString("uuid"))
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+
+	set := bson.M{"updated": time.Now()}
+	if p.Name != nil {
+		set["name"] = *p.Name
+	}
+	if p.Description != nil {
+		set["description"] = *p.Description
+	}
+	if p.Visibility != nil {
+		set["visibility"] = *p.Visibility
+	}
+
+	if _, err = collections.UpdateByID(context.TODO(), co.ID, bson.M{"$set": set}); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if err = expireCollection(co); err != nil {
+		internalError(c, err)
+		return
+	}
+	ok(c)
+}
+
+func deleteCollectionHandler(c *gin.Context) {
+	co, err := getOwnCollection(c.Param("id"), c.GetString("uuid"))
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+
+	if _, err = collections.DeleteOne(context.TODO(), bson.M{"_id": co.ID}); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if err = expireCollection(co); err != nil {
+		internalError(c, err)
+		return
+	}
+	ok(c)
+}
+
+// add the dream to the end of the collection
+func addCollectionItemHandler(c *gin.Context) {
+	uid := c.GetString("uuid")
+	co, err := getOwnCollection(c.Param("id"), uid)
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+
+	d, err := getVisibleDream(c.PostForm("dream"), uid)
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+
+	// the items are limited, and the dream is added only once
+	res, err := collections.UpdateOne(context.TODO(), bson.M{
+		"_id":         co.ID,
+		"items.dream": bson.M{"$ne": d.ID},
+		"items." + strconv.Itoa(viper.GetInt("collectionItemsMax")-1): bson.M{"$exists": false},
+	}, bson.M{
+		"$push": bson.M{"items": &collectionItem{Dream: d.ID, Added: time.Now()}},
+		"$set":  bson.M{"updated": time.Now()},
+	})
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if res.ModifiedCount == 0 {
+		badRequest(c, errors.New("collection.items.duplicatedOrFull"))
+		return
+	}
+
+	if err = expireCollection(co); err != nil {
+		internalError(c, err)
+		return
+	}
+	ok(c)
+}
+
+func removeCollectionItemHandler(c *gin.Context) {
+	co, err := getOwnCollection(c.Param("id"), c.GetString("uuid"))
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+
+	if _, err = collections.UpdateByID(context.TODO(), co.ID, bson.M{
+		"$pull": bson.M{"items": bson.M{"dream": c.Param("dream")}},
+		"$set":  bson.M{"updated": time.Now()},
+	}); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if err = expireCollection(co); err != nil {
+		internalError(c, err)
+		return
+	}
+	ok(c)
+}
+
+type collectionOrder struct {
+	Items []string `json:"items"` // all the dreams' ids in the new order
+}
+
+// reorder the items of the collection
+func orderCollectionHandler(c *gin.Context) {
+	var o collectionOrder
+	if err := c.ShouldBindJSON(&o); err != nil {
+		badRequest(c, errCollectionParams)
+		return
+	}
+
+	co, err := getOwnCollection(c.Param("id"), c.GetString("uuid"))
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+
+	items, err := reorderItems(co.Items, o.Items)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	// the items may be changed since they were loaded, so the order is only applied to the same items
+	res, err := collections.UpdateOne(context.TODO(), bson.M{"_id": co.ID, "items": co.Items}, bson.M{
+		"$set": bson.M{"items": items, "updated": time.Now()},
+	})
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if err = expireCollection(co); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if res.MatchedCount == 0 {
+		badRequest(c, errors.New("collection.order.outdated"))
+		return
+	}
+	ok(c)
+}
+
+// reorderItems returns the items in the order, which must contain every item exactly once
+func reorderItems(items []collectionItem, order []string) ([]collectionItem, error) {
+	errOrder := errors.New("collection.invalid.order")
+	if len(order) != len(items) {
+		return nil, errOrder
+	}
+
+	byId := make(map[string]collectionItem, len(items))
+	for _, item := range items {
+		byId[item.Dream] = item
+	}
+
+	res := make([]collectionItem, 0, len(order))
+	for _, id := range order {
+		item, ok := byId[id]
+		if !ok {
+			return nil, errOrder
+		}
+		delete(byId, id)
+		res = append(res, item)
+	}
+	return res, nil
+}
+
+// summary of the collection in the list
+type collectionSummary struct {
+	ID          string    `json:"_id" bson:"_id"`
+	Name        string    `json:"name" bson:"name"`
+	Description string    `json:"description" bson:"description"`
+	Visibility  string    `json:"visibility" bson:"visibility"`
+	Count       int       `json:"count" bson:"count"` // number of the items
+	Cover       []string  `json:"cover" bson:"cover"` // the first dreams' ids
+	Updated     time.Time `json:"updated" bson:"updated"`
+}
+
+// list the user's collections on the profile, the private ones are only listed to the owner
+func userCollectionsHandler(c *gin.Context) {
+	owner := c.Param("id")
+	cs, err := getUserCollections(owner)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	res := make([]*collectionSummary, 0, len(cs))
+	for _, s := range cs {
+		if s.Visibility == visPrivate && owner != c.GetString("uuid") {
+			continue
+		}
+		res = append(res, s)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":          true,
+		"collections": res,
+	})
+}
+
+// get the summaries of the user's collections, and cache them with their counts
+func getUserCollections(owner string) (cs []*collectionSummary, err error) {
+	key := "u:" + owner + ":collections"
+	err = getCache(key, &cs)
+	if err == nil {
+		return
+	}
+
+	if err != redis.Nil {
+		return
+	}
+
+	ctx := context.TODO()
+	cursor, err := collections.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"owner": owner}}},
+		{{Key: "$sort", Value: bson.M{"updated": -1}}},
+		{{Key: "$project", Value: bson.M{
+			"name":        1,
+			"description": 1,
+			"visibility":  1,
+			"updated":     1,
+			"count":       bson.M{"$size": "$items"},
+			"cover":       bson.M{"$slice": bson.A{"$items.dream", viper.GetInt("collectionCoverSize")}},
+		}}},
+	}, options.Aggregate())
+	if err != nil {
+		return
+	}
+
+	cs = make([]*collectionSummary, 0)
+	if err = cursor.All(ctx, &cs); err != nil {
+		return
+	}
+
+	err = setCache(key, cs, viper.GetDuration("expCollection"))
+	return
+}
+
+// remove the deleted dream from all the collections
+func removeFromCollections(ctx context.Context, id string) error {
+	cursor, err := collections.Find(ctx, bson.M{"items.dream": id}, options.Find().SetProjection(bson.M{"owner": 1}))
+	if err != nil {
+		return err
+	}
+
+	var cs []*collection
+	if err = cursor.All(ctx, &cs); err != nil {
+		return err
+	}
+
+	if len(cs) == 0 {
+		return nil
+	}
+
+	if _, err = collections.UpdateMany(ctx, bson.M{"items.dream": id}, bson.M{
+		"$pull": bson.M{"items": bson.M{"dream": id}},
+	}); err != nil {
+		return err
+	}
+
+	for _, co := range cs {
+		if err = expireCollection(co); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package dream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestReorderItems(t *testing.T) {
+	now := time.Now()
+	items := []collectionItem{{Dream: "a", Added: now}, {Dream: "b"}, {Dream: "c"}}
+
+	res, err := reorderItems(items, []string{"c", "a", "b"})
+	assert.Nil(t, err)
+	assert.Equal(t, []collectionItem{{Dream: "c"}, {Dream: "a", Added: now}, {Dream: "b"}}, res)
+
+	for _, order := range [][]string{{"a", "b"}, {"a", "b", "d"}, {"a", "a", "b"}} {
+		_, err = reorderItems(items, order)
+		assert.NotNil(t, err, order)
+	}
+}
+
+func TestCollections(t *testing.T) {
+	testSetup()
+
+	defer func() {
+		for _, name := range []string{"tester044", "tester045"} {
+			if err := delUsrByName(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}()
+
+	w := testLogin(t, "tester044")
+	owner, oc := testJwtToken(t, w)
+	w = testLogin(t, "tester045")
+	other, ac := testJwtToken(t, w)
+
+	ctx := context.TODO()
+	defer collections.DeleteMany(ctx, bson.M{"owner": oc.ID})
+
+	newDream := func(uid string, vis string) string {
+		d := &dream{ID: uuid.New().String(), AuthorID: uid, Status: dsDone, Visibility: vis, Created: time.Now()}
+		if _, err := dreams.InsertOne(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+		return d.ID
+	}
+	mine := newDream(oc.ID, visPublic)
+	theirs := newDream(ac.ID, visPublic)
+	secret := newDream(ac.ID, visPrivate)
+	defer dreams.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": bson.A{mine, theirs, secret}}})
+
+	send := func(token *http.Cookie, req *http.Request) *httptest.ResponseRecorder {
+		req.AddCookie(token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// create
+	req, _ := postJsonReq("/api/collections", map[string]string{"name": " Cats ", "description": "cute cats"})
+	body := assertOK(t, send(owner, req))
+	id := body["collection"].(map[string]interface{})["_id"].(string)
+	assert.Equal(t, "Cats", body["collection"].(map[string]interface{})["name"])
+
+	req, _ = postJsonReq("/api/collections", map[string]string{"name": ""})
+	assertNotOK(t, send(owner, req))
+
+	// add items, the others' private dreams can't be added
+	for _, d := range []string{mine, theirs} {
+		req, _ = postFormReq("/api/collections/"+id+"/items", map[string]string{"dream": d})
+		assertOK(t, send(owner, req))
+	}
+	for _, d := range []string{mine, secret} {
+		req, _ = postFormReq("/api/collections/"+id+"/items", map[string]string{"dream": d})
+		assertNotOK(t, send(owner, req))
+	}
+
+	// only the owner can change it
+	req, _ = postFormReq("/api/collections/"+id+"/items", map[string]string{"dream": theirs})
+	assertNotOK(t, send(other, req))
+
+	// reorder
+	req, _ = postJsonReq("/api/collections/"+id+"/order", map[string][]string{"items": {theirs, mine}})
+	assertOK(t, send(owner, req))
+	req, _ = postJsonReq("/api/collections/"+id+"/order", map[string][]string{"items": {mine}})
+	assertNotOK(t, send(owner, req))
+
+	req, _ = http.NewRequest("GET", "/api/collections/"+id, nil)
+	body = assertOK(t, send(other, req))
+	ds := body["dreams"].([]interface{})
+	assert.Equal(t, 2, len(ds))
+	assert.Equal(t, theirs, ds[0].(map[string]interface{})["_id"])
+
+	// listed on the profile with the counts
+	req, _ = http.NewRequest("GET", "/api/users/"+oc.ID+"/collections", nil)
+	body = assertOK(t, send(other, req))
+	cs := body["collections"].([]interface{})
+	assert.Equal(t, 1, len(cs))
+	assert.Equal(t, float64(2), cs[0].(map[string]interface{})["count"])
+
+	// private collections are hidden from the others
+	req, _ = postJsonReq("/api/collections/"+id, map[string]string{"visibility": visPrivate})
+	assertOK(t, send(owner, req))
+
+	req, _ = http.NewRequest("GET", "/api/collections/"+id, nil)
+	assertNotOK(t, send(other, req))
+	req, _ = http.NewRequest("GET", "/api/users/"+oc.ID+"/collections", nil)
+	body = assertOK(t, send(other, req))
+	assert.Equal(t, 0, len(body["collections"].([]interface{})))
+	req, _ = http.NewRequest("GET", "/api/users/"+oc.ID+"/collections", nil)
+	body = assertOK(t, send(owner, req))
+	assert.Equal(t, 1, len(body["collections"].([]interface{})))
+
+	// remove items
+	req, _ = http.NewRequest("DELETE", "/api/collections/"+id+"/items/"+theirs, nil)
+	assertOK(t, send(owner, req))
+	assert.Nil(t, removeFromCollections(ctx, mine))
+
+	co, err := getCollectionById(id)
+	assert.Nil(t, err)
+	assert.Empty(t, co.Items)
+
+	// delete
+	req, _ = http.NewRequest("DELETE", "/api/collections/"+id, nil)
+	assertNotOK(t, send(other, req))
+	req, _ = http.NewRequest("DELETE", "/api/collections/"+id, nil)
+	assertOK(t, send(owner, req))
+
+	_, err = getCollectionById(id)
+	assert.Equal(t, errCollectionNotFound, err)
+}
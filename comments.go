@@ -16,7 +16,7 @@ import (
 )
 
 func commentsHandlers() {
-	r.POST("/api/comments/add/:dreamId", jwtAuth, addCommentHandler)
+	r.POST("/api/comments/add/:dreamId", jwtAuth, rateLimit("comments"), addCommentHandler)
 }
 
 type comment struct {
@@ -42,6 +42,14 @@ func addCommentHandler(c *gin.Context) {
 		return
 	}
 
+	if _, err := getVisibleDream(dreamId, c.GetString("uuid")); err == errDreamNotFound {
+		badRequest(c, err)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
 	co := comment{
 		ID:      uuid.New().String(),
 		Text:    text,
@@ -57,6 +65,11 @@ func addCommentHandler(c *gin.Context) {
 		return
 	}
 
+	if err = refreshExplore(context.TODO(), dreamId); err != nil {
+		internalError(c, err)
+		return
+	}
+
 	ok(c)
 }
 
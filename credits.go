@@ -0,0 +1,260 @@
+package dream
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// reasons of the credit changes
+const (
+	creditSignup = "signup"
+	creditDream  = "dream"
+	creditRefund = "refund"
+	creditGrant  = "grant"
+)
+
+var errInsufficientCredits = errors.New("credits.insufficient")
+
+// entry of the append-only credit ledger
+type ledgerEntry struct {
+	ID      string    `json:"_id" bson:"_id"`
+	User    string    `json:"user" bson:"user"`       // user's id
+	Amount  int64     `json:"amount" bson:"amount"`   // positive for income, negative for expense
+	Balance int64     `json:"balance" bson:"balance"` // balance after the change
+	Reason  string    `json:"reason" bson:"reason"`   // "signup", "dream", "refund" or "grant"
+	Dream   string    `json:"dream,omitempty" bson:"dream,omitempty"`
+	By      string    `json:"by,omitempty" bson:"by,omitempty"` // admin who granted the credits
+	Note    string    `json:"note,omitempty" bson:"note,omitempty"`
+	Created time.Time `json:"created" bson:"created"`
+}
+
+func creditsHandlers() {
+	r.GET("/api/credits", jwtAuth, creditsHandler)
+	r.POST("/api/admin/credits/grant", jwtAuth, adminAuth, grantCreditsHandler)
+}
+
+// dreamCost charges one credit for every "creditUnit" of work,
+// the default dream (50 steps, 512x512, one image) costs one credit
+func dreamCost(d *dream) int64 {
+	cost := int64(math.Ceil(workUnits(d) / viper.GetFloat64("creditUnit")))
+	if cost < 1 {
+		cost = 1
+	}
+	return cost
+}
+
+// user's balance and ledger history, the newest first
+func creditsHandler(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "0"))
+	if err != nil || page < 0 {
+		badRequest(c, errors.New("invalid.input"))
+		return
+	}
+
+	uid := c.GetString("uuid")
+	usr, err := getUserById(uid)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	history, err := getLedger(uid, page)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":      true,
+		"balance": usr.Credits,
+		"history": history,
+	})
+}
+
+// admin grants credits to the user, or takes them back with a negative amount
+func grantCreditsHandler(c *gin.Context) {
+	amount, err := strconv.ParseInt(c.PostForm("amount"), 10, 64)
+	if err != nil || amount == 0 {
+		badRequest(c, errors.New("credits.invalid.amount"))
+		return
+	}
+
+	usr, err := findUsrByName(c.PostForm("username"), bson.M{"_id": 1})
+	if err == mongo.ErrNoDocuments {
+		badRequest(c, errors.New("credits.invalid.user"))
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	entry := &ledgerEntry{
+		User:   usr["_id"].(string),
+		Amount: amount,
+		Reason: creditGrant,
+		By:     c.GetString("username"),
+		Note:   strings.TrimSpace(c.PostForm("note")),
+	}
+
+	if err = changeCredits(entry); err == errInsufficientCredits {
+		badRequest(c, err)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	l.Infoln("GRANT_CREDITS", entry.User, amount, "by", entry.By)
+	c.JSON(http.StatusOK, gin.H{
+		"ok":      true,
+		"balance": entry.Balance,
+	})
+}
+
+// changeCredits updates the user's balance atomically, the balance can't be negative,
+// then appends the change to the ledger
+func changeCredits(entry *ledgerEntry) error {
+	filter := bson.M{"_id": entry.User}
+	if entry.Amount < 0 {
+		filter["credits"] = bson.M{"$gte": -entry.Amount}
+	}
+
+	var usr user
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"credits": 1})
+	err := users.FindOneAndUpdate(context.TODO(), filter, bson.M{"$inc": bson.M{"credits": entry.Amount}}, opts).Decode(&usr)
+	if err == mongo.ErrNoDocuments {
+		return errInsufficientCredits
+	} else if err != nil {
+		return err
+	}
+
+	entry.ID = uuid.New().String()
+	entry.Balance = usr.Credits
+	entry.Created = time.Now()
+	if _, err = ledger.InsertOne(context.TODO(), entry); err != nil {
+		return err
+	}
+
+	// clear cache of the user
+	return expires("u:" + entry.User)
+}
+
+// chargeDream debits the cost of the dream from its author
+func chargeDream(d *dream) error {
+	d.Cost = dreamCost(d)
+	return changeCredits(&ledgerEntry{User: d.AuthorID, Amount: -d.Cost, Reason: creditDream, Dream: d.ID})
+}
+
+// refundDream gives the cost back to the author, only once for each dream
+func refundDream(d *dream) error {
+	if d.Cost == 0 {
+		return nil
+	}
+
+	res, err := dreams.UpdateOne(context.TODO(),
+		bson.M{"_id": d.ID, "refunded": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"refunded": true}})
+	if err != nil {
+		return err
+	}
+
+	if res.ModifiedCount == 0 {
+		return nil // refunded already
+	}
+
+	d.Refunded = true
+	if err = expires("d:" + d.ID); err != nil {
+		return err
+	}
+
+	l.Infoln("REFUND_DREAM", d.ID, d.Cost)
+	return changeCredits(&ledgerEntry{User: d.AuthorID, Amount: d.Cost, Reason: creditRefund, Dream: d.ID})
+}
+
+// give the starting credits to the users who signed up before the credits were introduced
+func backfillCredits(ctx context.Context) {
+	cursor, err := users.Find(ctx, bson.M{"credits": bson.M{"$exists": false}},
+		options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		l.Errorln("backfill credits failed:", err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	amount := viper.GetInt64("signupCredits")
+	n := 0
+	for cursor.Next(ctx) {
+		var usr user
+		if err := cursor.Decode(&usr); err != nil {
+			l.Errorln("backfill credits failed:", err)
+			return
+		}
+
+		// other instances may be backfilling too, so only the one who set it records the ledger
+		res, err := users.UpdateOne(ctx,
+			bson.M{"_id": usr.ID, "credits": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"credits": amount}})
+		if err != nil {
+			l.Errorln("backfill credits failed:", usr.ID, err)
+			return
+		}
+
+		if res.ModifiedCount == 0 {
+			continue
+		}
+
+		if _, err = ledger.InsertOne(ctx, &ledgerEntry{
+			ID:      uuid.New().String(),
+			User:    usr.ID,
+			Amount:  amount,
+			Balance: amount,
+			Reason:  creditSignup,
+			Note:    "backfill",
+			Created: time.Now(),
+		}); err != nil {
+			l.Errorln("backfill credits failed:", usr.ID, err)
+			return
+		}
+
+		if err = expires("u:" + usr.ID); err != nil {
+			l.Errorln("backfill credits failed:", usr.ID, err)
+			return
+		}
+		n++
+	}
+
+	if n > 0 {
+		l.Infoln("BACKFILL_CREDITS", n)
+	}
+}
+
+func getLedger(uid string, page int) ([]*ledgerEntry, error) {
+	perPage := int64(viper.GetInt("ledgerPerPage"))
+	opts := options.Find().
+		SetSort(bson.M{"created": -1}).
+		SetSkip(perPage * int64(page)).
+		SetLimit(perPage)
+
+	cur, err := ledger.Find(context.TODO(), bson.M{"user": uid}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*ledgerEntry, 0)
+	if err = cur.All(context.TODO(), &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
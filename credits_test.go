@@ -0,0 +1,142 @@
+package dream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestDreamCost(t *testing.T) {
+	viper.SetDefault("creditUnit", 50*512*512)
+
+	assert.Equal(t, int64(1), dreamCost(&dream{Steps: 50, Width: 512, Height: 512}))
+	assert.Equal(t, int64(2), dreamCost(&dream{Steps: 51, Width: 512, Height: 512}))
+	assert.Equal(t, int64(4), dreamCost(&dream{Steps: 50, Width: 512, Height: 512, Batch: 4}))
+	assert.Equal(t, int64(4), dreamCost(&dream{Steps: 50, Width: 1024, Height: 1024}))
+	assert.Equal(t, int64(1), dreamCost(&dream{Steps: 1, Width: 256, Height: 256}))
+}
+
+func TestCredits(t *testing.T) {
+	testSetup()
+
+	ctx := context.TODO()
+	rdb.Del(ctx, queueOf(testModel))
+
+	defer func() {
+		if err := delUsrByName("tester032"); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	w := testLogin(t, "tester032")
+	token, c := testJwtToken(t, w)
+	defer ledger.DeleteMany(ctx, bson.M{"user": c.ID})
+
+	getCredits := func() map[string]interface{} {
+		req, _ := http.NewRequest("GET", "/api/credits", nil)
+		req.AddCookie(token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return assertOK(t, w)
+	}
+
+	signup := viper.GetFloat64("signupCredits")
+	body := getCredits()
+	assert.Equal(t, signup, body["balance"])
+	assert.Equal(t, 1, len(body["history"].([]interface{})))
+
+	// charged by the dream's cost
+	d := newTestDream()
+	cost := dreamCost(d)
+	id := testPostDream(t, token, d)
+	defer dreams.DeleteOne(ctx, bson.M{"_id": id})
+
+	body = getCredits()
+	assert.Equal(t, signup-float64(cost), body["balance"])
+	history := body["history"].([]interface{})
+	assert.Equal(t, 2, len(history))
+	assert.Equal(t, creditDream, history[0].(map[string]interface{})["reason"])
+	assert.Equal(t, id, history[0].(map[string]interface{})["dream"])
+
+	// refunded when cancelled before processing
+	req, _ := http.NewRequest("POST", "/api/dream/cancel/"+id, nil)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertOK(t, w)
+
+	body = getCredits()
+	assert.Equal(t, signup, body["balance"])
+
+	// refunded only once
+	dr, err := getDreamById(id)
+	assert.Nil(t, err)
+	assert.True(t, dr.Refunded)
+	assert.Nil(t, refundDream(dr))
+	body = getCredits()
+	assert.Equal(t, signup, body["balance"])
+	assert.Equal(t, 3, len(body["history"].([]interface{})))
+
+	// not enough credits
+	assert.Nil(t, changeCredits(&ledgerEntry{User: c.ID, Amount: -int64(signup), Reason: creditGrant}))
+	req, _ = postJsonReq("/api/dream/new", newTestDream())
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertNotOK(t, w)
+	assert.Equal(t, errInsufficientCredits, changeCredits(&ledgerEntry{User: c.ID, Amount: -1, Reason: creditGrant}))
+
+	// granted by admins only
+	grant := map[string]string{"username": "tester032", "amount": "10", "note": "welcome back"}
+	req, _ = postFormReq("/api/admin/credits/grant", grant)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertNotOK(t, w)
+
+	viper.Set("admins", []string{"tester032"})
+	defer viper.Set("admins", []string{})
+
+	req, _ = postFormReq("/api/admin/credits/grant", grant)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	body = assertOK(t, w)
+	assert.Equal(t, float64(10), body["balance"])
+
+	body = getCredits()
+	assert.Equal(t, float64(10), body["balance"])
+	entry := body["history"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, creditGrant, entry["reason"])
+	assert.Equal(t, "tester032", entry["by"])
+}
+
+func TestBackfillCredits(t *testing.T) {
+	testSetup()
+
+	ctx := context.TODO()
+	id := uuid.New().String()
+	if _, err := users.InsertOne(ctx, bson.M{"_id": id, "username": "tester052", "email": "tester052@test.com"}); err != nil {
+		t.Fatal(err)
+	}
+	defer users.DeleteOne(ctx, bson.M{"_id": id})
+	defer ledger.DeleteMany(ctx, bson.M{"user": id})
+
+	backfillCredits(ctx)
+	backfillCredits(ctx) // only once
+
+	usr, err := getUserById(id)
+	assert.Nil(t, err)
+	assert.Equal(t, viper.GetInt64("signupCredits"), usr.Credits)
+
+	entries, err := getLedger(id, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, creditSignup, entries[0].Reason)
+}
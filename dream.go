@@ -1,6 +1,7 @@
 package dream
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"time"
@@ -8,6 +9,8 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v9"
 	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -19,6 +22,8 @@ const (
 	dsDone
 	dsFailed
 	dsNsfw
+	dsCancelled
+	dsReview // held by the prompt rules until a moderator approves it
 )
 
 type dream struct {
@@ -30,21 +35,66 @@ type dream struct {
 	Height int     `json:"height" bson:"height"`
 	Seed   int64   `json:"seed" bson:"seed"`
 
+	NegativePrompt string `json:"negativePrompt" bson:"negativePrompt"`
+	Sampler        string `json:"sampler" bson:"sampler"`
+	Model          string `json:"model" bson:"model"`           // model or checkpoint name
+	ClipSkip       int    `json:"clipSkip" bson:"clipSkip"`     // skip the last layers of CLIP
+	Batch          int    `json:"batch" bson:"batch"`           // number of images to generate
+	Visibility     string `json:"visibility" bson:"visibility"` // "public", "unlisted" or "private"
+
 	// following data will be generated at server side
 	Author   string      `json:"author" bson:"author"`
 	AuthorID string      `json:"authorId" bson:"authorId"`
 	Status   dreamStatus `json:"status" bson:"status"`
 	Images   []string    `json:"image" bson:"image"`
 
+	Renditions []rendition `json:"renditions" bson:"renditions"` // resized copies of the images
+
+	Moderation *moderation `json:"moderation,omitempty" bson:"moderation,omitempty"` // nsfw moderation result
+	Blurred    []string    `json:"blurred" bson:"blurred"`                           // blurred images of the flagged dream
+
 	Created  time.Time `json:"created" bson:"created"`
 	Finished time.Time `json:"finished" bson:"finished"`
 
-	Likes []string `json:"likes" bson:"likes"`
+	Likes      []string `json:"likes" bson:"likes"`
+	Bookmarked bool     `json:"bookmarked" bson:"-"` // saved by the current user, never stored
+
+	Attempts   []attempt `json:"attempts" bson:"attempts"`     // generating attempts history
+	Retries    int       `json:"retries" bson:"retries"`       // failed attempts since queued
+	FailReason string    `json:"failReason" bson:"failReason"` // reason of the last failure
+
+	Cost     int64 `json:"cost" bson:"cost"`                   // credits charged
+	Refunded bool  `json:"refunded" bson:"refunded,omitempty"` // never reset by updating the whole dream
+
+	Tags  []string `json:"tags" bson:"tags"`         // hashtags in the prompt
+	Terms []string `json:"-" bson:"terms,omitempty"` // search terms of the prompt, never reset by updating the whole dream
+
+	TagsCounted bool `json:"-" bson:"tagsCounted,omitempty"` // tags counted in the popular tags, only read from the db
+
+	ParentID string `json:"parentId" bson:"parentId"` // the dream remixed from
+	RootID   string `json:"rootId" bson:"rootId"`     // the first dream of the remix tree
+}
+
+type attempt struct {
+	Worker  string    `json:"worker" bson:"worker"`
+	Started time.Time `json:"started" bson:"started"`
+	Ended   time.Time `json:"ended" bson:"ended"`
+	Error   string    `json:"error" bson:"error"`
+}
+
+// work units of the dream, used to estimate the generating time
+func workUnits(d *dream) float64 {
+	batch := d.Batch
+	if batch < 1 {
+		batch = 1
+	}
+	return float64(d.Steps) * float64(d.Width) * float64(d.Height) * float64(batch)
 }
 
 func dreamHandlers() {
-	r.POST("/api/dream/new", jwtAuth, newDreamHandler)
+	r.POST("/api/dream/new", jwtAuth, rateLimit("dreams"), newDreamHandler)
 	r.GET("/api/dream/status/:id", jwtAuth, dreamStatusHandler)
+	r.POST("/api/dream/cancel/:id", jwtAuth, cancelDreamHandler)
 }
 
 // create a new dream
@@ -62,17 +112,78 @@ func newDreamHandler(c *gin.Context) {
 		return
 	}
 
+	// lineage can only be set by remixing
+	d.ParentID = ""
+	d.RootID = ""
+
+	createDream(c, d)
+}
+
+// fill the params of the dream, then put it into the queue
+func createDream(c *gin.Context, d *dream) {
+	// fill the omitted params, then check them
+	if err := fillDefaults(d); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if err := validateDream(d); err != nil {
+		badRequest(c, err)
+		return
+	}
+
 	d.ID = uuid.New().String()
 	d.Status = dsPending
 	d.Created = time.Now()
+	d.Finished = time.Time{}
 	d.Author = c.GetString("username") // add author name by http-only cookie
 	d.AuthorID = c.GetString("uuid")   // add author id by http-only cookie
 	d.Likes = make([]string, 0)
+	d.Images = make([]string, 0)
+	d.Renditions = make([]rendition, 0)
+	d.Moderation = nil
+	d.Blurred = make([]string, 0)
+	d.Attempts = make([]attempt, 0)
+	d.Retries = 0
+	d.FailReason = ""
+	d.Terms = searchTerms(d.Prompt, true)
+	d.Tags = extractTags(d.Prompt)
+
+	// filter the prompt before wasting any gpu time
+	m, err := matchPrompt(c.Request.Context(), d.Prompt)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	switch m.Action {
+	case actionReject:
+		l.Infoln("BLOCK_DREAM", d.Author, "rules:", m.Rules)
+		badRequest(c, errPromptBlocked)
+		return
+	case actionReview:
+		d.Status = dsReview
+	case actionNsfw:
+		d.Moderation = &moderation{Flagged: true, Labels: m.Rules, Score: 1, By: "rules", Updated: d.Created}
+	}
+
+	d.Cost = 0
+	d.Refunded = false
+	if err = chargeDream(d); err == errInsufficientCredits {
+		badRequest(c, err)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
 
 	l.Debugln("new dream:", d)
 
 	err = addDream(d) // insert it into mongodb, then cache it with redis
 	if err != nil {
+		if e := discardDream(d); e != nil {
+			l.Errorln("refund failed", d.ID, e)
+		}
 		internalError(c, err)
 		return
 	}
@@ -83,22 +194,153 @@ func newDreamHandler(c *gin.Context) {
 	})
 }
 
-// get dream status
+// discardDream refunds the dream which failed to be added,
+// it may be saved but not queued, so remove it first, then it can't be cancelled and refunded again
+func discardDream(d *dream) error {
+	if _, err := dreams.DeleteOne(context.TODO(), bson.M{"_id": d.ID}); err != nil {
+		// still saved, refund it only once
+		return refundDream(d)
+	}
+	return changeCredits(&ledgerEntry{User: d.AuthorID, Amount: d.Cost, Reason: creditRefund, Dream: d.ID})
+}
+
+// get dream status, with queue position and estimated time for unfinished dream
 func dreamStatusHandler(c *gin.Context) {
 	dreamId := c.Param("id")
 	if len(dreamId) == 0 {
 		badRequest(c, errors.New("dream.invalid.params"))
+		return
 	}
 
-	d, err := getDreamById(dreamId)
-	if err == redis.Nil || err == mongo.ErrNoDocuments {
-		badRequest(c, errors.New("dream.invalid.notFound"))
+	d, err := getVisibleDream(dreamId, c.GetString("uuid"))
+	if err == errDreamNotFound {
+		badRequest(c, err)
+		return
 	} else if err != nil {
 		internalError(c, err)
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	res := gin.H{
 		"ok":     true,
 		"status": d.Status,
-	})
+	}
+
+	if d.Status == dsPending || d.Status == dsProcessing {
+		ctx := c.Request.Context()
+		stats, err := getQueueStats(ctx, d.Model)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		var position int64
+		var progress float64
+
+		if d.Status == dsPending {
+			position, err = queuePosition(ctx, d)
+			if err == nil {
+				res["position"] = position
+			} else if err != redis.Nil { // not in the queue, maybe waiting for retry
+				internalError(c, err)
+				return
+			}
+		} else {
+			step, total, err := getProgress(d.ID)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			if total > 0 {
+				res["step"] = step
+				res["total"] = total
+				progress = float64(step) / float64(total)
+			}
+		}
+
+		res["workers"] = stats.Workers
+		if eta := estimate(stats, d, position, progress); eta > 0 {
+			res["eta"] = eta.Seconds()
+		}
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// cancel the pending or processing dream, only the author can do it
+func cancelDreamHandler(c *gin.Context) {
+	d, err := getDreamById(c.Param("id"))
+	if err == redis.Nil || err == mongo.ErrNoDocuments {
+		badRequest(c, errors.New("dream.invalid.notFound"))
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if d.AuthorID != c.GetString("uuid") {
+		permissionError(c, errors.New("dream.cancel.notAuthor"))
+		return
+	}
+
+	if d.Status != dsPending && d.Status != dsProcessing && d.Status != dsReview {
+		badRequest(c, errors.New("dream.cancel.finished"))
+		return
+	}
+
+	if err = cancelDream(d); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	ok(c)
+}
+
+// cancelDream removes the pending dream from the queue,
+// or signals the worker which is processing it to stop
+func cancelDream(d *dream) error {
+	ctx := context.TODO()
+
+	switch d.Status {
+	case dsReview:
+		// not queued yet
+	case dsPending:
+		if err := dequeueDream(ctx, d.ID); err != nil {
+			return err
+		}
+	default:
+		if err := rdb.Set(ctx, "d:"+d.ID+":cancel", 1, viper.GetDuration("queueVisibility")*2).Err(); err != nil {
+			return err
+		}
+	}
+
+	// nothing generated yet, give the credits back
+	if d.Status == dsPending || d.Status == dsReview {
+		if err := refundDream(d); err != nil {
+			return err
+		}
+	}
+
+	d.Status = dsCancelled
+	d.Finished = time.Now()
+
+	l.Infoln("CANCEL_DREAM", d.ID)
+	if err := updateDream(d, bson.M{"status": d.Status, "finished": d.Finished}, false); err != nil {
+		return err
+	}
+	return onDreamFinished(d)
+}
+
+// whether the processing dream is cancelled by its author, or deleted
+func isCancelled(id string) (bool, error) {
+	n, err := rdb.Exists(context.TODO(), "d:"+id+":cancel").Result()
+	if err != nil || n > 0 {
+		return n > 0, err
+	}
+
+	_, err = getDreamById(id)
+	if err == redis.Nil || err == mongo.ErrNoDocuments {
+		return true, nil
+	}
+	return false, err
 }
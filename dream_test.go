@@ -10,10 +10,14 @@ import (
 
 	"github.com/go-redis/redis/v9"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
+const testModel = "sd-v1-5"
+
 func newTestDream() *dream {
 	return &dream{
+		Model:  testModel,
 		Prompt: "Hello, World!",
 		Steps:  51,
 		Scale:  7.5,
@@ -23,8 +27,24 @@ func newTestDream() *dream {
 	}
 }
 
+// post a new dream, and return its id
+func testPostDream(t *testing.T, token *http.Cookie, d *dream) string {
+	req, err := postJsonReq("/api/dream/new", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(token)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	body := assertOK(t, w)
+
+	return body["id"].(string)
+}
+
 func sdSimulating(ctx context.Context) {
 	timeout := time.Second * 10 // 10 seconds
+	worker := "sd-simulating"
 
 	// l.Debugln("stable diffusion canceled")
 	for {
@@ -34,7 +54,7 @@ func sdSimulating(ctx context.Context) {
 			return
 		default:
 			l.Debugln("stable diffusion start fetching job")
-			res, err := rdb.BLPop(ctx, timeout, "DQ").Result()
+			dreamId, err := claimJob(ctx, worker, []string{testModel}, timeout)
 			if err != nil && err != redis.Nil && err != context.Canceled { // if something wrong
 				l.Fatal(err)
 				// l.Debugln("queue failed", err)
@@ -44,8 +64,6 @@ func sdSimulating(ctx context.Context) {
 				return
 			}
 
-			dreamId := res[1]
-
 			d, err := getDreamById(dreamId)
 			if err != nil {
 				l.Panic(err, dreamId)
@@ -54,7 +72,7 @@ func sdSimulating(ctx context.Context) {
 
 			// update dream status
 			d.Status = dsProcessing
-			err = updateDream(d, false)
+			err = updateDream(d, bson.M{"status": d.Status}, false)
 			if err != nil {
 				// l.Debugln("queue failed", err)
 				l.Panic(err)
@@ -72,7 +90,18 @@ func sdSimulating(ctx context.Context) {
 			now := time.Now()
 			d.Finished = now
 
-			err = updateDream(d, false)
+			err = updateDream(d, bson.M{"status": d.Status, "image": d.Images, "finished": d.Finished}, false)
+			if err != nil {
+				l.Panic(err)
+			}
+
+			// acknowledge the job
+			err = completeJob(ctx, worker, dreamId)
+			if err != nil {
+				l.Panic(err)
+			}
+
+			err = onDreamFinished(d)
 			if err != nil {
 				l.Panic(err)
 			}
@@ -159,6 +188,8 @@ func TestDreamStatus(t *testing.T) {
 	r.ServeHTTP(w, req)
 	body = assertOK(t, w)
 	assert.Equal(t, body["status"], float64(dsPending))
+	assert.Contains(t, body, "position")
+	assert.Contains(t, body, "workers")
 }
 
 func TestDreamUpdate(t *testing.T) {
@@ -224,4 +255,101 @@ func TestDreamUpdate(t *testing.T) {
 
 	assert.Nil(t, err)
 	assert.Equal(t, n+1, len(usr.Outbox))
+
+	// only the changed fields are saved, the renditions pushed meanwhile are kept
+	d, err := getDreamById(usr.Outbox[0].Dream)
+	assert.Nil(t, err)
+	_, err = dreams.UpdateByID(context.TODO(), d.ID, bson.M{"$push": bson.M{"renditions": &rendition{Name: "thumb"}}})
+	assert.Nil(t, err)
+
+	d.FailReason = "tester"
+	assert.Nil(t, updateDream(d, bson.M{"failReason": d.FailReason}, false))
+
+	d, err = getDreamById(d.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "tester", d.FailReason)
+	assert.Equal(t, 1, len(d.Renditions))
+}
+
+func TestCancelDream(t *testing.T) {
+	testWorkerSetup()
+
+	defer func() {
+		if err := delUsrByName("tester023"); err != nil {
+			t.Fatal(err)
+		}
+		if err := delUsrByName("tester024"); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	ctx := context.TODO()
+	rdb.Del(ctx, queueOf(testModel))
+
+	w := testLogin(t, "tester023")
+	token, _ := testJwtToken(t, w)
+
+	w = testLogin(t, "tester024")
+	other, _ := testJwtToken(t, w)
+
+	cancel := func(id string, token *http.Cookie) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/dream/cancel/"+id, nil)
+		req.AddCookie(token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// cancel a pending dream
+	id := testPostDream(t, token, newTestDream())
+
+	assertNotOK(t, cancel(id, other)) // not the author
+	assertOK(t, cancel(id, token))
+
+	_, err := queuePosition(ctx, &dream{ID: id, Model: testModel})
+	assert.Equal(t, redis.Nil, err)
+
+	d, err := getDreamById(id)
+	assert.Nil(t, err)
+	assert.Equal(t, dsCancelled, d.Status)
+
+	assertNotOK(t, cancel(id, token)) // already cancelled
+
+	// cancel a processing dream
+	id = testPostDream(t, token, newTestDream())
+
+	w = claimReq()
+	assertOK(t, w)
+
+	assertOK(t, cancel(id, token))
+
+	w = workerReq("POST", "/api/worker/progress/"+id, nil, "")
+	body := assertOK(t, w)
+	assert.Equal(t, true, body["cancelled"])
+
+	// the job was released
+	owned, err := isJobOwner(ctx, "tester-worker", id)
+	assert.Nil(t, err)
+	assert.False(t, owned)
+
+	d, err = getDreamById(id)
+	assert.Nil(t, err)
+	assert.Equal(t, dsCancelled, d.Status)
+
+	// cancelled between claimed and started, it's never generated
+	id = testPostDream(t, token, newTestDream())
+	claimed, err := claimJob(ctx, "tester-worker", []string{testModel}, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, id, claimed)
+
+	d, err = getDreamById(id)
+	assert.Nil(t, err)
+	assert.Nil(t, cancelDream(d))
+	assert.Equal(t, errDreamNotPending, startAttempt(id, "tester-worker"))
+
+	d, err = getDreamById(id)
+	assert.Nil(t, err)
+	assert.Equal(t, dsCancelled, d.Status)
+	assert.Equal(t, 0, len(d.Attempts))
+	assert.Nil(t, completeJob(ctx, "tester-worker", id))
 }
@@ -0,0 +1,235 @@
+package dream
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v9"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sorted sets of the finished public dreams in the explore window
+const (
+	exploreNewKey = "explore:new" // scored by finished time
+	exploreHotKey = "explore:hot" // scored by engagement and recency
+	exploreTopKey = "explore:top" // scored by engagement only
+)
+
+// modes of the explore feed
+const (
+	exploreHot  = "hot"  // engagement decayed by time
+	exploreNew  = "new"  // newest first
+	exploreDay  = "day"  // top of the last day
+	exploreWeek = "week" // top of the last week
+)
+
+var errInvalidExploreMode = errors.New("explore.invalid.mode")
+
+func exploreHandlers() {
+	r.GET("/api/explore", jwtAuth, exploreHandler)
+}
+
+// get the explore feed, eg: /api/explore?mode=day&page=1
+func exploreHandler(c *gin.Context) {
+	mode := c.DefaultQuery("mode", exploreHot)
+	page, err := strconv.Atoi(c.DefaultQuery("page", "0"))
+	if err != nil || page < 0 {
+		badRequest(c, errors.New("explore.invalid.page"))
+		return
+	}
+
+	ids, err := getExplore(c.Request.Context(), mode, page)
+	if err == errInvalidExploreMode {
+		badRequest(c, err)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	uid := c.GetString("uuid")
+	ds := make([]*dream, 0, len(ids))
+	for _, id := range ids {
+		d, err := getDreamById(id)
+		if err == redis.Nil || err == mongo.ErrNoDocuments {
+			continue // deleted
+		} else if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		if !canListDream(d, uid) {
+			continue
+		}
+		ds = append(ds, d)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":     true,
+		"dreams": ds,
+	})
+}
+
+// getExplore returns a page of the dreams' ids by the mode
+func getExplore(ctx context.Context, mode string, page int) ([]string, error) {
+	key := ""
+	switch mode {
+	case exploreHot:
+		key = exploreHotKey
+	case exploreNew:
+		key = exploreNewKey
+	case exploreDay:
+		key = exploreTopKey + ":" + exploreDay
+		if err := buildTopOf(ctx, key, time.Hour*24); err != nil {
+			return nil, err
+		}
+	case exploreWeek:
+		key = exploreTopKey + ":" + exploreWeek
+		if err := buildTopOf(ctx, key, time.Hour*24*7); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errInvalidExploreMode
+	}
+
+	pp := int64(viper.GetInt("explorePerPage"))
+	start := pp * int64(page)
+	return rdb.ZRevRange(ctx, key, start, start+pp-1).Result()
+}
+
+// copy the engagement scores of the dreams finished since ARGV[1] into the cached sorted set,
+// KEYS[1]: new, KEYS[2]: top, KEYS[3]: destination
+// ARGV[1]: min finished time, ARGV[2]: expiration in seconds
+var topOfScript = redis.NewScript(`
+local ids = redis.call("ZRANGEBYSCORE", KEYS[1], ARGV[1], "+inf")
+redis.call("DEL", KEYS[3])
+for _, id in ipairs(ids) do
+	local score = redis.call("ZSCORE", KEYS[2], id)
+	redis.call("ZADD", KEYS[3], score or 0, id)
+end
+redis.call("EXPIRE", KEYS[3], ARGV[2])
+return #ids
+`)
+
+// build the top dreams of the period if it's not cached
+func buildTopOf(ctx context.Context, key string, period time.Duration) error {
+	n, err := rdb.Exists(ctx, key).Result()
+	if err != nil || n > 0 {
+		return err
+	}
+
+	since := time.Now().Add(-period).Unix()
+	exp := int64(viper.GetDuration("exploreTopExp") / time.Second)
+	return topOfScript.Run(ctx, rdb, []string{exploreNewKey, exploreTopKey, key}, since, max64(exp, 1)).Err()
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// engagement of the dream, comments are weighted by "exploreCommentWeight"
+func engagement(likes int, comments int64) float64 {
+	return float64(likes) + float64(comments)*viper.GetFloat64("exploreCommentWeight")
+}
+
+// hotScore ranks the dream by its engagement's order of magnitude and its finished time,
+// the dream finished "exploreDecay" later is worth 10 times more engagement
+func hotScore(engaged float64, finished time.Time) float64 {
+	decay := viper.GetDuration("exploreDecay").Seconds()
+	return math.Log10(math.Max(engaged, 1)) + float64(finished.Unix())/decay
+}
+
+// add the finished public dream into the explore feed
+func addExplore(ctx context.Context, id string) error {
+	var d dream
+	opts := options.FindOne().SetProjection(bson.M{"status": 1, "visibility": 1, "finished": 1, "likes": 1})
+	err := dreams.FindOne(ctx, bson.M{"_id": id}, opts).Decode(&d)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if d.Status != dsDone || !isPublic(&d) {
+		return removeExplore(ctx, id)
+	}
+
+	// too old to be explored
+	if time.Since(d.Finished) > viper.GetDuration("exploreWindow") {
+		return nil
+	}
+
+	n, err := comments.CountDocuments(ctx, bson.M{"dream": id})
+	if err != nil {
+		return err
+	}
+
+	engaged := engagement(len(d.Likes), n)
+	if _, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, exploreNewKey, redis.Z{Score: float64(d.Finished.Unix()), Member: id})
+		pipe.ZAdd(ctx, exploreHotKey, redis.Z{Score: hotScore(engaged, d.Finished), Member: id})
+		pipe.ZAdd(ctx, exploreTopKey, redis.Z{Score: engaged, Member: id})
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return trimExplore(ctx)
+}
+
+// refresh the dream's scores when it's liked or commented,
+// the dreams which are not in the explore feed are skipped
+func refreshExplore(ctx context.Context, id string) error {
+	err := rdb.ZScore(ctx, exploreNewKey, id).Err()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return addExplore(ctx, id)
+}
+
+func removeExplore(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	members := make([]interface{}, len(ids))
+	for i, id := range ids {
+		members[i] = id
+	}
+
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, exploreNewKey, members...)
+		pipe.ZRem(ctx, exploreHotKey, members...)
+		pipe.ZRem(ctx, exploreTopKey, members...)
+		return nil
+	})
+	return err
+}
+
+// remove the dreams finished before the explore window
+func trimExplore(ctx context.Context) error {
+	before := time.Now().Add(-viper.GetDuration("exploreWindow")).Unix()
+	ids, err := rdb.ZRangeByScore(ctx, exploreNewKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + strconv.FormatInt(before, 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	return removeExplore(ctx, ids...)
+}
@@ -0,0 +1,126 @@
+package dream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestHotScore(t *testing.T) {
+	viper.SetDefault("exploreDecay", time.Hour*12)
+	viper.SetDefault("exploreCommentWeight", 2.0)
+
+	now := time.Now()
+	assert.Equal(t, float64(5), engagement(1, 2))
+
+	// newer is hotter with the same engagement
+	assert.True(t, hotScore(10, now) > hotScore(10, now.Add(-time.Hour)))
+	// 10x engagement is worth being "exploreDecay" newer
+	assert.InDelta(t, hotScore(1, now), hotScore(10, now.Add(-time.Hour*12)), 1e-6)
+	// no engagement is the same as one
+	assert.Equal(t, hotScore(0, now), hotScore(1, now))
+}
+
+func orderOf(ids []string, want ...string) []string {
+	in := map[string]bool{}
+	for _, id := range want {
+		in[id] = true
+	}
+
+	var res []string
+	for _, id := range ids {
+		if in[id] {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+func TestExplore(t *testing.T) {
+	testSetup()
+
+	defer func() {
+		if err := delUsrByName("tester039"); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	w := testLogin(t, "tester039")
+	token, c := testJwtToken(t, w)
+
+	ctx := context.TODO()
+	rdb.Del(ctx, exploreTopKey+":"+exploreDay, exploreTopKey+":"+exploreWeek)
+
+	now := time.Now()
+	newDream := func(finished time.Time, likes int, vis string) string {
+		d := &dream{
+			ID: uuid.New().String(), AuthorID: c.ID, Author: "tester039",
+			Status: dsDone, Visibility: vis, Created: finished, Finished: finished,
+			Likes: make([]string, 0),
+		}
+		for i := 0; i < likes; i++ {
+			d.Likes = append(d.Likes, uuid.New().String())
+		}
+		if _, err := dreams.InsertOne(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+		if err := addExplore(ctx, d.ID); err != nil {
+			t.Fatal(err)
+		}
+		return d.ID
+	}
+
+	fresh := newDream(now, 0, visPublic)
+	popular := newDream(now.Add(-time.Hour*2), 50, visPublic)
+	old := newDream(now.Add(-time.Hour*24*3), 100, visPublic)
+	expired := newDream(now.Add(-time.Hour*24*30), 1000, visPublic)
+	private := newDream(now, 10, visPrivate)
+
+	all := []string{fresh, popular, old, expired, private}
+	defer func() {
+		dreams.DeleteMany(ctx, bson.M{"authorId": c.ID})
+		removeExplore(ctx, all...)
+	}()
+
+	get := func(mode string) []string {
+		ids, err := getExplore(ctx, mode, 0)
+		assert.Nil(t, err)
+		return orderOf(ids, all...)
+	}
+
+	viper.Set("explorePerPage", 1000)
+	defer viper.Set("explorePerPage", 24)
+
+	assert.Equal(t, []string{fresh, popular, old}, get(exploreNew))
+	assert.Equal(t, []string{popular, fresh, old}, get(exploreHot))
+	assert.Equal(t, []string{popular, fresh}, get(exploreDay))
+	assert.Equal(t, []string{old, popular, fresh}, get(exploreWeek))
+
+	// refreshed by likes
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, addLike(uuid.New().String(), fresh))
+	}
+	assert.Equal(t, []string{fresh, popular, old}, get(exploreHot))
+
+	// removed when it's not public any more
+	_, err := dreams.UpdateByID(ctx, popular, bson.M{"$set": bson.M{"visibility": visUnlisted}})
+	assert.Nil(t, err)
+	assert.Nil(t, addExplore(ctx, popular))
+	assert.Equal(t, []string{fresh, old}, get(exploreNew))
+
+	_, err = getExplore(ctx, "random", 0)
+	assert.Equal(t, errInvalidExploreMode, err)
+
+	req, _ := http.NewRequest("GET", "/api/explore?mode=new", nil)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertOK(t, w)
+}
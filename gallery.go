@@ -0,0 +1,208 @@
+package dream
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	errInvalidCursor = errors.New("gallery.invalid.cursor")
+	errInvalidSort   = errors.New("gallery.invalid.sort")
+	errInvalidStatus = errors.New("gallery.invalid.status")
+	errUserNotFound  = errors.New("gallery.invalid.user")
+)
+
+// sorting of the gallery
+const (
+	sortNewest = "newest"
+	sortOldest = "oldest"
+)
+
+func galleryHandlers() {
+	r.GET("/api/gallery/id/:id", jwtAuth, galleryByIdHandler)
+	r.GET("/api/gallery/name/:name", jwtAuth, galleryByNameHandler)
+}
+
+// the position of the last dream in the page, dreams created at the same time are ordered by id
+type galleryCursor struct {
+	Created time.Time
+	ID      string
+}
+
+func (gc *galleryCursor) String() string {
+	s := strconv.FormatInt(gc.Created.UnixNano(), 10) + ":" + gc.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func parseGalleryCursor(s string) (*galleryCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return nil, errInvalidCursor
+	}
+
+	ns, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	return &galleryCursor{Created: time.Unix(0, ns), ID: parts[1]}, nil
+}
+
+type galleryQuery struct {
+	Author string        // author's id
+	Viewer string        // viewer's id
+	Status []dreamStatus // empty for all the visible statuses
+	Sort   string
+	Cursor *galleryCursor
+	Limit  int64
+}
+
+func galleryByIdHandler(c *gin.Context) {
+	usr, err := getUserById(c.Param("id"))
+	if err == mongo.ErrNoDocuments {
+		badRequest(c, errUserNotFound)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	galleryHandler(c, usr.ID)
+}
+
+func galleryByNameHandler(c *gin.Context) {
+	usr, err := findUsrByName(c.Param("name"), bson.M{"_id": 1})
+	if err == mongo.ErrNoDocuments {
+		badRequest(c, errUserNotFound)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	galleryHandler(c, usr["_id"].(string))
+}
+
+// list the author's dreams, eg: /api/gallery/name/tester?status=2&sort=oldest&cursor=xxx
+func galleryHandler(c *gin.Context, author string) {
+	q := &galleryQuery{
+		Author: author,
+		Viewer: c.GetString("uuid"),
+		Sort:   c.DefaultQuery("sort", sortNewest),
+		Limit:  viper.GetInt64("galleryPerPage"),
+	}
+
+	if q.Sort != sortNewest && q.Sort != sortOldest {
+		badRequest(c, errInvalidSort)
+		return
+	}
+
+	for _, s := range c.QueryArray("status") {
+		st, err := strconv.Atoi(s)
+		if err != nil || st < int(dsPending) || st > int(dsReview) {
+			badRequest(c, errInvalidStatus)
+			return
+		}
+		q.Status = append(q.Status, dreamStatus(st))
+	}
+
+	if cursor := c.Query("cursor"); len(cursor) > 0 {
+		gc, err := parseGalleryCursor(cursor)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+		q.Cursor = gc
+	}
+
+	ds, next, err := getGallery(q)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if _, err = censorDreams(q.Viewer, ds); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":     true,
+		"dreams": ds,
+		"next":   next,
+	})
+}
+
+// getGallery returns a page of the author's dreams, and the cursor of the next page if there is one
+func getGallery(q *galleryQuery) (ds []*dream, next string, err error) {
+	filter := bson.M{"authorId": q.Author}
+
+	// the others can only see the finished dreams which are listed
+	if q.Viewer != q.Author {
+		filter["visibility"] = bson.M{"$nin": bson.A{visUnlisted, visPrivate}}
+		filter["status"] = bson.M{"$in": bson.A{dsDone, dsNsfw}}
+	}
+
+	if len(q.Status) > 0 {
+		status := bson.A{}
+		for _, s := range q.Status {
+			// the others' unfinished dreams are never listed
+			if q.Viewer != q.Author && s != dsDone && s != dsNsfw {
+				continue
+			}
+			status = append(status, s)
+		}
+		filter["status"] = bson.M{"$in": status}
+	}
+
+	order, cmp := -1, "$lt"
+	if q.Sort == sortOldest {
+		order, cmp = 1, "$gt"
+	}
+
+	if q.Cursor != nil {
+		filter["$or"] = bson.A{
+			bson.M{"created": bson.M{cmp: q.Cursor.Created}},
+			bson.M{"created": q.Cursor.Created, "_id": bson.M{cmp: q.Cursor.ID}},
+		}
+	}
+
+	// fetch one more to know if there is a next page
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created", Value: order}, {Key: "_id", Value: order}}).
+		SetLimit(q.Limit + 1)
+
+	ctx := context.TODO()
+	cursor, err := dreams.Find(ctx, filter, opts)
+	if err != nil {
+		return
+	}
+
+	ds = make([]*dream, 0)
+	if err = cursor.All(ctx, &ds); err != nil {
+		return
+	}
+
+	if int64(len(ds)) > q.Limit {
+		ds = ds[:q.Limit]
+		last := ds[len(ds)-1]
+		next = (&galleryCursor{Created: last.Created, ID: last.ID}).String()
+	}
+	return
+}
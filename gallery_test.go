@@ -0,0 +1,118 @@
+package dream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestGalleryCursor(t *testing.T) {
+	gc := &galleryCursor{Created: time.UnixMilli(1670000000123), ID: "abc:def"}
+	parsed, err := parseGalleryCursor(gc.String())
+	assert.Nil(t, err)
+	assert.True(t, gc.Created.Equal(parsed.Created))
+	assert.Equal(t, gc.ID, parsed.ID)
+
+	for _, s := range []string{"", "!!!", "bm9jb2xvbg", "eDphYmM"} {
+		_, err = parseGalleryCursor(s)
+		assert.Equal(t, errInvalidCursor, err, s)
+	}
+}
+
+func TestGallery(t *testing.T) {
+	testSetup()
+
+	viper.Set("galleryPerPage", 3)
+	defer viper.Set("galleryPerPage", 24)
+
+	defer func() {
+		for _, name := range []string{"tester037", "tester038"} {
+			if err := delUsrByName(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}()
+
+	w := testLogin(t, "tester037")
+	author, c := testJwtToken(t, w)
+	w = testLogin(t, "tester038")
+	other, _ := testJwtToken(t, w)
+
+	// 5 public done, 1 unlisted done, 1 private done, 1 public failed, all created at the same time
+	ctx := context.TODO()
+	created := time.Now().Truncate(time.Millisecond)
+	var docs []interface{}
+	add := func(n int, status dreamStatus, vis string) {
+		for i := 0; i < n; i++ {
+			docs = append(docs, &dream{
+				ID: uuid.New().String(), AuthorID: c.ID, Author: "tester037",
+				Status: status, Visibility: vis, Created: created,
+			})
+		}
+	}
+	add(5, dsDone, visPublic)
+	add(1, dsDone, visUnlisted)
+	add(1, dsDone, visPrivate)
+	add(1, dsFailed, visPublic)
+
+	_, err := dreams.InsertMany(ctx, docs)
+	assert.Nil(t, err)
+	defer dreams.DeleteMany(ctx, bson.M{"authorId": c.ID})
+
+	// walk through all the pages
+	walk := func(addr string, token *http.Cookie) []string {
+		var ids []string
+		next := ""
+		for {
+			req, _ := http.NewRequest("GET", addr+"&cursor="+next, nil)
+			req.AddCookie(token)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			body := assertOK(t, w)
+
+			ds := body["dreams"].([]interface{})
+			assert.True(t, len(ds) <= 3)
+			for _, d := range ds {
+				ids = append(ids, d.(map[string]interface{})["_id"].(string))
+			}
+
+			next = body["next"].(string)
+			if len(next) == 0 {
+				return ids
+			}
+		}
+	}
+
+	assert.Equal(t, 8, len(walk("/api/gallery/id/"+c.ID+"?sort=newest", author)))
+	assert.Equal(t, 5, len(walk("/api/gallery/name/tester037?sort=newest", other)))
+	assert.Equal(t, 1, len(walk("/api/gallery/name/tester037?status="+strconv.Itoa(int(dsFailed)), author)))
+	assert.Equal(t, 0, len(walk("/api/gallery/name/tester037?status="+strconv.Itoa(int(dsFailed)), other)))
+
+	// oldest first is the reverse order
+	newest := walk("/api/gallery/id/"+c.ID+"?sort=newest", author)
+	oldest := walk("/api/gallery/id/"+c.ID+"?sort=oldest", author)
+	for i := range newest {
+		assert.Equal(t, newest[i], oldest[len(oldest)-1-i])
+	}
+
+	for _, addr := range []string{
+		"/api/gallery/name/nobody",
+		"/api/gallery/id/" + c.ID + "?sort=random",
+		"/api/gallery/id/" + c.ID + "?status=99",
+		"/api/gallery/id/" + c.ID + "?cursor=!!!",
+	} {
+		req, _ := http.NewRequest("GET", addr, nil)
+		req.AddCookie(author)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assertNotOK(t, w)
+	}
+}
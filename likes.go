@@ -15,8 +15,8 @@ type like struct {
 }
 
 func likesHandlers() {
-	r.GET("/api/likes/add/:dreamId", jwtAuth, addLikeHandler)
-	r.GET("/api/likes/remove/:dreamId", jwtAuth, removeLikeHandler)
+	r.GET("/api/likes/add/:dreamId", jwtAuth, rateLimit("likes"), addLikeHandler)
+	r.GET("/api/likes/remove/:dreamId", jwtAuth, rateLimit("likes"), removeLikeHandler)
 }
 
 func addLikeHandler(c *gin.Context) {
@@ -28,6 +28,14 @@ func addLikeHandler(c *gin.Context) {
 		return
 	}
 
+	if _, err := getVisibleDream(dreamId, uuid); err == errDreamNotFound {
+		badRequest(c, err)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
 	err := addLike(uuid, dreamId)
 	if err != nil {
 		internalError(c, err)
@@ -69,6 +77,10 @@ func addLike(author string, dream string) error {
 
 	l.Debugln("add like from", dream, "by", author, ":", res.ModifiedCount)
 
+	if err = refreshExplore(ctx, dream); err != nil {
+		return err
+	}
+
 	// make the cache expires in a short time
 	// NOTE: redis only takes "1 second" as minimal expiration time
 	return expiresIn("d:"+dream, viper.GetDuration("expDreamShort"))
@@ -85,6 +97,10 @@ func removeLike(author string, dream string) error {
 		return err
 	}
 
+	if err = refreshExplore(ctx, dream); err != nil {
+		return err
+	}
+
 	exp := viper.GetDuration("expDreamShort")
 	l.Debugln("remove like from", dream, "by", author, ":", res.ModifiedCount, "exp:", exp)
 
@@ -9,6 +9,7 @@ import (
 	"github.com/spf13/viper"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -23,16 +24,20 @@ func addDream(d *dream) error {
 	// 	return err
 	// }
 
-	// push the task into queue
-	if err := rdb.RPush(context.TODO(), "DQ", d.ID).Err(); err != nil {
+	// push the task into queue, unless it's held for review
+	if d.Status != dsPending {
+		return nil
+	}
+	if err := enqueueDream(d.ID, d.Model); err != nil {
 		return err
 	}
 	return nil
 }
 
-func updateDream(d *dream, keepCache bool) error {
-	// insert dream into mongodb
-	if _, err := dreams.UpdateByID(context.TODO(), d.ID, bson.M{"$set": d}); err != nil {
+// updateDream saves the changed fields of the dream only,
+// so the ones changed by others at the same time, eg: the images and renditions, are never overwritten
+func updateDream(d *dream, set bson.M, keepCache bool) error {
+	if _, err := dreams.UpdateByID(context.TODO(), d.ID, bson.M{"$set": set}); err != nil {
 		return err
 	}
 
@@ -48,7 +53,34 @@ func updateDream(d *dream, keepCache bool) error {
 		expiresIn("d:"+d.ID, viper.GetDuration("expDreamShort"))
 	}
 
-	return nil
+	// notify the streaming clients
+	return publishStatus(d.ID, d.Status)
+}
+
+// update the dream's status only, and clear its cache
+func setDreamStatus(id string, status dreamStatus) error {
+	if _, err := dreams.UpdateByID(context.TODO(), id, bson.M{"$set": bson.M{"status": status}}); err != nil {
+		return err
+	}
+
+	if err := expires("d:" + id); err != nil {
+		return err
+	}
+	return publishStatus(id, status)
+}
+
+// onDreamFinished runs the hooks of the dream's terminal transition:
+// finished by the worker, dead, cancelled, or rejected or approved by the moderator
+func onDreamFinished(d *dream) error {
+	// explore the finished public dream
+	if d.Status == dsDone {
+		if err := addExplore(context.TODO(), d.ID); err != nil {
+			return err
+		}
+	}
+
+	// notify the author's webhooks
+	return enqueueWebhookEvent(d.ID, d.Status)
 }
 
 func getDreamById(id string) (d *dream, err error) {
@@ -79,10 +111,11 @@ func getDreamById(id string) (d *dream, err error) {
 }
 
 func addFeed(d *dream) error {
+	f := feed{Dream: d.ID, Generated: time.Now()}
 	_, err := users.UpdateOne(context.TODO(), bson.M{"username": d.Author}, bson.M{
 		"$push": bson.M{
 			"outbox": bson.M{
-				"$each":     bson.A{&feed{Dream: d.ID, Generated: time.Now()}},
+				"$each":     bson.A{&f},
 				"$position": 0,
 				"$slice":    viper.GetInt("outboxLimit"),
 			},
@@ -91,7 +124,34 @@ func addFeed(d *dream) error {
 
 	// clear cache of the author
 	expires("u:" + d.AuthorID)
-	return err
+	if err != nil {
+		return err
+	}
+
+	// push it into the timelines of the author and the followers
+	author, err := getUserById(d.AuthorID)
+	if err != nil {
+		return err
+	}
+	if err = fanOutFeed(context.TODO(), &author, f); err != nil {
+		return err
+	}
+
+	// and the outboxes of its tags
+	return addTagFeeds(context.TODO(), d, f.Generated)
+}
+
+// remove the duplicated feeds, the first one is kept
+func uniqueFeeds(list []feed) []feed {
+	seen := map[string]bool{}
+	res := list[:0]
+	for _, f := range list {
+		if !seen[f.Dream] {
+			seen[f.Dream] = true
+			res = append(res, f)
+		}
+	}
+	return res
 }
 
 // get user's outbox and cache it
@@ -154,20 +214,31 @@ func hasNewFeeds(id string, since time.Time) (hasNew []feed, err error) {
 	// clear error
 	err = nil
 
-	// concat with self's outbox
-	var list []feed = make([]feed, len(usr.Outbox))
-	copy(list, usr.Outbox)
+	// the precomputed timeline of self and the subscriptions
+	list, err := getTimeline(context.TODO(), &usr, since)
+	if err != nil {
+		return nil, err
+	}
 
-	// get subcription's outbox
-	following := usr.Following
-	for _, uid := range following {
-		u, err := getUserById(uid, "outbox")
+	// get the outboxes of the subscriptions which are not fanned out
+	cf, err := celebrityFeeds(context.TODO(), usr.Following)
+	if err != nil {
+		return nil, err
+	}
+	list = append(list, cf...)
+
+	// get followed tags' outbox
+	for _, tag := range usr.FollowingTags {
+		tf, err := getTagOutbox(context.TODO(), tag)
 		if err != nil {
 			return nil, err
 		}
-		list = append(list, u.Outbox...)
+		list = append(list, tf...)
 	}
 
+	// the dream may be in several outboxes
+	list = uniqueFeeds(list)
+
 	// filtered by since time
 	// https://github.com/golang/go/wiki/SliceTricks#filtering-without-allocating
 	bList := list[:0]
@@ -239,15 +310,37 @@ func getFeeds(id string, since time.Time) (feeds []*dream, err error) {
 		return
 	}
 
+	usr, err := getUserById(id)
+	if err != nil {
+		return
+	}
+
 	// get dream details
 	for _, feed := range flist {
 		d, err := getDreamById(feed.Dream)
-		if err != nil {
+		if err == redis.Nil || err == mongo.ErrNoDocuments {
+			continue // deleted
+		} else if err != nil {
 			return feeds, err
 		}
+
+		// unlisted and private dreams are only listed to their authors
+		if !canListDream(d, id) {
+			continue
+		}
+
+		// blur the flagged dreams by user's preference
+		if !usr.ShowSensitive {
+			censorDream(d)
+		}
 		feeds = append(feeds, d)
 	}
 
+	// mark the dreams saved by the user
+	if err = markBookmarked(id, feeds); err != nil {
+		return
+	}
+
 	// cache seen list
 	seen := make([]interface{}, len(flist))
 	for idx, f := range flist {
@@ -285,7 +378,10 @@ func addFollowing(uid string, following string) error {
 		return err
 	}
 
-	return err
+	if err = expireFollowing(uid, following); err != nil {
+		return err
+	}
+	return followTimeline(context.TODO(), uid, following)
 }
 
 func removeFollowing(uid string, following string) error {
@@ -309,5 +405,18 @@ func removeFollowing(uid string, following string) error {
 		return err
 	}
 
-	return err
+	if err = expireFollowing(uid, following); err != nil {
+		return err
+	}
+	return unfollowTimeline(context.TODO(), uid, following)
+}
+
+// clear the caches of both users, and the new feeds of the follower
+func expireFollowing(uid string, following string) error {
+	for _, key := range []string{"u:" + uid, "u:" + following, "u:" + uid + ":feed:new"} {
+		if err := expires(key); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,363 @@
+package dream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v9"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	appealPending  = "pending"
+	appealApproved = "approved"
+	appealRejected = "rejected"
+)
+
+var errNoAppeal = errors.New("moderation.appeal.notFound")
+
+// moderation result of the dream
+type moderation struct {
+	Flagged bool      `json:"flagged" bson:"flagged"`
+	Labels  []string  `json:"labels" bson:"labels"`
+	Score   float64   `json:"score" bson:"score"`
+	By      string    `json:"by" bson:"by"` // "auto", the worker or the moderator
+	Updated time.Time `json:"updated" bson:"updated"`
+
+	AppealStatus string    `json:"appealStatus" bson:"appealStatus"` // "pending", "approved" or "rejected"
+	AppealReason string    `json:"appealReason" bson:"appealReason"`
+	Appealed     time.Time `json:"appealed" bson:"appealed"`
+}
+
+// verdict of the moderator
+type verdict struct {
+	Flagged bool
+	Labels  []string
+	Score   float64
+}
+
+// moderator decides whether the generated dream is safe for work,
+// it's invoked after the worker finished the dream
+type moderator interface {
+	Moderate(ctx context.Context, d *dream) (*verdict, error)
+}
+
+var mod moderator // moderator of the generated dreams
+
+// create the moderator by "moderator" config
+func newModerator() moderator {
+	switch viper.GetString("moderator") {
+	case "rules":
+		return &rulesModerator{keywords: viper.GetStringSlice("nsfwKeywords")}
+	case "none":
+		return &rulesModerator{}
+	default:
+		panic("unknown moderator: " + viper.GetString("moderator"))
+	}
+}
+
+// rulesModerator flags the dreams whose prompt contains any of the keywords
+type rulesModerator struct {
+	keywords []string
+}
+
+func (m *rulesModerator) Moderate(ctx context.Context, d *dream) (*verdict, error) {
+	v := &verdict{}
+	prompt := strings.ToLower(d.Prompt)
+	for _, k := range m.keywords {
+		if strings.Contains(prompt, strings.ToLower(k)) {
+			v.Labels = append(v.Labels, k)
+		}
+	}
+
+	if len(v.Labels) > 0 {
+		v.Flagged = true
+		v.Score = 1
+	}
+	return v, nil
+}
+
+// moderateDream runs the moderator if the model's policy asks for it,
+// returns nil if the dream is not moderated
+func moderateDream(ctx context.Context, d *dream) (*moderation, error) {
+	// already flagged by the prompt rules
+	if d.Moderation != nil && d.Moderation.Flagged {
+		return d.Moderation, nil
+	}
+
+	m, err := getModel(d.Model)
+	if err != nil && err != errModelNotFound {
+		return nil, err
+	}
+
+	// moderate the dreams of the removed models too
+	if m != nil && m.Nsfw == "allow" {
+		return nil, nil
+	}
+
+	v, err := mod.Moderate(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+
+	return &moderation{Flagged: v.Flagged, Labels: v.Labels, Score: v.Score, By: "auto", Updated: time.Now()}, nil
+}
+
+// blur the flagged images in background
+func blurDreamImages(d *dream) error {
+	for _, key := range d.Images {
+		if err := enqueueBlur(d.ID, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// censorDream replaces the images of the flagged dream with the blurred ones
+func censorDream(d *dream) {
+	if d.Status != dsNsfw {
+		return
+	}
+
+	d.Images = d.Blurred
+	if d.Images == nil {
+		d.Images = make([]string, 0)
+	}
+	d.Renditions = make([]rendition, 0)
+}
+
+// censorDreams blurs the flagged dreams by the viewer's preference, and returns the viewer
+func censorDreams(uid string, ds []*dream) (user, error) {
+	viewer, err := getUserById(uid)
+	if err != nil {
+		return viewer, err
+	}
+
+	if !viewer.ShowSensitive {
+		for _, d := range ds {
+			censorDream(d)
+		}
+	}
+	return viewer, nil
+}
+
+func moderationHandlers() {
+	r.POST("/api/user/preferences", jwtAuth, preferencesHandler)
+	r.POST("/api/dream/appeal/:id", jwtAuth, rateLimit("appeals"), appealHandler)
+	r.GET("/api/admin/appeals", jwtAuth, moderatorAuth, appealsHandler)
+	r.POST("/api/admin/appeals/:id", jwtAuth, moderatorAuth, reviewAppealHandler)
+}
+
+type preferences struct {
+	ShowSensitive *bool `json:"showSensitive"`
+}
+
+// update user's preferences
+func preferencesHandler(c *gin.Context) {
+	var p preferences
+	if err := c.ShouldBind(&p); err != nil {
+		badRequest(c, errors.New("invalid.input"))
+		return
+	}
+
+	set := bson.M{}
+	if p.ShowSensitive != nil {
+		set["showSensitive"] = *p.ShowSensitive
+	}
+
+	if len(set) == 0 {
+		badRequest(c, errors.New("invalid.input"))
+		return
+	}
+
+	uid := c.GetString("uuid")
+	if _, err := users.UpdateByID(context.TODO(), uid, bson.M{"$set": set}); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	// clear the user's cache and new feeds
+	for _, key := range []string{"u:" + uid, "u:" + uid + ":feed:new"} {
+		if err := expires(key); err != nil {
+			internalError(c, err)
+			return
+		}
+	}
+
+	ok(c)
+}
+
+// author appeals against the nsfw decision
+func appealHandler(c *gin.Context) {
+	reason := strings.TrimSpace(c.PostForm("reason"))
+	if len(reason) == 0 || len([]rune(reason)) > viper.GetInt("appealMaxLen") {
+		badRequest(c, errors.New("moderation.appeal.invalidReason"))
+		return
+	}
+
+	d, err := getDreamById(c.Param("id"))
+	if err == redis.Nil || err == mongo.ErrNoDocuments {
+		badRequest(c, errors.New("dream.invalid.notFound"))
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if d.AuthorID != c.GetString("uuid") {
+		permissionError(c, errors.New("moderation.appeal.notAuthor"))
+		return
+	}
+
+	if d.Status != dsNsfw {
+		badRequest(c, errors.New("moderation.appeal.notFlagged"))
+		return
+	}
+
+	// only one appeal for each decision
+	if d.Moderation != nil && len(d.Moderation.AppealStatus) > 0 {
+		badRequest(c, errors.New("moderation.appeal.exists"))
+		return
+	}
+
+	set := bson.M{
+		"moderation.appealStatus": appealPending,
+		"moderation.appealReason": reason,
+		"moderation.appealed":     time.Now(),
+	}
+	if d.Moderation == nil {
+		set = bson.M{"moderation": &moderation{
+			Flagged:      true,
+			Updated:      d.Finished,
+			AppealStatus: appealPending,
+			AppealReason: reason,
+			Appealed:     time.Now(),
+		}}
+	}
+
+	if _, err = dreams.UpdateByID(context.TODO(), d.ID, bson.M{"$set": set}); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if err = expires("d:" + d.ID); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	l.Infoln("APPEAL_DREAM", d.ID, "by", d.Author)
+	ok(c)
+}
+
+// list the pending appeals, the oldest first
+func appealsHandler(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "0"))
+	if err != nil || page < 0 {
+		badRequest(c, errors.New("invalid.input"))
+		return
+	}
+
+	ds, err := getAppeals(page)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":     true,
+		"dreams": ds,
+	})
+}
+
+func getAppeals(page int) ([]*dream, error) {
+	perPage := int64(viper.GetInt("appealsPerPage"))
+	opts := options.Find().
+		SetSort(bson.M{"moderation.appealed": 1}).
+		SetSkip(perPage * int64(page)).
+		SetLimit(perPage)
+
+	cur, err := dreams.Find(context.TODO(), bson.M{"moderation.appealStatus": appealPending}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ds := make([]*dream, 0)
+	if err = cur.All(context.TODO(), &ds); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// moderator approves or rejects the appeal,
+// the dream will be marked as done if approved
+func reviewAppealHandler(c *gin.Context) {
+	decision := c.PostForm("decision")
+	if decision != "approve" && decision != "reject" {
+		badRequest(c, errors.New("moderation.appeal.invalidDecision"))
+		return
+	}
+
+	err := reviewAppeal(c.Param("id"), decision == "approve", c.GetString("username"))
+	if err == errNoAppeal {
+		badRequest(c, err)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	l.Infoln("REVIEW_APPEAL", c.Param("id"), "by", c.GetString("username"), "decision:", decision)
+	ok(c)
+}
+
+func reviewAppeal(id string, approve bool, reviewer string) error {
+	set := bson.M{
+		"moderation.appealStatus": appealRejected,
+		"moderation.by":           reviewer,
+		"moderation.updated":      time.Now(),
+	}
+	if approve {
+		set["moderation.appealStatus"] = appealApproved
+		set["moderation.flagged"] = false
+		set["status"] = dsDone
+	}
+
+	res, err := dreams.UpdateOne(context.TODO(), bson.M{
+		"_id":                     id,
+		"status":                  dsNsfw,
+		"moderation.appealStatus": appealPending,
+	}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		return errNoAppeal
+	}
+
+	if err = expires("d:" + id); err != nil {
+		return err
+	}
+
+	if !approve {
+		return nil
+	}
+
+	if err = publishStatus(id, dsDone); err != nil {
+		return err
+	}
+
+	d, err := getDreamById(id)
+	if err != nil {
+		return err
+	}
+	return onDreamFinished(d)
+}
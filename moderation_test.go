@@ -0,0 +1,212 @@
+package dream
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRulesModerator(t *testing.T) {
+	m := &rulesModerator{keywords: []string{"nsfw", "Gore"}}
+
+	v, err := m.Moderate(context.TODO(), &dream{Prompt: "a cat sitting on the moon"})
+	assert.Nil(t, err)
+	assert.False(t, v.Flagged)
+
+	v, err = m.Moderate(context.TODO(), &dream{Prompt: "NSFW, gore"})
+	assert.Nil(t, err)
+	assert.True(t, v.Flagged)
+	assert.Equal(t, []string{"nsfw", "Gore"}, v.Labels)
+}
+
+func TestCensorDream(t *testing.T) {
+	d := &dream{Status: dsDone, Images: []string{"a.png"}}
+	censorDream(d)
+	assert.Equal(t, []string{"a.png"}, d.Images)
+
+	d = &dream{Status: dsNsfw, Images: []string{"a.png"}, Renditions: []rendition{{Image: "a.png"}}}
+	censorDream(d)
+	assert.Equal(t, 0, len(d.Images))
+	assert.Equal(t, 0, len(d.Renditions))
+
+	d = &dream{Status: dsNsfw, Images: []string{"a.png"}, Blurred: []string{"a_blur.jpg"}}
+	censorDream(d)
+	assert.Equal(t, []string{"a_blur.jpg"}, d.Images)
+}
+
+func TestMakeBlurred(t *testing.T) {
+	s := &localStore{dir: t.TempDir()}
+	ctx := context.TODO()
+
+	assert.Nil(t, s.Put(ctx, "tester_1.png", newTestPNG(t, 64, 32), "image/png"))
+
+	key, err := makeBlurred(ctx, s, "tester_1.png", 4)
+	assert.Nil(t, err)
+	assert.Equal(t, "tester_1_blur.jpg", key)
+
+	img, err := s.Get(ctx, key)
+	assert.Nil(t, err)
+	defer img.Close()
+
+	cfg, err := jpeg.DecodeConfig(img.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, 64, cfg.Width)
+	assert.Equal(t, 32, cfg.Height)
+}
+
+func TestUpscaleImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, color.RGBA{A: 255})
+	src.Set(1, 0, color.RGBA{R: 255, A: 255})
+
+	dst := upscaleImage(src, 4, 1)
+	assert.Equal(t, uint8(0), dst.RGBAAt(0, 0).R)
+	assert.Equal(t, uint8(255), dst.RGBAAt(3, 0).R)
+
+	// the middle pixels are interpolated
+	mid := dst.RGBAAt(1, 0).R
+	assert.True(t, mid > 0 && mid < 255)
+}
+
+func TestModerationAppeal(t *testing.T) {
+	testSetup()
+	testWorkerSetup()
+
+	defer func() {
+		for _, name := range []string{"tester028", "tester029"} {
+			if err := delUsrByName(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}()
+
+	rdb.Del(context.TODO(), queueOf(testModel))
+
+	w := testLogin(t, "tester028")
+	token, c := testJwtToken(t, w)
+
+	w = testLogin(t, "tester029")
+	modToken, _ := testJwtToken(t, w)
+	viper.Set("moderators", []string{"tester029"})
+
+	// flagged by the rules moderator
+	dr := newTestDream()
+	dr.Prompt = "a nsfw painting"
+	id := testPostDream(t, token, dr)
+
+	assertOK(t, claimReq())
+	assertOK(t, uploadReq("/api/worker/upload/"+id, "0.png"))
+	assertOK(t, workerReq("POST", "/api/worker/done/"+id, nil, ""))
+
+	d, err := getDreamById(id)
+	assert.Nil(t, err)
+	assert.Equal(t, dsNsfw, d.Status)
+	assert.True(t, d.Moderation.Flagged)
+	assert.Equal(t, "auto", d.Moderation.By)
+
+	// flagged dream is in the outbox, but blurred
+	usr, err := getUserById(c.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(usr.Outbox))
+
+	feeds, err := getFeeds(c.ID, d.Created.AddDate(0, 0, -1))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(feeds))
+	for _, img := range feeds[0].Images {
+		assert.True(t, strings.HasSuffix(img, "_blur.jpg"))
+	}
+
+	postForm := func(addr string, data map[string]string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req, err := postFormReq(addr, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// only the author can appeal
+	assertNotOK(t, postForm("/api/dream/appeal/"+id, map[string]string{"reason": "it's art"}, modToken))
+	assertNotOK(t, postForm("/api/dream/appeal/"+id, map[string]string{"reason": ""}, token))
+	assertOK(t, postForm("/api/dream/appeal/"+id, map[string]string{"reason": "it's art"}, token))
+	assertNotOK(t, postForm("/api/dream/appeal/"+id, map[string]string{"reason": "again"}, token))
+
+	// authors can't review
+	assertNotOK(t, postForm("/api/admin/appeals/"+id, map[string]string{"decision": "approve"}, token))
+
+	req, _ := http.NewRequest("GET", "/api/admin/appeals", nil)
+	req.AddCookie(modToken)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	body := assertOK(t, w)
+	found := false
+	for _, a := range body["dreams"].([]interface{}) {
+		if a.(map[string]interface{})["_id"] == id {
+			found = true
+		}
+	}
+	assert.True(t, found)
+
+	assertNotOK(t, postForm("/api/admin/appeals/"+id, map[string]string{"decision": "maybe"}, modToken))
+	assertOK(t, postForm("/api/admin/appeals/"+id, map[string]string{"decision": "approve"}, modToken))
+	assertNotOK(t, postForm("/api/admin/appeals/"+id, map[string]string{"decision": "approve"}, modToken))
+
+	d, err = getDreamById(id)
+	assert.Nil(t, err)
+	assert.Equal(t, dsDone, d.Status)
+	assert.False(t, d.Moderation.Flagged)
+	assert.Equal(t, appealApproved, d.Moderation.AppealStatus)
+	assert.Equal(t, "tester029", d.Moderation.By)
+}
+
+func TestPreferences(t *testing.T) {
+	testSetup()
+
+	defer func() {
+		if err := delUsrByName("tester030"); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	w := testLogin(t, "tester030")
+	token, c := testJwtToken(t, w)
+
+	req, _ := http.NewRequest("POST", "/api/user/preferences", bytes.NewBufferString(`{"showSensitive":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertOK(t, w)
+
+	usr, err := getUserById(c.ID)
+	assert.Nil(t, err)
+	assert.True(t, usr.ShowSensitive)
+
+	// nothing to update
+	req, _ = http.NewRequest("POST", "/api/user/preferences", bytes.NewBufferString(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertNotOK(t, w)
+
+	// invalid input is answered with json too
+	req, _ = http.NewRequest("POST", "/api/user/preferences", bytes.NewBufferString(`{"showSensitive":"yes"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assertNotOK(t, w)
+}
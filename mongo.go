@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/spf13/viper"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -16,6 +17,13 @@ var db *mongo.Database
 var users *mongo.Collection
 var dreams *mongo.Collection
 var comments *mongo.Collection
+var sdModels *mongo.Collection
+var promptRules *mongo.Collection
+var ledger *mongo.Collection
+var webhooks *mongo.Collection
+var deliveries *mongo.Collection
+var collections *mongo.Collection
+var bookmarks *mongo.Collection
 
 var ErrInvalidPwd = errors.New("invalid password")
 
@@ -36,6 +44,12 @@ func ensureIndeces() {
 	models = []mongo.IndexModel{
 		{Keys: bson.D{{Key: "author", Value: 1}}},
 		{Keys: bson.D{{Key: "created", Value: 1}}},
+		{Keys: bson.D{{Key: "rootId", Value: 1}}},
+		{Keys: bson.D{{Key: "parentId", Value: 1}}},
+		{Keys: bson.D{{Key: "authorId", Value: 1}, {Key: "created", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "tags", Value: 1}, {Key: "created", Value: -1}}},
+		{Keys: bson.D{{Key: "terms", Value: "text"}}, Options: options.Index().SetDefaultLanguage("none")},
+		{Keys: bson.D{{Key: "moderation.appealStatus", Value: 1}, {Key: "moderation.appealed", Value: 1}}},
 	}
 	if _, err := dreams.Indexes().CreateMany(
 		context.TODO(),
@@ -44,6 +58,57 @@ func ensureIndeces() {
 		panic(err)
 	}
 
+	// Ensure indeces for the credit ledger
+	models = []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user", Value: 1}, {Key: "created", Value: -1}}},
+	}
+	if _, err := ledger.Indexes().CreateMany(
+		context.TODO(),
+		models,
+	); err != nil {
+		panic(err)
+	}
+
+	// Ensure indeces for collections
+	models = []mongo.IndexModel{
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "updated", Value: -1}}},
+		{Keys: bson.D{{Key: "items.dream", Value: 1}}},
+	}
+	if _, err := collections.Indexes().CreateMany(
+		context.TODO(),
+		models,
+	); err != nil {
+		panic(err)
+	}
+
+	// Ensure indeces for bookmarks
+	models = []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user", Value: 1}, {Key: "dream", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user", Value: 1}, {Key: "saved", Value: -1}}},
+		{Keys: bson.D{{Key: "dream", Value: 1}}},
+	}
+	if _, err := bookmarks.Indexes().CreateMany(
+		context.TODO(),
+		models,
+	); err != nil {
+		panic(err)
+	}
+
+	// Ensure indeces for webhooks and their delivery logs
+	if _, err := webhooks.Indexes().CreateOne(
+		context.TODO(),
+		mongo.IndexModel{Keys: bson.D{{Key: "user", Value: 1}}},
+	); err != nil {
+		panic(err)
+	}
+
+	if _, err := deliveries.Indexes().CreateOne(
+		context.TODO(),
+		mongo.IndexModel{Keys: bson.D{{Key: "webhook", Value: 1}, {Key: "created", Value: -1}}},
+	); err != nil {
+		panic(err)
+	}
+
 	// Ensure indeces for comments
 	models = []mongo.IndexModel{
 		{Keys: bson.D{{Key: "dream", Value: 1}}},
@@ -71,7 +136,8 @@ func newUser(email string, username string, hashedPassword string) error {
 		Followers: []string{},
 
 		Outbox: make([]feed, 0),
-		Inbox:  make([]feed, 0),
+
+		Credits: viper.GetInt64("signupCredits"),
 	}
 
 	res, err := users.InsertOne(context.TODO(), usr)
@@ -80,7 +146,17 @@ func newUser(email string, username string, hashedPassword string) error {
 		return err
 	}
 	l.Infoln("ADD_USER", username, res.InsertedID)
-	return nil
+
+	// record the initial credits
+	_, err = ledger.InsertOne(context.TODO(), &ledgerEntry{
+		ID:      uuid.New().String(),
+		User:    id,
+		Amount:  usr.Credits,
+		Balance: usr.Credits,
+		Reason:  creditSignup,
+		Created: usr.Created,
+	})
+	return err
 }
 
 func findUsrByName(name string, project bson.M) (usr bson.M, err error) {
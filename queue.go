@@ -0,0 +1,488 @@
+package dream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+// the dream queue:
+// "DQ:m:<model>"         pending dream ids of the model, workers claim from the left
+// "DQ:queues"            hash of dream id -> its model queue
+// "DQ:processing:<wid>"  dream ids claimed by the worker
+// "DQ:claims"            sorted set of claimed dream ids, scored by visibility deadline
+// "DQ:owners"            hash of claimed dream id -> worker id
+// "DQ:delayed"           sorted set of dream ids waiting for retry, scored by ready time
+// "DQ:dead"              dream ids which failed too many times
+// "DQ:workers:<model>"   sorted set of worker ids serving the model, scored by last seen time
+// "DQ:stats:<model>"     recent finished jobs of the model as "<duration ms> <work units>"
+const (
+	queuesKey  = "DQ:queues"
+	claimsKey  = "DQ:claims"
+	ownersKey  = "DQ:owners"
+	delayedKey = "DQ:delayed"
+	deadKey    = "DQ:dead"
+)
+
+var errJobNotOwned = errors.New("queue.job.notOwned")
+
+type queueStats struct {
+	Jobs    int     `json:"jobs"`    // number of the sampled jobs
+	JobMs   float64 `json:"jobMs"`   // average duration of a job
+	UnitMs  float64 `json:"unitMs"`  // average duration of a work unit
+	Workers int64   `json:"workers"` // active workers of the model
+}
+
+func queueOf(model string) string {
+	return "DQ:m:" + model
+}
+
+func processingKey(worker string) string {
+	return "DQ:processing:" + worker
+}
+
+func workersKey(model string) string {
+	return "DQ:workers:" + model
+}
+
+func statsKey(model string) string {
+	return "DQ:stats:" + model
+}
+
+// KEYS[1] processing list, KEYS[2] claims, KEYS[3] owners, KEYS[4...] model queues
+// ARGV[1] visibility deadline, ARGV[2] worker id
+var claimScript = redis.NewScript(`
+for i = 4, #KEYS do
+	local id = redis.call('LMOVE', KEYS[i], KEYS[1], 'LEFT', 'RIGHT')
+	if id then
+		redis.call('ZADD', KEYS[2], ARGV[1], id)
+		redis.call('HSET', KEYS[3], id, ARGV[2])
+		return id
+	end
+end
+return false
+`)
+
+// KEYS[1] claims, KEYS[2] owners
+// ARGV[1] dream id, ARGV[2] worker id, ARGV[3] new visibility deadline
+var heartbeatScript = redis.NewScript(`
+if redis.call('HGET', KEYS[2], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call('ZADD', KEYS[1], 'XX', ARGV[3], ARGV[1])
+return 1
+`)
+
+// KEYS[1] processing list, KEYS[2] claims, KEYS[3] owners
+// ARGV[1] dream id, ARGV[2] worker id
+var releaseScript = redis.NewScript(`
+if redis.call('HGET', KEYS[3], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call('LREM', KEYS[1], 0, ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+return 1
+`)
+
+// KEYS[1] claims, KEYS[2] owners, KEYS[i+2] processing list of the i-th dream
+// ARGV[1] now, ARGV[2] reaper id, ARGV[3] new visibility deadline, ARGV[2i+2] id and ARGV[2i+3] worker id of the i-th dream,
+// the expired claims are taken over by the reaper, so they can't be claimed until the dreams are updated,
+// dreams which were heartbeated or released since they were read are skipped
+var takeoverScript = redis.NewScript(`
+local ids = {}
+for i = 4, #ARGV, 2 do
+	local id, w = ARGV[i], ARGV[i + 1]
+	local deadline = redis.call('ZSCORE', KEYS[1], id)
+	if deadline and tonumber(deadline) <= tonumber(ARGV[1]) and (redis.call('HGET', KEYS[2], id) or '') == w then
+		redis.call('LREM', KEYS[i / 2 + 1], 0, id)
+		redis.call('ZADD', KEYS[1], ARGV[3], id)
+		redis.call('HSET', KEYS[2], id, ARGV[2])
+		table.insert(ids, id)
+	end
+end
+return ids
+`)
+
+// KEYS[1] claims, KEYS[2] owners, KEYS[3] model queue, empty if the dream is not queued
+// ARGV[1] dream id, ARGV[2] reaper id
+var requeueScript = redis.NewScript(`
+if redis.call('HGET', KEYS[2], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+if KEYS[3] ~= '' then
+	redis.call('LPUSH', KEYS[3], ARGV[1])
+end
+return 1
+`)
+
+// KEYS[1] processing list, KEYS[2] claims, KEYS[3] owners, KEYS[4] delayed
+// ARGV[1] dream id, ARGV[2] worker id, ARGV[3] ready time
+var retryScript = redis.NewScript(`
+if redis.call('HGET', KEYS[3], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call('LREM', KEYS[1], 0, ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+redis.call('ZADD', KEYS[4], ARGV[3], ARGV[1])
+return 1
+`)
+
+// KEYS[1] delayed, KEYS[2] queues
+// ARGV[1] now, ARGV[2] batch size
+var promoteScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, id in ipairs(ids) do
+	redis.call('ZREM', KEYS[1], id)
+	local q = redis.call('HGET', KEYS[2], id)
+	if q then
+		redis.call('RPUSH', q, id)
+	end
+end
+return ids
+`)
+
+func visibilityDeadline() string {
+	return strconv.FormatInt(time.Now().Add(viper.GetDuration("queueVisibility")).UnixMilli(), 10)
+}
+
+// push the dream into its model's queue
+func enqueueDream(id string, model string) error {
+	ctx := context.TODO()
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, queuesKey, id, queueOf(model))
+		pipe.RPush(ctx, queueOf(model), id)
+		return nil
+	})
+	return err
+}
+
+// remove the dream from the queue and the delayed queue
+func dequeueDream(ctx context.Context, id string) error {
+	q, err := rdb.HGet(ctx, queuesKey, id).Result()
+	if err == redis.Nil {
+		return rdb.ZRem(ctx, delayedKey, id).Err()
+	} else if err != nil {
+		return err
+	}
+
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, q, 0, id)
+		pipe.ZRem(ctx, delayedKey, id)
+		pipe.HDel(ctx, queuesKey, id)
+		return nil
+	})
+	return err
+}
+
+// claimJob moves the next pending dream of the given models into the worker's processing list,
+// it polls the queues until a job is found or the wait duration is elapsed,
+// returns redis.Nil if there is no job
+func claimJob(ctx context.Context, worker string, models []string, wait time.Duration) (string, error) {
+	until := time.Now().Add(wait)
+
+	for {
+		if err := touchWorker(ctx, worker, models); err != nil {
+			return "", err
+		}
+
+		// shuffle the models, so that no model will be starved
+		keys := []string{processingKey(worker), claimsKey, ownersKey}
+		for _, idx := range rand.Perm(len(models)) {
+			keys = append(keys, queueOf(models[idx]))
+		}
+
+		id, err := claimScript.Run(ctx, rdb, keys, visibilityDeadline(), worker).Text()
+		if err != redis.Nil {
+			return id, err
+		}
+
+		if time.Now().After(until) {
+			return "", redis.Nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(viper.GetDuration("queuePoll")):
+		}
+	}
+}
+
+// heartbeatJob extends the visibility deadline of the claimed dream
+func heartbeatJob(ctx context.Context, worker string, id string) error {
+	res, err := heartbeatScript.Run(ctx, rdb, []string{claimsKey, ownersKey}, id, worker, visibilityDeadline()).Int()
+	if err != nil {
+		return err
+	}
+
+	if res == 0 {
+		return errJobNotOwned
+	}
+	return nil
+}
+
+// isJobOwner checks whether the dream is claimed by the worker
+func isJobOwner(ctx context.Context, worker string, id string) (bool, error) {
+	owner, err := rdb.HGet(ctx, ownersKey, id).Result()
+	if err == redis.Nil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return owner == worker, nil
+}
+
+// completeJob acknowledges the claimed dream and removes it from the queue
+func completeJob(ctx context.Context, worker string, id string) error {
+	if err := releaseJob(ctx, worker, id); err != nil {
+		return err
+	}
+	return rdb.HDel(ctx, queuesKey, id).Err()
+}
+
+// failJob retries the claimed dream later or moves it into the dead letter queue,
+// the claim is released at last, so the dream will be requeued when it expires if anything failed
+func failJob(ctx context.Context, worker string, id string, reason string) error {
+	owned, err := isJobOwner(ctx, worker, id)
+	if err != nil {
+		return err
+	} else if !owned {
+		return errJobNotOwned
+	}
+
+	_, err = retryDream(ctx, worker, id, reason)
+	return err
+}
+
+func releaseJob(ctx context.Context, worker string, id string) error {
+	keys := []string{processingKey(worker), claimsKey, ownersKey}
+	res, err := releaseScript.Run(ctx, rdb, keys, id, worker).Int()
+	if err != nil {
+		return err
+	}
+
+	if res == 0 {
+		return errJobNotOwned
+	}
+	return nil
+}
+
+// owner of the expired claims taken over by this server
+var reaperId = "reaper:" + uuid.New().String()
+
+// requeueExpired takes over the claimed dreams which are not acknowledged in time,
+// resets their status to pending, then pushes them back to the head of the queue,
+// the timeout counts as a failed attempt
+func requeueExpired(ctx context.Context) ([]string, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	expired, err := rdb.ZRangeByScore(ctx, claimsKey, &redis.ZRangeBy{Min: "-inf", Max: now, Count: 100}).Result()
+	if err != nil || len(expired) == 0 {
+		return nil, err
+	}
+
+	// the keys of the processing lists are passed in, so the script works with redis cluster
+	owners, err := rdb.HMGet(ctx, ownersKey, expired...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{claimsKey, ownersKey}
+	args := []interface{}{now, reaperId, visibilityDeadline()}
+	for i, id := range expired {
+		worker, _ := owners[i].(string)
+		keys = append(keys, processingKey(worker))
+		args = append(args, id, worker)
+	}
+
+	ids, err := takeoverScript.Run(ctx, rdb, keys, args...).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	// the failed ones are still claimed by the reaper, they will be handled again when the claims expire
+	var errs []error
+	for _, id := range ids {
+		l.Infoln("REQUEUE_DREAM", id)
+		if err := timeoutDream(id); err != nil {
+			l.Errorln("timeout dream failed", id, err)
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return ids, fmt.Errorf("timeout %d of %d dreams failed: %v", len(errs), len(ids), errs)
+	}
+	return ids, nil
+}
+
+// requeueJob releases the dream taken over by the reaper, and pushes it back to the head of its queue
+func requeueJob(ctx context.Context, id string) error {
+	queue, err := rdb.HGet(ctx, queuesKey, id).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	res, err := requeueScript.Run(ctx, rdb, []string{claimsKey, ownersKey, queue}, id, reaperId).Int()
+	if err != nil {
+		return err
+	}
+
+	if res == 0 {
+		return errJobNotOwned
+	}
+	return nil
+}
+
+// scheduleRetry releases the claimed dream, and puts it into the delayed queue
+func scheduleRetry(ctx context.Context, worker string, id string, at time.Time) error {
+	keys := []string{processingKey(worker), claimsKey, ownersKey, delayedKey}
+	res, err := retryScript.Run(ctx, rdb, keys, id, worker, at.UnixMilli()).Int()
+	if err != nil {
+		return err
+	}
+
+	if res == 0 {
+		return errJobNotOwned
+	}
+	return nil
+}
+
+// promoteDelayed pushes the dreams which are ready to retry into their queues
+func promoteDelayed(ctx context.Context) ([]string, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	return promoteScript.Run(ctx, rdb, []string{delayedKey, queuesKey}, now, 100).StringSlice()
+}
+
+// mark the worker as active for the models it serves
+func touchWorker(ctx context.Context, worker string, models []string) error {
+	now := float64(time.Now().UnixMilli())
+	_, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, model := range models {
+			pipe.ZAdd(ctx, workersKey(model), redis.Z{Score: now, Member: worker})
+		}
+		return nil
+	})
+	return err
+}
+
+// number of the workers which served the model in the visibility timeout
+func activeWorkers(ctx context.Context, model string) (int64, error) {
+	since := time.Now().Add(-viper.GetDuration("queueVisibility")).UnixMilli()
+	return rdb.ZCount(ctx, workersKey(model), strconv.FormatInt(since, 10), "+inf").Result()
+}
+
+// 0-based position of the dream in its model's queue,
+// returns redis.Nil if it's not in the queue
+func queuePosition(ctx context.Context, d *dream) (int64, error) {
+	return rdb.LPos(ctx, queueOf(d.Model), d.ID, redis.LPosArgs{}).Result()
+}
+
+// recordThroughput samples the duration of a finished job
+func recordThroughput(ctx context.Context, model string, duration time.Duration, units float64) error {
+	sample := strconv.FormatInt(duration.Milliseconds(), 10) + " " + strconv.FormatFloat(units, 'f', -1, 64)
+
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, statsKey(model), sample)
+		pipe.LTrim(ctx, statsKey(model), 0, int64(viper.GetInt("queueStatsSamples"))-1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// stats will be recomputed on next request
+	return delCache(statsKey(model) + ":summary")
+}
+
+// getQueueStats summarizes the recent throughput of the model, and caches it for a short time
+func getQueueStats(ctx context.Context, model string) (stats queueStats, err error) {
+	err = getCache(statsKey(model)+":summary", &stats)
+	if err == nil {
+		return
+	} else if err != redis.Nil {
+		return
+	}
+
+	samples, err := rdb.LRange(ctx, statsKey(model), 0, -1).Result()
+	if err != nil {
+		return
+	}
+
+	var ms, units float64
+	for _, sample := range samples {
+		var m, u float64
+		if _, err := fmt.Sscan(sample, &m, &u); err != nil {
+			continue
+		}
+		ms += m
+		units += u
+		stats.Jobs++
+	}
+
+	if stats.Jobs > 0 {
+		stats.JobMs = ms / float64(stats.Jobs)
+	}
+	if units > 0 {
+		stats.UnitMs = ms / units
+	}
+
+	if stats.Workers, err = activeWorkers(ctx, model); err != nil {
+		return
+	}
+
+	err = setCache(statsKey(model)+":summary", stats, viper.GetDuration("expQueueStats"))
+	return
+}
+
+// estimate the remaining time of the dream,
+// returns 0 if there is no enough data to estimate
+func estimate(stats queueStats, d *dream, position int64, progress float64) time.Duration {
+	if stats.Jobs == 0 {
+		return 0
+	}
+
+	own := stats.UnitMs * workUnits(d) * (1 - progress)
+
+	// dreams ahead will be processed by all the active workers
+	var ahead float64
+	if position > 0 {
+		workers := stats.Workers
+		if workers < 1 {
+			workers = 1
+		}
+		ahead = stats.JobMs * float64(position) / float64(workers)
+	}
+
+	return time.Duration(own+ahead) * time.Millisecond
+}
+
+// queueReaper requeues expired and delayed jobs periodically until the context is done
+func queueReaper(ctx context.Context) {
+	ticker := time.NewTicker(viper.GetDuration("queueReapInterval"))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := requeueExpired(ctx); err != nil && err != context.Canceled {
+				l.Errorln("requeue expired jobs failed", err)
+			}
+			if _, err := promoteDelayed(ctx); err != nil && err != context.Canceled {
+				l.Errorln("promote delayed jobs failed", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package dream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func newQueuedDream(t *testing.T) *dream {
+	d := newTestDream()
+	d.ID = uuid.New().String()
+	d.Status = dsPending
+	d.Created = time.Now()
+
+	if err := addDream(d); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestQueueClaimComplete(t *testing.T) {
+	testSetup()
+
+	ctx := context.TODO()
+	worker := "tester-worker-001"
+
+	// clear the queue first
+	rdb.Del(ctx, queueOf(testModel))
+
+	// nothing to claim
+	_, err := claimJob(ctx, worker, []string{testModel}, 0)
+	assert.Equal(t, redis.Nil, err)
+
+	d := newQueuedDream(t)
+	defer dreams.DeleteOne(ctx, bson.M{"_id": d.ID})
+
+	id, err := claimJob(ctx, worker, []string{testModel}, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, d.ID, id)
+
+	// moved into the processing list
+	ids, err := rdb.LRange(ctx, processingKey(worker), 0, -1).Result()
+	assert.Nil(t, err)
+	assert.Contains(t, ids, id)
+
+	// only the owner can heartbeat or complete the job
+	assert.Nil(t, heartbeatJob(ctx, worker, id))
+	assert.Equal(t, errJobNotOwned, heartbeatJob(ctx, "someone-else", id))
+	assert.Equal(t, errJobNotOwned, completeJob(ctx, "someone-else", id))
+
+	assert.Nil(t, completeJob(ctx, worker, id))
+
+	ids, err = rdb.LRange(ctx, processingKey(worker), 0, -1).Result()
+	assert.Nil(t, err)
+	assert.NotContains(t, ids, id)
+
+	// completed twice
+	assert.Equal(t, errJobNotOwned, completeJob(ctx, worker, id))
+}
+
+func TestQueueRequeueExpired(t *testing.T) {
+	testSetup()
+
+	ctx := context.TODO()
+	worker := "tester-worker-002"
+
+	rdb.Del(ctx, queueOf(testModel))
+
+	d := newQueuedDream(t)
+	defer dreams.DeleteOne(ctx, bson.M{"_id": d.ID})
+
+	// make the claim expires immediately
+	viper.SetDefault("queueVisibility", -time.Second)
+	defer viper.SetDefault("queueVisibility", time.Minute*5)
+
+	id, err := claimJob(ctx, worker, []string{testModel}, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, d.ID, id)
+
+	assert.Nil(t, setDreamStatus(id, dsProcessing))
+
+	ids, err := requeueExpired(ctx)
+	assert.Nil(t, err)
+	assert.Contains(t, ids, id)
+
+	// back to the head of the queue
+	head, err := rdb.LIndex(ctx, queueOf(testModel), 0).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, id, head)
+
+	// and back to pending
+	d, err = getDreamById(id)
+	assert.Nil(t, err)
+	assert.Equal(t, dsPending, d.Status)
+
+	// the worker lost the job, and the reaper released it
+	assert.Equal(t, errJobNotOwned, completeJob(ctx, worker, id))
+	owned, err := isJobOwner(ctx, reaperId, id)
+	assert.Nil(t, err)
+	assert.False(t, owned)
+
+	rdb.Del(ctx, queueOf(testModel))
+}
+
+func TestEstimate(t *testing.T) {
+	d := newTestDream()
+
+	// no samples
+	assert.Equal(t, time.Duration(0), estimate(queueStats{}, d, 3, 0))
+
+	stats := queueStats{Jobs: 10, JobMs: 4000, UnitMs: 4000 / workUnits(d), Workers: 2}
+
+	assert.Equal(t, time.Second*4, estimate(stats, d, 0, 0))
+	assert.Equal(t, time.Second*2, estimate(stats, d, 0, 0.5))
+
+	// 3 dreams ahead, processed by 2 workers
+	assert.Equal(t, time.Second*10, estimate(stats, d, 3, 0))
+
+	// no active workers
+	stats.Workers = 0
+	assert.Equal(t, time.Second*16, estimate(stats, d, 3, 0))
+}
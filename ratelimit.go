@@ -0,0 +1,105 @@
+package dream
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+// limit of the requests in a sliding window, configured by "rateLimits.<name>"
+type rateLimitConf struct {
+	Limit  int64         `mapstructure:"limit"`
+	Window time.Duration `mapstructure:"window"`
+	By     string        `mapstructure:"by"` // "user" or "ip"
+}
+
+// sliding window log, every request is a member of the sorted set scored by its time.
+// KEYS[1]: window key
+// ARGV[1]: now in ms, ARGV[2]: window in ms, ARGV[3]: limit, ARGV[4]: member
+// returns {allowed, remaining, retry after in ms}
+var rateLimitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+local count = redis.call("ZCARD", KEYS[1])
+
+if count < limit then
+	redis.call("ZADD", KEYS[1], now, ARGV[4])
+	redis.call("PEXPIRE", KEYS[1], window)
+	return {1, limit - count - 1, 0}
+end
+
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+return {0, 0, tonumber(oldest[2]) + window - now}
+`)
+
+// rateLimit limits the requests by the config of the name,
+// must be used after jwtAuth if it's limited by user
+func rateLimit(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !viper.GetBool("rateLimitEnabled") {
+			c.Next()
+			return
+		}
+
+		var conf rateLimitConf
+		if err := viper.UnmarshalKey("rateLimits."+name, &conf); err != nil {
+			internalError(c, err)
+			c.Abort()
+			return
+		}
+
+		// not configured
+		if conf.Limit <= 0 || conf.Window <= 0 {
+			c.Next()
+			return
+		}
+
+		id := c.ClientIP()
+		if conf.By == "user" && len(c.GetString("uuid")) > 0 {
+			id = c.GetString("uuid")
+		}
+
+		allowed, remaining, retryAfter, err := takeRateLimit(c.Request.Context(), "rl:"+name+":"+id, &conf)
+		if err != nil {
+			internalError(c, err)
+			c.Abort()
+			return
+		}
+
+		c.Header("X-RateLimit-Limit", strconv.FormatInt(conf.Limit, 10))
+		c.Header("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+
+		if !allowed {
+			secs := int64((retryAfter + time.Second - 1) / time.Second)
+			c.Header("Retry-After", strconv.FormatInt(secs, 10))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"ok":  false,
+				"msg": "rate.limited",
+			})
+			l.Infoln("RATE_LIMITED", name, id)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func takeRateLimit(ctx context.Context, key string, conf *rateLimitConf) (allowed bool, remaining int64, retryAfter time.Duration, err error) {
+	now := time.Now().UnixMilli()
+	res, err := rateLimitScript.Run(ctx, rdb, []string{key},
+		now, conf.Window.Milliseconds(), conf.Limit, strconv.FormatInt(now, 10)+"-"+uuid.New().String()).Int64Slice()
+	if err != nil {
+		return
+	}
+
+	return res[0] == 1, res[1], time.Duration(res[2]) * time.Millisecond, nil
+}
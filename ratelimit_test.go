@@ -0,0 +1,102 @@
+package dream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimit(t *testing.T) {
+	testSetup()
+
+	viper.Set("rateLimitEnabled", true)
+	defer viper.Set("rateLimitEnabled", false)
+
+	viper.Set("rateLimits.tester", map[string]interface{}{"limit": 3, "window": "1s", "by": "ip"})
+	r.GET("/api/ratelimit/test", rateLimit("tester"), func(c *gin.Context) { ok(c) })
+	r.GET("/api/ratelimit/none", rateLimit("not-configured"), func(c *gin.Context) { ok(c) })
+
+	ctx := context.TODO()
+	rdb.Del(ctx, "rl:tester:192.0.2.1", "rl:tester:192.0.2.2")
+
+	get := func(addr string, ip string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", addr, nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		w := get("/api/ratelimit/test", "192.0.2.1")
+		assertOK(t, w)
+		assert.Equal(t, strconv.Itoa(2-i), w.Header().Get("X-RateLimit-Remaining"))
+	}
+
+	w := get("/api/ratelimit/test", "192.0.2.1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	// the forwarded ip is ignored, since no proxy is trusted
+	req, _ := http.NewRequest("GET", "/api/ratelimit/test", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "192.0.2.3")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	// limited by the client
+	assertOK(t, get("/api/ratelimit/test", "192.0.2.2"))
+
+	// not configured
+	for i := 0; i < 5; i++ {
+		assertOK(t, get("/api/ratelimit/none", "192.0.2.1"))
+	}
+
+	// the window slides
+	time.Sleep(time.Millisecond * 1100)
+	assertOK(t, get("/api/ratelimit/test", "192.0.2.1"))
+}
+
+func TestRateLimitByUser(t *testing.T) {
+	testSetup()
+
+	defer func() {
+		if err := delUsrByName("tester033"); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	w := testLogin(t, "tester033")
+	token, c := testJwtToken(t, w)
+
+	viper.Set("rateLimitEnabled", true)
+	defer viper.Set("rateLimitEnabled", false)
+
+	viper.Set("rateLimits.tester-user", map[string]interface{}{"limit": 1, "window": "1m", "by": "user"})
+	r.GET("/api/ratelimit/user", jwtAuth, rateLimit("tester-user"), func(c *gin.Context) { ok(c) })
+	defer rdb.Del(context.TODO(), "rl:tester-user:"+c.ID)
+
+	req, _ := http.NewRequest("GET", "/api/ratelimit/user", nil)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertOK(t, w)
+
+	req, _ = http.NewRequest("GET", "/api/ratelimit/user", nil)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	retry, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	assert.Nil(t, err)
+	assert.True(t, retry > 0 && retry <= 60)
+}
@@ -0,0 +1,229 @@
+package dream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v9"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the params can be changed when remixing a dream, omitted ones are inherited
+type remix struct {
+	Prompt         string `json:"prompt"`
+	NegativePrompt string `json:"negativePrompt"`
+	Seed           int64  `json:"seed"`
+	RandomSeed     bool   `json:"randomSeed"` // generate a new random seed
+	Visibility     string `json:"visibility"`
+}
+
+type remixNode struct {
+	Dream    *dream       `json:"dream"`
+	Children []*remixNode `json:"children"`
+}
+
+func remixHandlers() {
+	r.POST("/api/dream/remix/:id", jwtAuth, rateLimit("dreams"), remixDreamHandler)
+	r.GET("/api/dream/remixes/:id", jwtAuth, remixTreeHandler)
+}
+
+// create a child dream from the finished dream
+func remixDreamHandler(c *gin.Context) {
+	rm := &remix{}
+	if err := c.ShouldBindJSON(rm); err != nil {
+		badRequest(c, errors.New("dream.invalid.params"))
+		return
+	}
+
+	parent, err := getVisibleDream(c.Param("id"), c.GetString("uuid"))
+	if err == errDreamNotFound {
+		badRequest(c, err)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if parent.Status != dsDone {
+		badRequest(c, errors.New("dream.remix.notFinished"))
+		return
+	}
+
+	createDream(c, newRemix(parent, rm))
+}
+
+// newRemix copies the params of the parent, and records the lineage
+func newRemix(parent *dream, rm *remix) *dream {
+	d := &dream{
+		Prompt:         parent.Prompt,
+		NegativePrompt: parent.NegativePrompt,
+		Steps:          parent.Steps,
+		Scale:          parent.Scale,
+		Width:          parent.Width,
+		Height:         parent.Height,
+		Seed:           parent.Seed,
+		Sampler:        parent.Sampler,
+		Model:          parent.Model,
+		ClipSkip:       parent.ClipSkip,
+		Batch:          parent.Batch,
+		Visibility:     parent.Visibility,
+
+		ParentID: parent.ID,
+		RootID:   parent.RootID,
+	}
+
+	if len(d.RootID) == 0 {
+		d.RootID = parent.ID
+	}
+
+	if len(rm.Prompt) > 0 {
+		d.Prompt = rm.Prompt
+	}
+	if len(rm.NegativePrompt) > 0 {
+		d.NegativePrompt = rm.NegativePrompt
+	}
+	if len(rm.Visibility) > 0 {
+		d.Visibility = rm.Visibility
+	}
+
+	if rm.RandomSeed {
+		d.Seed = 0 // will be filled by a random one
+	} else if rm.Seed != 0 {
+		d.Seed = rm.Seed
+	}
+
+	return d
+}
+
+// get the whole remix tree which the dream belongs to
+func remixTreeHandler(c *gin.Context) {
+	uid := c.GetString("uuid")
+	d, err := getVisibleDream(c.Param("id"), uid)
+	if err == errDreamNotFound {
+		badRequest(c, err)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	rootId := d.RootID
+	if len(rootId) == 0 {
+		rootId = d.ID
+	}
+
+	tree, err := getRemixTree(rootId, uid)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":   true,
+		"tree": tree,
+	})
+}
+
+// the dreams which the user can't see are hidden in the tree
+func getRemixTree(rootId string, uid string) (*remixNode, error) {
+	root, err := getDreamById(rootId)
+	if err == redis.Nil || err == mongo.ErrNoDocuments {
+		root = &dream{ID: rootId, Visibility: visPrivate} // deleted, its remixes are kept under the placeholder
+	} else if err != nil {
+		return nil, err
+	}
+
+	ctx := context.TODO()
+	opts := options.Find().
+		SetSort(bson.M{"created": 1}).
+		SetLimit(int64(viper.GetInt("remixTreeLimit")))
+
+	cursor, err := dreams.Find(ctx, bson.M{"rootId": rootId}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var ds []*dream
+	if err = cursor.All(ctx, &ds); err != nil {
+		return nil, err
+	}
+
+	usr, err := getUserById(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	// hide the dreams which the user can't see, and blur the flagged ones by user's preference
+	show := func(d *dream) *dream {
+		if !canViewDream(d, uid) {
+			return hideDream(d)
+		}
+		if !usr.ShowSensitive {
+			censorDream(d)
+		}
+		return d
+	}
+
+	root = show(root)
+	for i, d := range ds {
+		ds[i] = show(d)
+	}
+
+	return buildRemixTree(root, ds), nil
+}
+
+// build the tree with the root and its descendants,
+// the ones whose parent is not found are attached to the root
+func buildRemixTree(root *dream, ds []*dream) *remixNode {
+	nodes := map[string]*remixNode{
+		root.ID: {Dream: root, Children: make([]*remixNode, 0)},
+	}
+	for _, d := range ds {
+		nodes[d.ID] = &remixNode{Dream: d, Children: make([]*remixNode, 0)}
+	}
+
+	// descendants were sorted by created time
+	for _, d := range ds {
+		parent, ok := nodes[d.ParentID]
+		if !ok || d.ParentID == d.ID {
+			parent = nodes[root.ID]
+		}
+		parent.Children = append(parent.Children, nodes[d.ID])
+	}
+
+	return nodes[root.ID]
+}
+
+// reparentRemixes moves the remixes of the deleted dream to its parent,
+// so they are still under their nearest ancestor in the tree, the root is kept
+func reparentRemixes(ctx context.Context, d *dream) error {
+	cursor, err := dreams.Find(ctx, bson.M{"parentId": d.ID}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+
+	var ds []*dream
+	if err = cursor.All(ctx, &ds); err != nil {
+		return err
+	}
+
+	if len(ds) == 0 {
+		return nil
+	}
+
+	if _, err = dreams.UpdateMany(ctx, bson.M{"parentId": d.ID}, bson.M{"$set": bson.M{"parentId": d.ParentID}}); err != nil {
+		return err
+	}
+
+	for _, c := range ds {
+		if err = expires("d:" + c.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package dream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestBuildRemixTree(t *testing.T) {
+	root := &dream{ID: "a"}
+	ds := []*dream{
+		{ID: "b", ParentID: "a", RootID: "a"},
+		{ID: "c", ParentID: "b", RootID: "a"},
+		{ID: "d", ParentID: "a", RootID: "a"},
+		{ID: "e", ParentID: "x", RootID: "a"}, // parent not found
+		{ID: "f", ParentID: "", RootID: "a"},  // parent was the deleted root
+	}
+
+	tree := buildRemixTree(root, ds)
+	assert.Equal(t, "a", tree.Dream.ID)
+	assert.Equal(t, 4, len(tree.Children))
+	assert.Equal(t, "b", tree.Children[0].Dream.ID)
+	assert.Equal(t, "d", tree.Children[1].Dream.ID)
+	assert.Equal(t, "e", tree.Children[2].Dream.ID)
+	assert.Equal(t, "f", tree.Children[3].Dream.ID)
+	assert.Equal(t, "c", tree.Children[0].Children[0].Dream.ID)
+	assert.Equal(t, 0, len(tree.Children[1].Children))
+
+	// placeholder of the deleted root
+	tree = buildRemixTree(&dream{ID: "x", Visibility: visPrivate}, []*dream{{ID: "y", ParentID: "x", RootID: "x"}})
+	assert.Equal(t, "x", tree.Dream.ID)
+	assert.Equal(t, 1, len(tree.Children))
+}
+
+func TestRemixTreeCensored(t *testing.T) {
+	testSetup()
+
+	defer func() {
+		if err := delUsrByName("tester051"); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	w := testLogin(t, "tester051")
+	_, c := testJwtToken(t, w)
+
+	ctx := context.TODO()
+	root := &dream{ID: uuid.New().String(), AuthorID: c.ID, Status: dsDone, Images: []string{"root.png"}, Created: time.Now()}
+	child := &dream{
+		ID: uuid.New().String(), AuthorID: c.ID, Status: dsNsfw, ParentID: root.ID, RootID: root.ID,
+		Images: []string{"child.png"}, Blurred: []string{"child_blur.jpg"}, Created: time.Now(),
+	}
+	for _, d := range []*dream{root, child} {
+		if _, err := dreams.InsertOne(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer dreams.DeleteMany(ctx, bson.M{"rootId": root.ID})
+	defer dreams.DeleteOne(ctx, bson.M{"_id": root.ID})
+
+	tree, err := getRemixTree(root.ID, c.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"root.png"}, tree.Dream.Images)
+	assert.Equal(t, []string{"child_blur.jpg"}, tree.Children[0].Dream.Images)
+}
+
+func TestNewRemix(t *testing.T) {
+	parent := newTestDream()
+	parent.ID = "parent"
+	parent.RootID = "root"
+	parent.Sampler = "ddim"
+
+	d := newRemix(parent, &remix{Prompt: "Hello, Remix!"})
+	assert.Equal(t, "Hello, Remix!", d.Prompt)
+	assert.Equal(t, parent.Seed, d.Seed)
+	assert.Equal(t, "ddim", d.Sampler)
+	assert.Equal(t, "parent", d.ParentID)
+	assert.Equal(t, "root", d.RootID)
+
+	d = newRemix(parent, &remix{RandomSeed: true})
+	assert.Equal(t, parent.Prompt, d.Prompt)
+	assert.Equal(t, int64(0), d.Seed)
+
+	parent.RootID = ""
+	d = newRemix(parent, &remix{Seed: 42})
+	assert.Equal(t, int64(42), d.Seed)
+	assert.Equal(t, "parent", d.RootID)
+}
+
+func TestRemixDream(t *testing.T) {
+	testSetup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go sdSimulating(ctx)
+
+	defer func() {
+		cancel()
+		err := delUsrByName("tester027")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	w := testLogin(t, "tester027")
+	token, _ := testJwtToken(t, w)
+
+	remixReq := func(id string, rm *remix) *httptest.ResponseRecorder {
+		req, err := postJsonReq("/api/dream/remix/"+id, rm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	rootId := testPostDream(t, token, newTestDream())
+
+	// can't remix an unfinished dream
+	time.Sleep(time.Millisecond * 5)
+	d, err := getDreamById(rootId)
+	assert.Nil(t, err)
+	if d.Status != dsDone {
+		assertNotOK(t, remixReq(rootId, &remix{}))
+	}
+
+	time.Sleep(time.Second * 1)
+
+	body := assertOK(t, remixReq(rootId, &remix{Prompt: "Hello, Remix!"}))
+	childId := body["id"].(string)
+
+	child, err := getDreamById(childId)
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello, Remix!", child.Prompt)
+	assert.Equal(t, rootId, child.ParentID)
+	assert.Equal(t, rootId, child.RootID)
+
+	time.Sleep(time.Second * 1)
+
+	body = assertOK(t, remixReq(childId, &remix{RandomSeed: true}))
+	grandchildId := body["id"].(string)
+
+	grandchild, err := getDreamById(grandchildId)
+	assert.Nil(t, err)
+	assert.Equal(t, childId, grandchild.ParentID)
+	assert.Equal(t, rootId, grandchild.RootID)
+
+	// get the tree from any node
+	req, _ := http.NewRequest("GET", "/api/dream/remixes/"+grandchildId, nil)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	body = assertOK(t, w)
+
+	tree := body["tree"].(map[string]interface{})
+	assert.Equal(t, rootId, tree["dream"].(map[string]interface{})["_id"])
+
+	children := tree["children"].([]interface{})
+	assert.Equal(t, 1, len(children))
+	assert.Equal(t, 1, len(children[0].(map[string]interface{})["children"].([]interface{})))
+}
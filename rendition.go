@@ -0,0 +1,419 @@
+package dream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png" // register png decoder
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// redis keys of the rendition jobs
+const (
+	renditionQueueKey      = "RQ"            // list of the images to be rendered
+	renditionProcessingKey = "RQ:processing" // jobs being processed by the workers
+	renditionClaimsKey     = "RQ:claims"     // zset of the processing jobs, scored by the deadline in ms
+)
+
+// resized copy of a generated image
+type rendition struct {
+	Image  string `json:"image" bson:"image"` // key of the original image
+	Name   string `json:"name" bson:"name"`   // "original", "thumb", "medium" ...
+	URL    string `json:"url" bson:"url"`
+	Width  int    `json:"width" bson:"width"`
+	Height int    `json:"height" bson:"height"`
+}
+
+// rendition size, configured by "renditions"
+type renditionSpec struct {
+	Name    string `mapstructure:"name"`
+	MaxEdge int    `mapstructure:"maxEdge"` // the longer edge will be resized to it
+	Quality int    `mapstructure:"quality"` // jpeg quality
+}
+
+type renditionJob struct {
+	Dream string `json:"dream"`
+	Image string `json:"image"`
+	Blur  bool   `json:"blur,omitempty"` // generate the blurred variant of the flagged image
+
+	Attempts int `json:"attempts,omitempty"` // failed attempts so far
+}
+
+func imageURL(key string) string {
+	return viper.GetString("imageBaseURL") + key
+}
+
+// key of the image's rendition, eg: "abc_123_thumb.jpg"
+func renditionKey(key string, name string) string {
+	return strings.TrimSuffix(key, filepath.Ext(key)) + "_" + name + ".jpg"
+}
+
+// push the uploaded image into the rendition queue
+func enqueueRendition(dreamId string, key string) error {
+	return pushRenditionJob(&renditionJob{Dream: dreamId, Image: key})
+}
+
+// push the flagged image into the rendition queue to be blurred
+func enqueueBlur(dreamId string, key string) error {
+	return pushRenditionJob(&renditionJob{Dream: dreamId, Image: key, Blur: true})
+}
+
+func pushRenditionJob(job *renditionJob) error {
+	p, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return rdb.RPush(context.TODO(), renditionQueueKey, p).Err()
+}
+
+// renditionWorker generates renditions of the uploaded images until the context is done,
+// the jobs are kept in the processing list until they are done,
+// so they will be requeued by renditionRequeuer if the worker crashed
+func renditionWorker(ctx context.Context) {
+	for {
+		p, err := rdb.BLMove(ctx, renditionQueueKey, renditionProcessingKey, "LEFT", "RIGHT", time.Second*5).Result()
+		if err == redis.Nil {
+			continue
+		} else if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			l.Errorln("rendition queue failed", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		// NX, since the requeuer may have claimed it already
+		if err = claimRenditionJob(ctx, p, renditionDeadline(viper.GetDuration("renditionTimeout"))); err != nil {
+			l.Errorln("claim rendition job failed", err)
+		}
+
+		var job renditionJob
+		if err = json.Unmarshal([]byte(p), &job); err != nil {
+			l.Errorln("invalid rendition job", err)
+		} else if err = processRendition(ctx, &job); err != nil {
+			l.Errorln("rendition failed", job.Image, job.Attempts, err)
+			if err = retryRenditionJob(ctx, p, &job); err != nil {
+				l.Errorln("retry rendition job failed", err)
+			}
+			continue
+		}
+
+		if err = ackRenditionJob(ctx, p); err != nil {
+			l.Errorln("ack rendition job failed", err)
+		}
+	}
+}
+
+func renditionDeadline(d time.Duration) string {
+	return strconv.FormatInt(time.Now().Add(d).UnixMilli(), 10)
+}
+
+// set the deadline of the job which is moved into the processing list
+func claimRenditionJob(ctx context.Context, p string, deadline string) error {
+	score, err := strconv.ParseFloat(deadline, 64)
+	if err != nil {
+		return err
+	}
+	return rdb.ZAddNX(ctx, renditionClaimsKey, redis.Z{Score: score, Member: p}).Err()
+}
+
+// remove the done job from the processing list
+func ackRenditionJob(ctx context.Context, p string) error {
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, renditionProcessingKey, 1, p)
+		pipe.ZRem(ctx, renditionClaimsKey, p)
+		return nil
+	})
+	return err
+}
+
+// replace the failed job with the next attempt, which will be requeued after the backoff,
+// the job is dropped after "renditionRetries" attempts
+func retryRenditionJob(ctx context.Context, p string, job *renditionJob) error {
+	job.Attempts++
+	if job.Attempts > viper.GetInt("renditionRetries") {
+		l.Errorln("rendition dropped", job.Dream, job.Image, job.Attempts)
+		return ackRenditionJob(ctx, p)
+	}
+
+	next, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	score, err := strconv.ParseFloat(renditionDeadline(viper.GetDuration("renditionBackoff")), 64)
+	if err != nil {
+		return err
+	}
+
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, renditionProcessingKey, 1, p)
+		pipe.ZRem(ctx, renditionClaimsKey, p)
+		pipe.RPush(ctx, renditionProcessingKey, next)
+		pipe.ZAdd(ctx, renditionClaimsKey, redis.Z{Score: score, Member: string(next)})
+		return nil
+	})
+	return err
+}
+
+// push the jobs which are not done before their deadlines back to the queue
+func requeueRenditionJobs(ctx context.Context) (int, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	keys := []string{renditionQueueKey, renditionProcessingKey, renditionClaimsKey}
+	return requeueJobsScript.Run(ctx, rdb, keys, now, renditionDeadline(viper.GetDuration("renditionTimeout"))).Int()
+}
+
+// renditionRequeuer requeues the failed jobs when they are due,
+// and the jobs which the crashed workers failed to finish
+func renditionRequeuer(ctx context.Context) {
+	ticker := time.NewTicker(viper.GetDuration("renditionPoll"))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := requeueRenditionJobs(ctx); err != nil {
+				l.Errorln("requeue rendition jobs failed", err)
+			} else if n > 0 {
+				l.Infoln("REQUEUE_RENDITIONS", n)
+			}
+		}
+	}
+}
+
+// processRendition generates all the renditions of the image, and saves them to the dream
+func processRendition(ctx context.Context, job *renditionJob) error {
+	if job.Blur {
+		return processBlur(ctx, job)
+	}
+
+	var specs []renditionSpec
+	if err := viper.UnmarshalKey("renditions", &specs); err != nil {
+		return err
+	}
+
+	rs, err := makeRenditions(ctx, store, job.Image, specs)
+	if err != nil {
+		return err
+	}
+
+	// skip if the renditions were saved by an attempt which failed to be acknowledged
+	_, err = dreams.UpdateOne(ctx, bson.M{"_id": job.Dream, "renditions.image": bson.M{"$ne": job.Image}}, bson.M{
+		"$push": bson.M{"renditions": bson.M{"$each": rs}},
+	})
+	if err != nil {
+		return err
+	}
+
+	l.Debugln("renditions generated:", job.Image, len(rs))
+	return expires("d:" + job.Dream)
+}
+
+// processBlur generates the blurred variant of the image, and saves it to the dream
+func processBlur(ctx context.Context, job *renditionJob) error {
+	key, err := makeBlurred(ctx, store, job.Image, viper.GetInt("blurSize"))
+	if err != nil {
+		return err
+	}
+
+	_, err = dreams.UpdateByID(ctx, job.Dream, bson.M{"$addToSet": bson.M{"blurred": key}})
+	if err != nil {
+		return err
+	}
+
+	l.Debugln("blurred image generated:", key)
+	return expires("d:" + job.Dream)
+}
+
+// makeBlurred shrinks the image to a few pixels, then scales it back smoothly,
+// so nothing but the colors can be recognized
+func makeBlurred(ctx context.Context, s imageStore, key string, size int) (string, error) {
+	img, err := s.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer img.Close()
+
+	src, _, err := image.Decode(img.Body)
+	if err != nil {
+		return "", err
+	}
+
+	b := src.Bounds()
+	w, h := fitSize(b.Dx(), b.Dy(), size)
+	dst := upscaleImage(resizeImage(src, w, h), b.Dx(), b.Dy())
+
+	buf := &bytes.Buffer{}
+	if err = jpeg.Encode(buf, dst, &jpeg.Options{Quality: 75}); err != nil {
+		return "", err
+	}
+
+	bkey := renditionKey(key, "blur")
+	if err = s.Put(ctx, bkey, buf.Bytes(), "image/jpeg"); err != nil {
+		return "", err
+	}
+	return bkey, nil
+}
+
+// makeRenditions resizes the image by the specs, and puts them into the store
+func makeRenditions(ctx context.Context, s imageStore, key string, specs []renditionSpec) ([]rendition, error) {
+	img, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	src, _, err := image.Decode(img.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	b := src.Bounds()
+	rs := []rendition{{Image: key, Name: "original", URL: imageURL(key), Width: b.Dx(), Height: b.Dy()}}
+
+	for _, spec := range specs {
+		w, h := fitSize(b.Dx(), b.Dy(), spec.MaxEdge)
+		dst := resizeImage(src, w, h)
+
+		buf := &bytes.Buffer{}
+		if err = jpeg.Encode(buf, dst, &jpeg.Options{Quality: spec.Quality}); err != nil {
+			return nil, err
+		}
+
+		rkey := renditionKey(key, spec.Name)
+		if err = s.Put(ctx, rkey, buf.Bytes(), "image/jpeg"); err != nil {
+			return nil, err
+		}
+
+		rs = append(rs, rendition{Image: key, Name: spec.Name, URL: imageURL(rkey), Width: w, Height: h})
+	}
+
+	return rs, nil
+}
+
+// fit the size into the max edge, keep the aspect ratio, never upscale
+func fitSize(w int, h int, maxEdge int) (int, int) {
+	if w <= maxEdge && h <= maxEdge {
+		return w, h
+	}
+
+	if w >= h {
+		return maxEdge, max1(h * maxEdge / w)
+	}
+	return max1(w * maxEdge / h), maxEdge
+}
+
+func max1(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// resizeImage downscales the image by averaging the source pixels covered by each target pixel
+func resizeImage(src image.Image, w int, h int) *image.RGBA {
+	b := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+
+	sw, sh := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max1((y+1)*sh/h)
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				off := rgba.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(rgba.Pix[off])
+					g += uint32(rgba.Pix[off+1])
+					bl += uint32(rgba.Pix[off+2])
+					a += uint32(rgba.Pix[off+3])
+					off += 4
+					n++
+				}
+			}
+
+			off := dst.PixOffset(x, y)
+			dst.Pix[off] = uint8(r / n)
+			dst.Pix[off+1] = uint8(g / n)
+			dst.Pix[off+2] = uint8(bl / n)
+			dst.Pix[off+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
+
+// upscaleImage enlarges the image with bilinear interpolation
+func upscaleImage(src *image.RGBA, w int, h int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		// map to the center of the source pixels
+		fy := (float64(y)+0.5)*float64(sh)/float64(h) - 0.5
+		y0, dy := clampFloor(fy, sh)
+		y1 := minInt(y0+1, sh-1)
+
+		for x := 0; x < w; x++ {
+			fx := (float64(x)+0.5)*float64(sw)/float64(w) - 0.5
+			x0, dx := clampFloor(fx, sw)
+			x1 := minInt(x0+1, sw-1)
+
+			p00, p10 := src.PixOffset(x0, y0), src.PixOffset(x1, y0)
+			p01, p11 := src.PixOffset(x0, y1), src.PixOffset(x1, y1)
+
+			off := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				top := float64(src.Pix[p00+c])*(1-dx) + float64(src.Pix[p10+c])*dx
+				bottom := float64(src.Pix[p01+c])*(1-dx) + float64(src.Pix[p11+c])*dx
+				dst.Pix[off+c] = uint8(top*(1-dy) + bottom*dy + 0.5)
+			}
+		}
+	}
+
+	return dst
+}
+
+// floor of the coordinate within [0, n), and its fraction
+func clampFloor(f float64, n int) (int, float64) {
+	if f <= 0 {
+		return 0, 0
+	}
+
+	i := int(f)
+	if i >= n-1 {
+		return n - 1, 0
+	}
+	return i, f - float64(i)
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
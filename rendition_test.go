@@ -0,0 +1,170 @@
+package dream
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// encode a solid color png in the given size
+func newTestPNG(t *testing.T, w int, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFitSize(t *testing.T) {
+	w, h := fitSize(512, 512, 256)
+	assert.Equal(t, 256, w)
+	assert.Equal(t, 256, h)
+
+	w, h = fitSize(1024, 512, 256)
+	assert.Equal(t, 256, w)
+	assert.Equal(t, 128, h)
+
+	w, h = fitSize(512, 1024, 256)
+	assert.Equal(t, 128, w)
+	assert.Equal(t, 256, h)
+
+	// never upscale
+	w, h = fitSize(200, 100, 256)
+	assert.Equal(t, 200, w)
+	assert.Equal(t, 100, h)
+}
+
+func TestResizeImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	src.Set(0, 0, color.RGBA{R: 255, A: 255})
+	src.Set(1, 0, color.RGBA{R: 255, A: 255})
+	src.Set(0, 1, color.RGBA{R: 255, A: 255})
+	src.Set(1, 1, color.RGBA{R: 255, A: 255})
+
+	dst := resizeImage(src, 2, 1)
+	assert.Equal(t, image.Rect(0, 0, 2, 1), dst.Bounds())
+	assert.Equal(t, color.RGBA{R: 255, A: 255}, dst.RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{}, dst.RGBAAt(1, 0))
+}
+
+func TestMakeRenditions(t *testing.T) {
+	s := &localStore{dir: t.TempDir()}
+	ctx := context.TODO()
+
+	assert.Nil(t, s.Put(ctx, "tester_1.png", newTestPNG(t, 512, 256), "image/png"))
+
+	rs, err := makeRenditions(ctx, s, "tester_1.png", []renditionSpec{
+		{Name: "thumb", MaxEdge: 128, Quality: 75},
+		{Name: "medium", MaxEdge: 1024, Quality: 85},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(rs))
+
+	assert.Equal(t, "original", rs[0].Name)
+	assert.Equal(t, 512, rs[0].Width)
+	assert.Equal(t, "thumb", rs[1].Name)
+	assert.Equal(t, 128, rs[1].Width)
+	assert.Equal(t, 64, rs[1].Height)
+	assert.Equal(t, "medium", rs[2].Name)
+	assert.Equal(t, 512, rs[2].Width)
+
+	img, err := s.Get(ctx, "tester_1_thumb.jpg")
+	assert.Nil(t, err)
+	defer img.Close()
+	assert.Equal(t, "image/jpeg", img.ContentType)
+
+	cfg, err := jpeg.DecodeConfig(img.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, 128, cfg.Width)
+	assert.Equal(t, 64, cfg.Height)
+
+	// not an image
+	assert.Nil(t, s.Put(ctx, "tester_2.png", testPNG, "image/png"))
+	_, err = makeRenditions(ctx, s, "tester_2.png", nil)
+	assert.NotNil(t, err)
+}
+
+func TestUploadRenditions(t *testing.T) {
+	testSetup()
+	testWorkerSetup()
+
+	ctx := context.TODO()
+	id := newQueuedDream(t).ID
+	defer dreams.DeleteOne(ctx, bson.M{"_id": id})
+	defer rdb.Del(ctx, queueOf(testModel))
+
+	data := newTestPNG(t, 512, 512)
+	key := id + "_tester.png"
+	assert.Nil(t, store.Put(ctx, key, data, "image/png"))
+	defer store.Delete(ctx, key)
+	defer store.Delete(ctx, renditionKey(key, "thumb"))
+	defer store.Delete(ctx, renditionKey(key, "medium"))
+
+	assert.Nil(t, enqueueRendition(id, key))
+
+	var d *dream
+	var err error
+	for i := 0; i < 50; i++ {
+		time.Sleep(time.Millisecond * 100)
+		d, err = getDreamById(id)
+		assert.Nil(t, err)
+		if len(d.Renditions) > 0 {
+			break
+		}
+	}
+
+	assert.Equal(t, 3, len(d.Renditions))
+	assert.Equal(t, imageURL(renditionKey(key, "thumb")), d.Renditions[1].URL)
+	assert.Equal(t, 256, d.Renditions[1].Width)
+}
+
+func TestRenditionRetry(t *testing.T) {
+	testSetup()
+
+	ctx := context.TODO()
+	defer rdb.Del(ctx, renditionProcessingKey, renditionClaimsKey)
+
+	// the image doesn't exist, so every attempt fails
+	job := &renditionJob{Dream: "no-such-dream", Image: "no-such-image.png"}
+	assert.NotNil(t, processRendition(ctx, job))
+
+	p := `{"dream":"no-such-dream","image":"no-such-image.png"}`
+	assert.Nil(t, rdb.RPush(ctx, renditionProcessingKey, p).Err())
+	assert.Nil(t, claimRenditionJob(ctx, p, renditionDeadline(time.Minute)))
+
+	// replaced by the next attempt, due after the backoff
+	assert.Nil(t, retryRenditionJob(ctx, p, job))
+	jobs, err := rdb.LRange(ctx, renditionProcessingKey, 0, -1).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{`{"dream":"no-such-dream","image":"no-such-image.png","attempts":1}`}, jobs)
+	n, err := rdb.ZCard(ctx, renditionClaimsKey).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+
+	// dropped after the last attempt
+	p = jobs[0]
+	job.Attempts = viper.GetInt("renditionRetries")
+	assert.Nil(t, retryRenditionJob(ctx, p, job))
+	n, err = rdb.LLen(ctx, renditionProcessingKey).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+	n, err = rdb.ZCard(ctx, renditionClaimsKey).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+}
@@ -0,0 +1,266 @@
+package dream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v9"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var errNotDead = errors.New("dream.dead.notFound")
+
+func retryHandlers() {
+	r.GET("/api/admin/dead", jwtAuth, adminAuth, deadLettersHandler)
+	r.POST("/api/admin/dead/redrive/:id", jwtAuth, adminAuth, redriveHandler)
+}
+
+// list the dreams in the dead letter queue
+func deadLettersHandler(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "0"))
+	if err != nil || page < 0 {
+		badRequest(c, errors.New("invalid.input"))
+		return
+	}
+
+	ds, err := getDeadLetters(page)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":     true,
+		"dreams": ds,
+	})
+}
+
+// put the dead dream back to the queue
+func redriveHandler(c *gin.Context) {
+	err := redriveDream(c.Param("id"))
+	if err == errNotDead || err == errInsufficientCredits {
+		badRequest(c, err)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	ok(c)
+}
+
+// backoff duration before the n-th retry, doubled every time
+func retryBackoff(n int) time.Duration {
+	d := viper.GetDuration("retryBackoff")
+	max := viper.GetDuration("retryBackoffMax")
+
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// close the last attempt of the dream with the failure reason
+func endAttempt(d *dream, reason string) {
+	if n := len(d.Attempts); n > 0 && d.Attempts[n-1].Ended.IsZero() {
+		d.Attempts[n-1].Ended = time.Now()
+		d.Attempts[n-1].Error = reason
+	}
+
+	d.Retries++
+	d.FailReason = reason
+}
+
+// fields of the dream changed by endAttempt
+func attemptFields(d *dream) bson.M {
+	set := bson.M{"retries": d.Retries, "failReason": d.FailReason}
+	if n := len(d.Attempts); n > 0 {
+		set["attempts."+strconv.Itoa(n-1)] = d.Attempts[n-1]
+	}
+	return set
+}
+
+// retryDream schedules the failed dream claimed by the worker with backoff,
+// or moves it into the dead letter queue if there is no retry left, then releases the claim
+func retryDream(ctx context.Context, worker string, id string, reason string) (dead bool, err error) {
+	d, err := getDreamById(id)
+	if err == redis.Nil || err == mongo.ErrNoDocuments {
+		return false, releaseJob(ctx, worker, id) // deleted by its author, no retry
+	} else if err != nil {
+		return
+	}
+
+	// cancelled by its author, no retry
+	if d.Status == dsCancelled {
+		return false, releaseJob(ctx, worker, id)
+	}
+
+	endAttempt(d, reason)
+
+	if d.Retries > viper.GetInt("retryMax") {
+		if err = deadLetter(d); err != nil {
+			return
+		}
+		return true, releaseJob(ctx, worker, id)
+	}
+
+	d.Status = dsPending
+	set := attemptFields(d)
+	set["status"] = d.Status
+	if err = updateDream(d, set, false); err != nil {
+		return
+	}
+
+	at := time.Now().Add(retryBackoff(d.Retries))
+	l.Infoln("RETRY_DREAM", id, "at:", at, "reason:", reason)
+
+	err = scheduleRetry(ctx, worker, id, at)
+	return
+}
+
+// timeoutDream handles the dream whose worker kept silent, it's still claimed by the reaper,
+// so it's updated before it can be claimed again
+func timeoutDream(id string) error {
+	ctx := context.TODO()
+	d, err := getDreamById(id)
+	if err == redis.Nil || err == mongo.ErrNoDocuments {
+		return dropTimeout(ctx, id) // deleted by its author
+	} else if err != nil {
+		return err
+	}
+
+	// cancelled by its author, or handled before the reaper failed to release it
+	if d.Status != dsProcessing && d.Status != dsPending {
+		return dropTimeout(ctx, id)
+	}
+
+	endAttempt(d, "queue.timeout")
+
+	if d.Retries > viper.GetInt("retryMax") {
+		if err := deadLetter(d); err != nil {
+			return err
+		}
+		return releaseJob(ctx, reaperId, id)
+	}
+
+	d.Status = dsPending
+	set := attemptFields(d)
+	set["status"] = d.Status
+	if err = updateDream(d, set, false); err != nil {
+		return err
+	}
+	return requeueJob(ctx, id)
+}
+
+// remove the dream taken over by the reaper from the queues
+func dropTimeout(ctx context.Context, id string) error {
+	if err := dequeueDream(ctx, id); err != nil {
+		return err
+	}
+	return releaseJob(ctx, reaperId, id)
+}
+
+// mark the dream as failed, and push it into the dead letter queue
+func deadLetter(d *dream) error {
+	d.Status = dsFailed
+	d.Finished = time.Now()
+
+	set := attemptFields(d)
+	set["status"] = d.Status
+	set["finished"] = d.Finished
+	if err := updateDream(d, set, false); err != nil {
+		return err
+	}
+
+	l.Infoln("DEAD_DREAM", d.ID, "reason:", d.FailReason)
+
+	if err := refundDream(d); err != nil {
+		return err
+	}
+
+	ctx := context.TODO()
+	if _, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, queuesKey, d.ID)
+		pipe.LPush(ctx, deadKey, d.ID)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return onDreamFinished(d)
+}
+
+func getDeadLetters(page int) ([]*dream, error) {
+	perPage := int64(viper.GetInt("deadPerPage"))
+	start := perPage * int64(page)
+
+	ids, err := rdb.LRange(context.TODO(), deadKey, start, start+perPage-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ds := make([]*dream, 0, len(ids))
+	for _, id := range ids {
+		d, err := getDreamById(id)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// redriveDream resets the retries of the dead dream, then push it into the queue again,
+// its attempts history will be kept, the author is charged again since it was refunded when it died
+func redriveDream(id string) error {
+	ctx := context.TODO()
+	n, err := rdb.LRem(ctx, deadKey, 0, id).Result()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return errNotDead
+	}
+
+	d, err := getDreamById(id)
+	if err != nil {
+		return err
+	}
+
+	if err = chargeDream(d); err != nil {
+		// put it back, so it can be redriven later
+		if e := rdb.LPush(ctx, deadKey, id).Err(); e != nil {
+			l.Errorln("push back dead dream failed", id, e)
+		}
+		return err
+	}
+
+	d.Status = dsPending
+	d.Retries = 0
+	d.FailReason = ""
+	d.Finished = time.Time{}
+	d.Refunded = false
+
+	// the cost may be changed since it was charged, and it can be refunded again if it fails
+	set := bson.M{
+		"status": d.Status, "retries": d.Retries, "failReason": d.FailReason, "finished": d.Finished,
+		"cost": d.Cost, "refunded": d.Refunded,
+	}
+	if err = updateDream(d, set, false); err != nil {
+		return err
+	}
+
+	l.Infoln("REDRIVE_DREAM", id)
+	return enqueueDream(id, d.Model)
+}
@@ -0,0 +1,137 @@
+package dream
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	viper.SetDefault("retryBackoff", time.Second*10)
+	viper.SetDefault("retryBackoffMax", time.Minute)
+
+	assert.Equal(t, time.Second*10, retryBackoff(1))
+	assert.Equal(t, time.Second*20, retryBackoff(2))
+	assert.Equal(t, time.Second*40, retryBackoff(3))
+	assert.Equal(t, time.Minute, retryBackoff(4))
+	assert.Equal(t, time.Minute, retryBackoff(10))
+
+	viper.SetDefault("retryBackoffMax", time.Minute*10)
+}
+
+func TestRetryAndDeadLetter(t *testing.T) {
+	testWorkerSetup()
+
+	viper.Set("admins", []string{"tester021"})
+	viper.SetDefault("retryMax", 1)
+	viper.SetDefault("retryBackoff", time.Second)
+
+	defer func() {
+		viper.SetDefault("retryMax", 3)
+		viper.SetDefault("retryBackoff", time.Second*10)
+
+		err := delUsrByName("tester021")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	ctx := context.TODO()
+	rdb.Del(ctx, queueOf(testModel), delayedKey)
+
+	w := testLogin(t, "tester021")
+	token, c := testJwtToken(t, w)
+
+	id := testPostDream(t, token, newTestDream())
+
+	failed := func() {
+		w := claimReq()
+		body := assertOK(t, w)
+		assert.Equal(t, id, body["job"].(map[string]interface{})["_id"])
+
+		w = workerReq("POST", "/api/worker/failed/"+id, bytes.NewBufferString("reason=cuda.oom"), "application/x-www-form-urlencoded")
+		assertOK(t, w)
+	}
+
+	// first failure, retry later
+	failed()
+
+	d, err := getDreamById(id)
+	assert.Nil(t, err)
+	assert.Equal(t, dsPending, d.Status)
+	assert.Equal(t, 1, d.Retries)
+	assert.Equal(t, "cuda.oom", d.FailReason)
+	assert.Equal(t, 1, len(d.Attempts))
+	assert.Equal(t, "tester-worker", d.Attempts[0].Worker)
+	assert.Equal(t, "cuda.oom", d.Attempts[0].Error)
+
+	_, err = rdb.ZScore(ctx, delayedKey, id).Result()
+	assert.Nil(t, err)
+
+	// not ready yet
+	ids, err := promoteDelayed(ctx)
+	assert.Nil(t, err)
+	assert.NotContains(t, ids, id)
+
+	time.Sleep(time.Second)
+	ids, err = promoteDelayed(ctx)
+	assert.Nil(t, err)
+	assert.Contains(t, ids, id)
+
+	// second failure, dead
+	failed()
+
+	d, err = getDreamById(id)
+	assert.Nil(t, err)
+	assert.Equal(t, dsFailed, d.Status)
+	assert.Equal(t, 2, len(d.Attempts))
+
+	// list dead letters
+	req, _ := http.NewRequest("GET", "/api/admin/dead", nil)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	body := assertOK(t, w)
+	assert.Equal(t, id, body["dreams"].([]interface{})[0].(map[string]interface{})["_id"])
+
+	// redrive
+	req, _ = http.NewRequest("POST", "/api/admin/dead/redrive/"+id, nil)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertOK(t, w)
+
+	d, err = getDreamById(id)
+	assert.Nil(t, err)
+	assert.Equal(t, dsPending, d.Status)
+	assert.Equal(t, 0, d.Retries)
+	assert.False(t, d.Refunded)
+
+	// charged again, since it was refunded when it died
+	usr, err := getUserById(c.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, viper.GetInt64("signupCredits")-d.Cost, usr.Credits)
+
+	// not dead any more
+	req, _ = http.NewRequest("POST", "/api/admin/dead/redrive/"+id, nil)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertNotOK(t, w)
+
+	// only admins
+	viper.Set("admins", []string{})
+	req, _ = http.NewRequest("GET", "/api/admin/dead", nil)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertNotOK(t, w)
+
+	rdb.Del(ctx, queueOf(testModel))
+}
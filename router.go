@@ -36,17 +36,65 @@ func Setup(engine *gin.Engine) {
 	// connect to redis and mongodb
 	rdb, mdb = dbConn()
 
+	// create the image store and the moderator
+	store = newImageStore()
+	mod = newModerator()
+
 	// set router
 	r = engine
 
+	// only the configured proxies are trusted to forward the client's ip, eg: by "X-Forwarded-For"
+	if err := r.SetTrustedProxies(viper.GetStringSlice("trustedProxies")); err != nil {
+		panic(err)
+	}
+
 	// setup handlers
-	pingHandlers()      // ping handlers
-	authHandlers()      // auth handlers
-	dreamHandlers()     // dream handlers
-	feedHandlers()      // user's feed handlers
-	subscribeHandlers() // users' subscribe handlers
-	likesHandlers()     // likes input handlers
-	commentsHandlers()  // comments handlers
+	pingHandlers()        // ping handlers
+	authHandlers()        // auth handlers
+	dreamHandlers()       // dream handlers
+	feedHandlers()        // user's feed handlers
+	subscribeHandlers()   // users' subscribe handlers
+	likesHandlers()       // likes input handlers
+	commentsHandlers()    // comments handlers
+	workerHandlers()      // stable diffusion workers' handlers
+	retryHandlers()       // dead letter queue handlers
+	streamHandlers()      // dream events streaming handlers
+	catalogHandlers()     // models catalog handlers
+	remixHandlers()       // remix handlers
+	storeHandlers()       // images handlers
+	moderationHandlers()  // nsfw moderation handlers
+	rulesHandlers()       // prompt rules handlers
+	creditsHandlers()     // credits handlers
+	webhookHandlers()     // webhooks handlers
+	visibilityHandlers()  // dream visibility and deletion handlers
+	galleryHandlers()     // users' gallery handlers
+	exploreHandlers()     // explore feed handlers
+	searchHandlers()      // prompt search handlers
+	tagsHandlers()        // hashtags handlers
+	collectionsHandlers() // collections handlers
+	bookmarksHandlers()   // bookmarks handlers
+
+	// fill the search terms and the tags of the old dreams
+	go indexSearchTerms(context.Background())
+	go indexTags(context.Background())
+
+	// give the starting credits to the old users
+	go backfillCredits(context.Background())
+
+	// requeue the dreams which workers failed to acknowledge
+	go queueReaper(context.Background())
+
+	// generate the renditions of the uploaded images
+	for i := 0; i < viper.GetInt("renditionWorkers"); i++ {
+		go renditionWorker(context.Background())
+	}
+	go renditionRequeuer(context.Background())
+
+	// notify the webhooks when the dreams are finished
+	for i := 0; i < viper.GetInt("webhookWorkers"); i++ {
+		go webhookWorker(context.Background())
+	}
+	go webhookRetrier(context.Background())
 }
 
 func pingHandlers() {
@@ -89,8 +137,16 @@ func dbConn() (rdb *redis.Client, mdb *mongo.Client) {
 	users = db.Collection(viper.GetString("users"))
 	dreams = db.Collection(viper.GetString("dreams"))
 	comments = db.Collection(viper.GetString("comments"))
+	sdModels = db.Collection(viper.GetString("models"))
+	promptRules = db.Collection(viper.GetString("rules"))
+	ledger = db.Collection(viper.GetString("ledger"))
+	webhooks = db.Collection(viper.GetString("webhooks"))
+	deliveries = db.Collection(viper.GetString("deliveries"))
+	collections = db.Collection(viper.GetString("collections"))
+	bookmarks = db.Collection(viper.GetString("bookmarks"))
 
 	ensureIndeces()
+	seedModels()
 
 	return
 }
@@ -115,6 +171,13 @@ func Config() {
 	viper.SetDefault("users", "users")
 	viper.SetDefault("dreams", "dreams")
 	viper.SetDefault("comments", "comments")
+	viper.SetDefault("models", "models")
+	viper.SetDefault("rules", "rules")
+	viper.SetDefault("ledger", "ledger")
+	viper.SetDefault("webhooks", "webhooks")
+	viper.SetDefault("deliveries", "deliveries")
+	viper.SetDefault("collections", "collections")
+	viper.SetDefault("bookmarks", "bookmarks")
 
 	viper.SetDefault("redis", "localhost:6379")
 
@@ -133,11 +196,140 @@ func Config() {
 	viper.SetDefault("feedLimit", 16)   // max feed length
 	viper.SetDefault("outboxLimit", 24) // max outbox length
 
+	viper.SetDefault("timelineLimit", 500)       // max timeline length
+	viper.SetDefault("fanoutMaxFollowers", 1000) // the followers of the users who have more followers read their outboxes instead
+
+	viper.SetDefault("galleryPerPage", 24) // dreams per page of the user's gallery
+
+	viper.SetDefault("explorePerPage", 24)            // dreams per page of the explore feed
+	viper.SetDefault("exploreWindow", time.Hour*24*7) // dreams finished in the last 7 days are explored
+	viper.SetDefault("exploreDecay", time.Hour*12)    // 10x engagement is worth being 12 hours newer
+	viper.SetDefault("exploreCommentWeight", 2.0)     // a comment counts as 2 likes
+	viper.SetDefault("exploreTopExp", time.Minute*1)  // top of the day/week will be rebuilt every minute
+
+	viper.SetDefault("searchPerPage", 24)  // dreams per page of the search results
+	viper.SetDefault("searchTermsMax", 64) // max search terms of a prompt or a query
+
+	viper.SetDefault("tagsMax", 10)          // max hashtags of a dream
+	viper.SetDefault("tagMaxLen", 32)        // max length of a hashtag
+	viper.SetDefault("followingTagsMax", 50) // max tags followed by a user
+	viper.SetDefault("popularTagsLimit", 20) // number of the popular tags listed
+	viper.SetDefault("tagDreamsPerPage", 24) // dreams per page of the tag
+
+	viper.SetDefault("collectionsMax", 50)         // collections of each user
+	viper.SetDefault("collectionItemsMax", 200)    // dreams of each collection
+	viper.SetDefault("collectionNameMaxLen", 64)   // max length of the collection's name
+	viper.SetDefault("collectionDescMaxLen", 500)  // max length of the collection's description
+	viper.SetDefault("collectionCoverSize", 4)     // the first dreams shown as the cover of the collection
+	viper.SetDefault("expCollection", time.Hour*1) // collections' cache will expires in ONE hour by default
+
+	viper.SetDefault("bookmarksPerPage", 24) // saved dreams per page
+
 	viper.SetDefault("feedUpdatedLimit", -3) // default feed updated limit at 3 days ago
 
 	viper.SetDefault("commentMaxLen", 128)  // max comment length
 	viper.SetDefault("commentsPerPage", 12) // max comment length
 
+	viper.SetDefault("queueVisibility", time.Minute*5)    // claimed dream will be requeued if the worker keeps silent for 5 minutes
+	viper.SetDefault("queueReapInterval", time.Second*10) // check the expired claims every 10 seconds
+	viper.SetDefault("queuePoll", time.Millisecond*200)   // workers poll the queue every 200 milliseconds while waiting
+	viper.SetDefault("queueStatsSamples", 100)            // recent finished jobs sampled to estimate the time
+	viper.SetDefault("expQueueStats", time.Second*10)     // summary of the samples and workers is cached for 10 seconds
+
+	viper.SetDefault("workerClaimWait", time.Second*5)  // worker's claim request waits 5 seconds at most for a new job
+	viper.SetDefault("previewMaxSize", 256*1024)        // progress preview image can't be larger than 256KB
+	viper.SetDefault("streamKeepAlive", time.Second*15) // streaming clients are pinged every 15 seconds
+
+	viper.SetDefault("imageStore", "local")                 // "local" or "s3"
+	viper.SetDefault("imageDir", "images")                  // generated images will be saved in this directory by local store
+	viper.SetDefault("imageMaxSize", 20*1024*1024)          // uploaded image can't be larger than 20MB
+	viper.SetDefault("imageMaxAge", 31536000)               // images will be cached by clients for one year
+	viper.SetDefault("s3Endpoint", "http://localhost:9000") // access key and secret key should be set by env vars
+	viper.SetDefault("s3Bucket", "dreams")
+	viper.SetDefault("s3Region", "us-east-1")
+
+	// renditions are encoded as jpeg, the longer edge is resized to "maxEdge"
+	viper.SetDefault("renditions", []map[string]interface{}{
+		{"name": "thumb", "maxEdge": 256, "quality": 75},
+		{"name": "medium", "maxEdge": 768, "quality": 85},
+	})
+	viper.SetDefault("renditionWorkers", 2)              // goroutines generating the renditions
+	viper.SetDefault("renditionTimeout", time.Minute*1)  // job will be requeued if it's not done in one minute
+	viper.SetDefault("renditionRetries", 3)              // failed job will be retried 3 times at most
+	viper.SetDefault("renditionBackoff", time.Second*30) // failed job will be retried after 30 seconds
+	viper.SetDefault("renditionPoll", time.Second*5)     // check the due jobs every 5 seconds
+	viper.SetDefault("imageBaseURL", "/api/images/")     // prefix of the images' urls, may be a CDN
+
+	viper.SetDefault("retryMax", 3)                     // failed dream will be retried 3 times at most
+	viper.SetDefault("retryBackoff", time.Second*10)    // first retry after 10 seconds, doubled every time
+	viper.SetDefault("retryBackoffMax", time.Minute*10) // retry backoff won't be longer than 10 minutes
+	viper.SetDefault("deadPerPage", 20)                 // dead dreams per page
+
+	// limits of the dream params
+	viper.SetDefault("promptMaxLen", 1000) // max prompt length in characters
+	viper.SetDefault("stepsMin", 1)
+	viper.SetDefault("stepsMax", 150)
+	viper.SetDefault("stepsDefault", 50)
+	viper.SetDefault("scaleMin", 1.0)
+	viper.SetDefault("scaleMax", 30.0)
+	viper.SetDefault("scaleDefault", 7.5)
+	viper.SetDefault("sizeMin", 256) // width and height
+	viper.SetDefault("sizeMax", 1024)
+	viper.SetDefault("sizeMultiple", 64) // width and height must be multiple of 64
+	viper.SetDefault("sizeDefault", 512)
+	viper.SetDefault("seedMin", 1)
+	viper.SetDefault("seedMax", 4294967295) // max of uint32
+
+	viper.SetDefault("modelDefault", "sd-v1-5")
+	// models will be inserted into the models collection, if they don't exist
+	viper.SetDefault("modelSeeds", []map[string]interface{}{
+		{
+			"name":        "sd-v1-5",
+			"version":     "1.5",
+			"enabled":     true,
+			"steps":       50,
+			"scale":       7.5,
+			"width":       512,
+			"height":      512,
+			"maxWidth":    1024,
+			"maxHeight":   1024,
+			"samplers":    []string{"euler_a", "euler", "ddim", "dpm++_2m", "lms", "pndm"},
+			"clipSkipMax": 2,
+			"batchMax":    4,
+			"nsfw":        "moderate",
+		},
+	})
+	viper.SetDefault("expModel", time.Hour*1) // model's cache will expires in ONE hour by default
+
+	viper.SetDefault("remixTreeLimit", 200) // max dreams in a remix tree
+
+	viper.SetDefault("moderator", "rules") // "rules" flags the dreams by "nsfwKeywords", "none" flags nothing
+	viper.SetDefault("nsfwKeywords", []string{"nsfw", "nude", "naked", "gore"})
+	viper.SetDefault("blurSize", 16)       // flagged images are shrunk to 16 pixels, then scaled back
+	viper.SetDefault("appealMaxLen", 500)  // max length of the appeal reason
+	viper.SetDefault("appealsPerPage", 20) // pending appeals per page
+
+	viper.SetDefault("rulePatternMaxLen", 200)                 // max length of the rule's pattern
+	viper.SetDefault("ruleMatchTimeout", time.Millisecond*100) // regex rule will be treated as matched if it runs longer
+	viper.SetDefault("reviewsPerPage", 20)                     // dreams held for review per page
+
+	viper.SetDefault("rateLimitEnabled", true)     // limits are defined by "rateLimits" in config.yaml
+	viper.SetDefault("trustedProxies", []string{}) // ips or cidrs of the reverse proxies, none by default
+
+	viper.SetDefault("creditUnit", 50*512*512) // one credit for 50 steps of a 512x512 image
+	viper.SetDefault("signupCredits", 100)     // credits given to the new users
+	viper.SetDefault("ledgerPerPage", 20)      // ledger entries per page
+
+	viper.SetDefault("webhooksMax", 5)                 // webhooks of each user
+	viper.SetDefault("webhookWorkers", 2)              // goroutines delivering the webhook events
+	viper.SetDefault("webhookTimeout", time.Second*10) // receiver must respond in 10 seconds
+	viper.SetDefault("webhookRetries", 5)              // failed delivery will be retried 5 times at most
+	viper.SetDefault("webhookBackoff", time.Second*10) // first retry after 10 seconds, doubled every time
+	viper.SetDefault("webhookBackoffMax", time.Hour*1) // retry backoff won't be longer than one hour
+	viper.SetDefault("webhookPoll", time.Second*1)     // check the due retries every second
+	viper.SetDefault("deliveriesPerPage", 20)          // delivery logs per page
+	viper.SetDefault("webhookAllowedNets", []string{}) // private or reserved cidrs the webhooks can reach, eg: for tests
+
 	// env vars must prefix with "vp",
 	// eg: "VP_HELLO=12" in .env file, then viper.Get("hello")
 	viper.SetEnvPrefix("vp")
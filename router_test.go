@@ -11,6 +11,7 @@ import (
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -20,6 +21,7 @@ func testSetup() {
 	setupOnlyOnce.Do(func() {
 		router := gin.Default()
 		Config()
+		viper.Set("rateLimitEnabled", false) // tests may login and post much faster than users
 		Setup(router)
 	})
 }
@@ -0,0 +1,452 @@
+package dream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dlclark/regexp2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/text/width"
+)
+
+// rule kinds
+const (
+	ruleKeyword = "keyword"
+	ruleRegex   = "regex"
+)
+
+// rule actions, ordered by severity
+const (
+	actionNone   = ""
+	actionReview = "review" // hold the dream until a moderator approves it
+	actionNsfw   = "nsfw"   // generate the dream, but flag it as nsfw
+	actionReject = "reject" // refuse the dream
+)
+
+var actionSeverity = map[string]int{actionNone: 0, actionReview: 1, actionNsfw: 2, actionReject: 3}
+
+// version of the rules, increased when any rule changes,
+// so every server instance knows when to reload them
+const rulesVersionKey = "rules:version"
+
+var errRuleNotFound = errors.New("rule.notFound")
+var errPromptBlocked = errors.New("dream.prompt.blocked")
+
+// prompt rule, evaluated before the dream is queued
+type promptRule struct {
+	ID      string    `json:"_id" bson:"_id"`
+	Kind    string    `json:"kind" bson:"kind"`       // "keyword" or "regex"
+	Pattern string    `json:"pattern" bson:"pattern"` // keyword or regexp2 pattern
+	Action  string    `json:"action" bson:"action"`   // "reject", "review" or "nsfw"
+	Note    string    `json:"note" bson:"note"`
+	Enabled bool      `json:"enabled" bson:"enabled"`
+	Updated time.Time `json:"updated" bson:"updated"`
+}
+
+// compiled rules cached in memory
+type ruleSet struct {
+	sync.RWMutex
+	version  int64
+	keywords []*promptRule
+	regexps  []*compiledRule
+}
+
+type compiledRule struct {
+	rule *promptRule
+	re   *regexp2.Regexp
+}
+
+var rules = &ruleSet{version: -1}
+
+// result of the prompt filter
+type ruleMatch struct {
+	Action string   `json:"action"`
+	Rules  []string `json:"rules"` // ids of the matched rules
+}
+
+func rulesHandlers() {
+	r.GET("/api/admin/rules", jwtAuth, adminAuth, listRulesHandler)
+	r.POST("/api/admin/rules", jwtAuth, adminAuth, saveRuleHandler)
+	r.DELETE("/api/admin/rules/:id", jwtAuth, adminAuth, removeRuleHandler)
+	r.POST("/api/admin/rules/test", jwtAuth, adminAuth, testRulesHandler)
+
+	r.GET("/api/admin/reviews", jwtAuth, moderatorAuth, reviewsHandler)
+	r.POST("/api/admin/reviews/:id", jwtAuth, moderatorAuth, reviewDreamHandler)
+}
+
+func listRulesHandler(c *gin.Context) {
+	cur, err := promptRules.Find(context.TODO(), bson.M{}, options.Find().SetSort(bson.M{"updated": -1}))
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	rs := make([]*promptRule, 0)
+	if err = cur.All(context.TODO(), &rs); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":    true,
+		"rules": rs,
+	})
+}
+
+// create or update the rule, a new id will be generated if it's omitted
+func saveRuleHandler(c *gin.Context) {
+	var rule promptRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		badRequest(c, errors.New("rule.invalid.params"))
+		return
+	}
+
+	if err := validateRule(&rule); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	if len(rule.ID) == 0 {
+		rule.ID = uuid.New().String()
+	}
+
+	if err := saveRule(&rule); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	l.Infoln("SAVE_RULE", rule.ID, "by", c.GetString("username"))
+	c.JSON(http.StatusOK, gin.H{
+		"ok": true,
+		"id": rule.ID,
+	})
+}
+
+func removeRuleHandler(c *gin.Context) {
+	err := removeRule(c.Param("id"))
+	if err == errRuleNotFound {
+		badRequest(c, err)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	l.Infoln("REMOVE_RULE", c.Param("id"), "by", c.GetString("username"))
+	ok(c)
+}
+
+// check the prompt against the rules, nothing will be saved
+func testRulesHandler(c *gin.Context) {
+	m, err := matchPrompt(c.Request.Context(), c.PostForm("prompt"))
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":    true,
+		"match": m,
+	})
+}
+
+func validateRule(rule *promptRule) error {
+	rule.Pattern = strings.TrimSpace(rule.Pattern)
+	if len(rule.Pattern) == 0 || utf8.RuneCountInString(rule.Pattern) > viper.GetInt("rulePatternMaxLen") {
+		return errors.New("rule.invalid.pattern")
+	}
+
+	switch rule.Kind {
+	case ruleKeyword:
+	case ruleRegex:
+		if _, err := compileRule(rule.Pattern); err != nil {
+			return errors.New("rule.invalid.pattern")
+		}
+	default:
+		return errors.New("rule.invalid.kind")
+	}
+
+	if rule.Action != actionReject && rule.Action != actionReview && rule.Action != actionNsfw {
+		return errors.New("rule.invalid.action")
+	}
+	return nil
+}
+
+func saveRule(rule *promptRule) error {
+	rule.Updated = time.Now()
+	_, err := promptRules.ReplaceOne(context.TODO(), bson.M{"_id": rule.ID}, rule, options.Replace().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	return rdb.Incr(context.TODO(), rulesVersionKey).Err()
+}
+
+func removeRule(id string) error {
+	res, err := promptRules.DeleteOne(context.TODO(), bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return errRuleNotFound
+	}
+	return rdb.Incr(context.TODO(), rulesVersionKey).Err()
+}
+
+func compileRule(pattern string) (*regexp2.Regexp, error) {
+	re, err := regexp2.Compile(pattern, regexp2.IgnoreCase)
+	if err != nil {
+		return nil, err
+	}
+
+	// guard against catastrophic backtracking
+	re.MatchTimeout = viper.GetDuration("ruleMatchTimeout")
+	return re, nil
+}
+
+// loadRules reloads the rules from mongodb if any of them changed
+func loadRules(ctx context.Context) error {
+	version, err := rdb.Get(ctx, rulesVersionKey).Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	rules.RLock()
+	loaded := rules.version
+	rules.RUnlock()
+
+	if loaded == version {
+		return nil
+	}
+
+	cur, err := promptRules.Find(ctx, bson.M{"enabled": true})
+	if err != nil {
+		return err
+	}
+
+	var rs []*promptRule
+	if err = cur.All(ctx, &rs); err != nil {
+		return err
+	}
+
+	var keywords []*promptRule
+	var regexps []*compiledRule
+	for _, rule := range rs {
+		switch rule.Kind {
+		case ruleKeyword:
+			rule.Pattern = normalizePrompt(rule.Pattern)
+			keywords = append(keywords, rule)
+		case ruleRegex:
+			re, err := compileRule(rule.Pattern)
+			if err != nil {
+				l.Errorln("invalid rule", rule.ID, err)
+				continue
+			}
+			regexps = append(regexps, &compiledRule{rule: rule, re: re})
+		}
+	}
+
+	rules.Lock()
+	rules.version = version
+	rules.keywords = keywords
+	rules.regexps = regexps
+	rules.Unlock()
+
+	l.Debugln("prompt rules loaded:", len(rs), "version:", version)
+	return nil
+}
+
+// matchPrompt evaluates all the rules, returns the most severe action
+func matchPrompt(ctx context.Context, prompt string) (*ruleMatch, error) {
+	if err := loadRules(ctx); err != nil {
+		return nil, err
+	}
+
+	rules.RLock()
+	defer rules.RUnlock()
+
+	m := &ruleMatch{Action: actionNone, Rules: make([]string, 0)}
+	hit := func(rule *promptRule) {
+		m.Rules = append(m.Rules, rule.ID)
+		if actionSeverity[rule.Action] > actionSeverity[m.Action] {
+			m.Action = rule.Action
+		}
+	}
+
+	normalized := normalizePrompt(prompt)
+	for _, rule := range rules.keywords {
+		if containsKeyword(normalized, rule.Pattern) {
+			hit(rule)
+		}
+	}
+
+	for _, cr := range rules.regexps {
+		matched, err := cr.re.MatchString(normalized)
+		if err != nil {
+			// timed out, treat it as a match to be safe
+			l.Errorln("rule match failed", cr.rule.ID, err)
+			matched = true
+		}
+		if matched {
+			hit(cr.rule)
+		}
+	}
+
+	return m, nil
+}
+
+// normalizePrompt folds the full-width characters, eg: "ＮＳＦＷ" to "nsfw",
+// lowers the cases, and collapses the spaces
+func normalizePrompt(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(width.Fold.String(s))), " ")
+}
+
+// containsKeyword matches the keyword as a whole word if it's made of letters like latin,
+// or as a substring if it contains CJK characters, which have no spaces between words
+func containsKeyword(s string, keyword string) bool {
+	if len(keyword) == 0 {
+		return false
+	}
+
+	if hasCJK(keyword) {
+		return strings.Contains(s, keyword)
+	}
+
+	for start := 0; start < len(s); {
+		i := strings.Index(s[start:], keyword)
+		if i < 0 {
+			return false
+		}
+		i += start
+		end := i + len(keyword)
+
+		before, _ := utf8.DecodeLastRuneInString(s[:i])
+		after, _ := utf8.DecodeRuneInString(s[end:])
+		if !isWordRune(before) && !isWordRune(after) {
+			return true
+		}
+
+		_, size := utf8.DecodeRuneInString(s[i:])
+		start = i + size
+	}
+	return false
+}
+
+func isWordRune(r rune) bool {
+	return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r)) && !isCJK(r)
+}
+
+func hasCJK(s string) bool {
+	for _, r := range s {
+		if isCJK(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// list the dreams held for review, the oldest first
+func reviewsHandler(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "0"))
+	if err != nil || page < 0 {
+		badRequest(c, errors.New("invalid.input"))
+		return
+	}
+
+	perPage := int64(viper.GetInt("reviewsPerPage"))
+	opts := options.Find().
+		SetSort(bson.M{"created": 1}).
+		SetSkip(perPage * int64(page)).
+		SetLimit(perPage)
+
+	cur, err := dreams.Find(context.TODO(), bson.M{"status": dsReview}, opts)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	ds := make([]*dream, 0)
+	if err = cur.All(context.TODO(), &ds); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":     true,
+		"dreams": ds,
+	})
+}
+
+// moderator approves the dream to be queued, or rejects it
+func reviewDreamHandler(c *gin.Context) {
+	decision := c.PostForm("decision")
+	if decision != "approve" && decision != "reject" {
+		badRequest(c, errors.New("dream.review.invalidDecision"))
+		return
+	}
+
+	err := reviewDream(c.Param("id"), decision == "approve")
+	if err == mongo.ErrNoDocuments {
+		badRequest(c, errors.New("dream.review.notFound"))
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	l.Infoln("REVIEW_DREAM", c.Param("id"), "by", c.GetString("username"), "decision:", decision)
+	ok(c)
+}
+
+func reviewDream(id string, approve bool) error {
+	set := bson.M{"status": dsFailed, "failReason": "review.rejected", "finished": time.Now()}
+	if approve {
+		set = bson.M{"status": dsPending}
+	}
+
+	var d dream
+	err := dreams.FindOneAndUpdate(context.TODO(), bson.M{"_id": id, "status": dsReview}, bson.M{"$set": set}).Decode(&d)
+	if err != nil {
+		return err
+	}
+
+	if approve {
+		if err = enqueueDream(d.ID, d.Model); err != nil {
+			return err
+		}
+	} else if err = refundDream(&d); err != nil {
+		return err
+	}
+
+	if err = expires("d:" + id); err != nil {
+		return err
+	}
+
+	d.Status = set["status"].(dreamStatus)
+	if err = publishStatus(id, d.Status); err != nil {
+		return err
+	}
+
+	// rejected, it's failed without being queued
+	if !approve {
+		return onDreamFinished(&d)
+	}
+	return nil
+}
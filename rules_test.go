@@ -0,0 +1,159 @@
+package dream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestNormalizePrompt(t *testing.T) {
+	assert.Equal(t, "nsfw cat", normalizePrompt("  ＮＳＦＷ \t Cat "))
+	assert.Equal(t, "猫 dog", normalizePrompt("猫　DOG")) // ideographic space
+}
+
+func TestContainsKeyword(t *testing.T) {
+	assert.True(t, containsKeyword("a nude cat", "nude"))
+	assert.True(t, containsKeyword("nude", "nude"))
+	assert.True(t, containsKeyword("nude, cat", "nude"))
+	assert.False(t, containsKeyword("denuded trees", "nude"))
+	assert.True(t, containsKeyword("denuded trees, nude", "nude"))
+	assert.True(t, containsKeyword("猫nude猫", "nude"))
+	assert.True(t, containsKeyword("a nude cat", "nude cat"))
+
+	// CJK keywords match as substrings
+	assert.True(t, containsKeyword("一只裸体的猫", "裸体"))
+	assert.True(t, containsKeyword("ヌードの猫", "ヌード"))
+	assert.False(t, containsKeyword("一只猫", "裸体"))
+	assert.False(t, containsKeyword("anything", ""))
+}
+
+func TestValidateRule(t *testing.T) {
+	testSetup()
+
+	assert.Nil(t, validateRule(&promptRule{Kind: ruleKeyword, Pattern: "nude", Action: actionReject}))
+	assert.Nil(t, validateRule(&promptRule{Kind: ruleRegex, Pattern: `(?<!\w)gore\b`, Action: actionNsfw}))
+	assert.NotNil(t, validateRule(&promptRule{Kind: ruleRegex, Pattern: "(", Action: actionReject}))
+	assert.NotNil(t, validateRule(&promptRule{Kind: "glob", Pattern: "nude", Action: actionReject}))
+	assert.NotNil(t, validateRule(&promptRule{Kind: ruleKeyword, Pattern: " ", Action: actionReject}))
+	assert.NotNil(t, validateRule(&promptRule{Kind: ruleKeyword, Pattern: "nude", Action: "ban"}))
+}
+
+func TestPromptRules(t *testing.T) {
+	testSetup()
+	testWorkerSetup()
+
+	ctx := context.TODO()
+	rdb.Del(ctx, queueOf(testModel))
+
+	defer func() {
+		promptRules.DeleteMany(ctx, bson.M{"note": "tester"})
+		rdb.Incr(ctx, rulesVersionKey)
+
+		if err := delUsrByName("tester031"); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	w := testLogin(t, "tester031")
+	token, _ := testJwtToken(t, w)
+	viper.Set("admins", []string{"tester031"})
+	viper.Set("moderators", []string{})
+
+	saveReq := func(rule *promptRule) *httptest.ResponseRecorder {
+		p, _ := json.Marshal(rule)
+		req, _ := http.NewRequest("POST", "/api/admin/rules", bytes.NewReader(p))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	body := assertOK(t, saveReq(&promptRule{Kind: ruleKeyword, Pattern: "禁止词", Action: actionReject, Enabled: true, Note: "tester"}))
+	rejectId := body["id"].(string)
+	assertOK(t, saveReq(&promptRule{Kind: ruleRegex, Pattern: `\bneeds?\s+review\b`, Action: actionReview, Enabled: true, Note: "tester"}))
+	assertOK(t, saveReq(&promptRule{Kind: ruleKeyword, Pattern: "spicy", Action: actionNsfw, Enabled: true, Note: "tester"}))
+	assertOK(t, saveReq(&promptRule{Kind: ruleKeyword, Pattern: "disabled", Action: actionReject, Enabled: false, Note: "tester"}))
+	assertNotOK(t, saveReq(&promptRule{Kind: ruleRegex, Pattern: "(", Action: actionReject, Note: "tester"}))
+
+	// the most severe action wins
+	m, err := matchPrompt(ctx, "a spicy cat, 禁止词")
+	assert.Nil(t, err)
+	assert.Equal(t, actionReject, m.Action)
+	assert.Equal(t, 2, len(m.Rules))
+
+	m, err = matchPrompt(ctx, "a disabled cat")
+	assert.Nil(t, err)
+	assert.Equal(t, actionNone, m.Action)
+
+	postDream := func(prompt string) *httptest.ResponseRecorder {
+		d := newTestDream()
+		d.Prompt = prompt
+		req, err := postJsonReq("/api/dream/new", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// rejected
+	w = postDream("一个禁止词的梦")
+	assertNotOK(t, w)
+
+	// held for review, then approved
+	body = assertOK(t, postDream("this one NEEDS   review"))
+	reviewId := body["id"].(string)
+	defer dreams.DeleteOne(ctx, bson.M{"_id": reviewId})
+
+	d, err := getDreamById(reviewId)
+	assert.Nil(t, err)
+	assert.Equal(t, dsReview, d.Status)
+	_, err = queuePosition(ctx, d)
+	assert.NotNil(t, err)
+
+	req, _ := postFormReq("/api/admin/reviews/"+reviewId, map[string]string{"decision": "approve"})
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertOK(t, w)
+
+	d, err = getDreamById(reviewId)
+	assert.Nil(t, err)
+	assert.Equal(t, dsPending, d.Status)
+	_, err = queuePosition(ctx, d)
+	assert.Nil(t, err)
+
+	// flagged as nsfw before generating
+	body = assertOK(t, postDream("a spicy cat"))
+	nsfwId := body["id"].(string)
+	defer dreams.DeleteOne(ctx, bson.M{"_id": nsfwId})
+
+	d, err = getDreamById(nsfwId)
+	assert.Nil(t, err)
+	assert.Equal(t, dsPending, d.Status)
+	assert.True(t, d.Moderation.Flagged)
+	assert.Equal(t, "rules", d.Moderation.By)
+
+	// removed rule won't match any more
+	req, _ = http.NewRequest("DELETE", "/api/admin/rules/"+rejectId, nil)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertOK(t, w)
+
+	m, err = matchPrompt(ctx, "禁止词")
+	assert.Nil(t, err)
+	assert.Equal(t, actionNone, m.Action)
+
+	rdb.Del(ctx, queueOf(testModel))
+}
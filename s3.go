@@ -0,0 +1,173 @@
+package dream
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// s3Store saves the images in a bucket of the S3 compatible storage,
+// requests are signed with AWS signature version 4, using path-style urls
+type s3Store struct {
+	client    *http.Client
+	endpoint  string // eg: "http://localhost:9000"
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+}
+
+func (s *s3Store) objectURL(key string) string {
+	return s.endpoint + "/" + s.bucket + "/" + url.PathEscape(key)
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	res, err := s.do(req, data)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return s3Error(res)
+	}
+	return nil
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) (*storedImage, error) {
+	return s.GetRange(ctx, key, "", "")
+}
+
+func (s *s3Store) GetRange(ctx context.Context, key string, rng string, ifRange string) (*storedImage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rng) > 0 {
+		req.Header.Set("Range", rng)
+		if len(ifRange) > 0 {
+			req.Header.Set("If-Range", ifRange)
+		}
+	}
+
+	res, err := s.do(req, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		defer res.Body.Close()
+		switch res.StatusCode {
+		case http.StatusNotFound:
+			return nil, errImageNotFound
+		case http.StatusRequestedRangeNotSatisfiable:
+			return nil, errImageRange
+		}
+		return nil, s3Error(res)
+	}
+
+	// the body is streamed, so the image is never loaded into memory
+	modified, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	contentType := res.Header.Get("Content-Type")
+	if len(contentType) == 0 {
+		contentType = imageContentType(key, nil)
+	}
+
+	img := &storedImage{
+		Body:        res.Body,
+		Size:        res.ContentLength,
+		ContentType: contentType,
+		Modified:    modified,
+		closer:      res.Body,
+	}
+	if res.StatusCode == http.StatusPartialContent {
+		img.Range = res.Header.Get("Content-Range")
+	}
+	return img, nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.do(req, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// deleting a missing object is not an error in S3
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return s3Error(res)
+	}
+	return nil
+}
+
+func (s *s3Store) do(req *http.Request, payload []byte) (*http.Response, error) {
+	s.sign(req, payload, time.Now())
+	return s.client.Do(req)
+}
+
+// sign the request with AWS signature version 4
+func (s *s3Store) sign(req *http.Request, payload []byte, now time.Time) {
+	sum := sha256.Sum256(payload)
+	payloadHash := hex.EncodeToString(sum[:])
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := req.Method + "\n" +
+		req.URL.EscapedPath() + "\n" +
+		req.URL.RawQuery + "\n" +
+		canonicalHeaders + "\n" +
+		signedHeaders + "\n" +
+		payloadHash
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3Error(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("s3 %s %s: %d %s", res.Request.Method, res.Request.URL.Path, res.StatusCode, body)
+}
@@ -0,0 +1,319 @@
+package dream
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sorting of the search results
+const (
+	sortRelevance = "relevance"
+	sortRecent    = "recent"
+)
+
+var (
+	errInvalidQuery        = errors.New("search.invalid.query")
+	errInvalidDate         = errors.New("search.invalid.date")
+	errInvalidSearchSort   = errors.New("search.invalid.sort")
+	errInvalidSearchStatus = errors.New("search.invalid.status")
+)
+
+func searchHandlers() {
+	r.GET("/api/search", jwtAuth, searchHandler)
+}
+
+type searchQuery struct {
+	Terms  []string
+	Viewer string // viewer's id
+	Author string // author's name
+	Model  string
+	From   time.Time
+	To     time.Time
+	Status []dreamStatus
+	Sort   string
+	Offset int64          // cursor of the relevance sorting
+	Cursor *galleryCursor // cursor of the recency sorting
+	Limit  int64
+}
+
+// searchTerms splits the prompt into the terms of the text index.
+// Latin words are kept as they are, while CJK text which has no spaces is split into bigrams,
+// and also unigrams for the documents, so a single character can be searched too.
+func searchTerms(s string, unigrams bool) []string {
+	seen := map[string]bool{}
+	terms := make([]string, 0)
+	add := func(t string) {
+		if !seen[t] {
+			seen[t] = true
+			terms = append(terms, t)
+		}
+	}
+
+	var word, run []rune
+	flushWord := func() {
+		if len(word) > 0 {
+			add(string(word))
+			word = word[:0]
+		}
+	}
+	flushRun := func() {
+		if len(run) == 1 || unigrams {
+			for _, r := range run {
+				add(string(r))
+			}
+		}
+		for i := 0; i+1 < len(run); i++ {
+			add(string(run[i : i+2]))
+		}
+		run = run[:0]
+	}
+
+	for _, r := range normalizePrompt(s) {
+		switch {
+		case isCJK(r):
+			flushWord()
+			run = append(run, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushRun()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushRun()
+		}
+	}
+	flushWord()
+	flushRun()
+
+	if len(terms) > viper.GetInt("searchTermsMax") {
+		terms = terms[:viper.GetInt("searchTermsMax")]
+	}
+	return terms
+}
+
+func encodeOffset(n int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(n, 10)))
+}
+
+func parseOffset(s string) (int64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return 0, errInvalidCursor
+	}
+
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || n < 0 {
+		return 0, errInvalidCursor
+	}
+	return n, nil
+}
+
+func parseDate(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errInvalidDate
+	}
+	return t, nil
+}
+
+// search the dreams by prompt, eg: /api/search?q=cat&author=tester&model=sd&from=2022-12-01T00:00:00Z&status=2&sort=recent
+func searchHandler(c *gin.Context) {
+	q := &searchQuery{
+		Terms:  searchTerms(c.Query("q"), false),
+		Viewer: c.GetString("uuid"),
+		Author: c.Query("author"),
+		Model:  c.Query("model"),
+		Sort:   c.DefaultQuery("sort", sortRelevance),
+		Limit:  viper.GetInt64("searchPerPage"),
+	}
+
+	if len(q.Terms) == 0 {
+		badRequest(c, errInvalidQuery)
+		return
+	}
+
+	if q.Sort != sortRelevance && q.Sort != sortRecent {
+		badRequest(c, errInvalidSearchSort)
+		return
+	}
+
+	var err error
+	if q.From, err = parseDate(c.Query("from")); err != nil {
+		badRequest(c, err)
+		return
+	}
+	if q.To, err = parseDate(c.Query("to")); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	for _, s := range c.QueryArray("status") {
+		st, err := strconv.Atoi(s)
+		if err != nil || st < int(dsPending) || st > int(dsReview) {
+			badRequest(c, errInvalidSearchStatus)
+			return
+		}
+		q.Status = append(q.Status, dreamStatus(st))
+	}
+
+	if cursor := c.Query("cursor"); len(cursor) > 0 {
+		if q.Sort == sortRelevance {
+			q.Offset, err = parseOffset(cursor)
+		} else {
+			q.Cursor, err = parseGalleryCursor(cursor)
+		}
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+	}
+
+	ds, next, err := searchDreams(c.Request.Context(), q)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if _, err = censorDreams(q.Viewer, ds); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":     true,
+		"dreams": ds,
+		"next":   next,
+	})
+}
+
+// searchDreams returns a page of the matched dreams, and the cursor of the next page if there is one
+func searchDreams(ctx context.Context, q *searchQuery) (ds []*dream, next string, err error) {
+	filter := bson.M{"$text": bson.M{"$search": strings.Join(q.Terms, " ")}}
+
+	if len(q.Author) > 0 {
+		filter["author"] = q.Author
+	}
+	if len(q.Model) > 0 {
+		filter["model"] = q.Model
+	}
+
+	created := bson.M{}
+	if !q.From.IsZero() {
+		created["$gte"] = q.From
+	}
+	if !q.To.IsZero() {
+		created["$lt"] = q.To
+	}
+	if len(created) > 0 {
+		filter["created"] = created
+	}
+
+	if len(q.Status) > 0 {
+		filter["status"] = bson.M{"$in": q.Status}
+	}
+
+	// the others' unlisted, private or unfinished dreams are never listed
+	nor := bson.A{
+		bson.M{"authorId": bson.M{"$ne": q.Viewer}, "visibility": bson.M{"$in": bson.A{visUnlisted, visPrivate}}},
+		bson.M{"authorId": bson.M{"$ne": q.Viewer}, "status": bson.M{"$nin": bson.A{dsDone, dsNsfw}}},
+	}
+
+	opts := options.Find().SetLimit(q.Limit + 1) // fetch one more to know if there is a next page
+	if q.Sort == sortRelevance {
+		opts.SetSort(bson.D{
+			{Key: "score", Value: bson.M{"$meta": "textScore"}},
+			{Key: "created", Value: -1},
+			{Key: "_id", Value: -1},
+		}).SetSkip(q.Offset)
+	} else {
+		opts.SetSort(bson.D{{Key: "created", Value: -1}, {Key: "_id", Value: -1}})
+
+		// $or can't be used with $text, unless all of its clauses are indexed
+		if q.Cursor != nil {
+			filter["created"] = mergeRange(created, "$lte", q.Cursor.Created)
+			nor = append(nor, bson.M{"created": q.Cursor.Created, "_id": bson.M{"$gte": q.Cursor.ID}})
+		}
+	}
+	filter["$nor"] = nor
+
+	cursor, err := dreams.Find(ctx, filter, opts)
+	if err != nil {
+		return
+	}
+
+	ds = make([]*dream, 0)
+	if err = cursor.All(ctx, &ds); err != nil {
+		return
+	}
+
+	if int64(len(ds)) > q.Limit {
+		ds = ds[:q.Limit]
+		if q.Sort == sortRelevance {
+			next = encodeOffset(q.Offset + q.Limit)
+		} else {
+			last := ds[len(ds)-1]
+			next = (&galleryCursor{Created: last.Created, ID: last.ID}).String()
+		}
+	}
+	return
+}
+
+// add the bound to the range, the tighter upper bound wins
+func mergeRange(r bson.M, op string, t time.Time) bson.M {
+	res := bson.M{}
+	for k, v := range r {
+		res[k] = v
+	}
+
+	if lt, ok := res["$lt"].(time.Time); ok && !t.Before(lt) {
+		return res
+	}
+	delete(res, "$lt")
+	res[op] = t
+	return res
+}
+
+// fill the search terms of the dreams saved before the search was introduced
+func indexSearchTerms(ctx context.Context) {
+	cursor, err := dreams.Find(ctx, bson.M{"terms": bson.M{"$exists": false}},
+		options.Find().SetProjection(bson.M{"prompt": 1}))
+	if err != nil {
+		l.Errorln("index search terms failed:", err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	n := 0
+	for cursor.Next(ctx) {
+		var d dream
+		if err := cursor.Decode(&d); err != nil {
+			l.Errorln("index search terms failed:", err)
+			return
+		}
+
+		if _, err := dreams.UpdateByID(ctx, d.ID, bson.M{"$set": bson.M{"terms": searchTerms(d.Prompt, true)}}); err != nil && err != mongo.ErrNoDocuments {
+			l.Errorln("index search terms failed:", d.ID, err)
+			return
+		}
+		n++
+	}
+
+	if n > 0 {
+		l.Infoln("INDEX_SEARCH_TERMS", n)
+	}
+}
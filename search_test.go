@@ -0,0 +1,129 @@
+package dream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSearchTerms(t *testing.T) {
+	viper.SetDefault("searchTermsMax", 64)
+
+	assert.Equal(t, []string{"a", "cute", "cat", "4k"}, searchTerms("A  cute, CAT! ４Ｋ", false))
+	assert.Equal(t, []string{"a", "cat"}, searchTerms("a cat a CAT", false))
+
+	// bigrams of the query, and unigrams of the document as well
+	assert.Equal(t, []string{"可爱", "爱的", "的猫"}, searchTerms("可爱的猫", false))
+	assert.Equal(t, []string{"可", "爱", "的", "猫", "可爱", "爱的", "的猫"}, searchTerms("可爱的猫", true))
+	assert.Equal(t, []string{"猫"}, searchTerms("猫", false))
+	assert.Equal(t, []string{"cat", "猫咪", "in", "東京"}, searchTerms("cat猫咪 in 東京", false))
+
+	assert.Empty(t, searchTerms(" ,.!? ", false))
+}
+
+func TestMergeRange(t *testing.T) {
+	now := time.Now()
+	cursor := now.Add(-time.Hour)
+
+	assert.Equal(t, bson.M{"$lte": cursor}, mergeRange(bson.M{}, "$lte", cursor))
+	assert.Equal(t, bson.M{"$gte": now.Add(-time.Hour * 2), "$lte": cursor},
+		mergeRange(bson.M{"$gte": now.Add(-time.Hour * 2), "$lt": now}, "$lte", cursor))
+	assert.Equal(t, bson.M{"$lt": now.Add(-time.Hour * 2)}, mergeRange(bson.M{"$lt": now.Add(-time.Hour * 2)}, "$lte", cursor))
+}
+
+func TestSearch(t *testing.T) {
+	testSetup()
+
+	viper.Set("searchPerPage", 2)
+	defer viper.Set("searchPerPage", 24)
+
+	defer func() {
+		for _, name := range []string{"tester040", "tester041"} {
+			if err := delUsrByName(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}()
+
+	w := testLogin(t, "tester040")
+	author, c := testJwtToken(t, w)
+	w = testLogin(t, "tester041")
+	other, _ := testJwtToken(t, w)
+
+	ctx := context.TODO()
+	now := time.Now().Truncate(time.Millisecond)
+	var docs []interface{}
+	add := func(prompt string, status dreamStatus, vis string, created time.Time) {
+		docs = append(docs, &dream{
+			ID: uuid.New().String(), AuthorID: c.ID, Author: "tester040", Model: testModel,
+			Prompt: prompt, Terms: searchTerms(prompt, true),
+			Status: status, Visibility: vis, Created: created,
+		})
+	}
+	add("a cute cat on the moon", dsDone, visPublic, now)
+	add("a cute cat", dsDone, visPublic, now.Add(-time.Hour))
+	add("cat", dsDone, visPublic, now.Add(-time.Hour*2))
+	add("secret cat", dsDone, visPrivate, now)
+	add("failed cat", dsFailed, visPublic, now)
+	add("可爱的猫咪", dsDone, visPublic, now)
+	add("a dog", dsDone, visPublic, now)
+
+	_, err := dreams.InsertMany(ctx, docs)
+	assert.Nil(t, err)
+	defer dreams.DeleteMany(ctx, bson.M{"authorId": c.ID})
+
+	search := func(params url.Values, token *http.Cookie) (prompts []string) {
+		params.Set("author", "tester040")
+		next := ""
+		for {
+			params.Set("cursor", next)
+			req, _ := http.NewRequest("GET", "/api/search?"+params.Encode(), nil)
+			req.AddCookie(token)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			body := assertOK(t, w)
+
+			for _, d := range body["dreams"].([]interface{}) {
+				prompts = append(prompts, d.(map[string]interface{})["prompt"].(string))
+			}
+
+			next = body["next"].(string)
+			if len(next) == 0 {
+				return
+			}
+		}
+	}
+
+	assert.Equal(t, 5, len(search(url.Values{"q": {"cat"}}, author)))
+	assert.Equal(t, 3, len(search(url.Values{"q": {"cat"}}, other)))
+	assert.Equal(t, []string{"a cute cat on the moon", "a cute cat", "cat"},
+		search(url.Values{"q": {"cat"}, "sort": {sortRecent}}, other))
+	assert.Equal(t, []string{"cat"},
+		search(url.Values{"q": {"cat"}, "to": {now.Add(-time.Minute * 90).Format(time.RFC3339)}}, other))
+	assert.Equal(t, []string{"failed cat"}, search(url.Values{"q": {"cat"}, "status": {"3"}}, author))
+
+	// relevance first
+	res := search(url.Values{"q": {"cute cat"}}, other)
+	assert.Equal(t, 3, len(res))
+	assert.Equal(t, "cat", res[2])
+
+	// CJK
+	assert.Equal(t, []string{"可爱的猫咪"}, search(url.Values{"q": {"猫咪"}}, other))
+	assert.Equal(t, []string{"可爱的猫咪"}, search(url.Values{"q": {"猫"}}, other))
+
+	for _, q := range []string{"q=", "q=cat&sort=random", "q=cat&from=yesterday", "q=cat&status=99", "q=cat&cursor=!!!"} {
+		req, _ := http.NewRequest("GET", "/api/search?"+q, nil)
+		req.AddCookie(author)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assertNotOK(t, w)
+	}
+}
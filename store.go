@@ -0,0 +1,260 @@
+package dream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+var (
+	errImageNotFound = errors.New("image.notFound")
+	errImageRange    = errors.New("image.invalid.range") // the range can't be satisfied
+)
+
+// imageStore saves and loads the generated images by their keys
+type imageStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) (*storedImage, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// rangeStore reads the part of the image itself, for the stores which can't be seeked, eg: S3
+type rangeStore interface {
+	// GetRange gets the whole image if the range is empty, or the "If-Range" date doesn't match
+	GetRange(ctx context.Context, key string, rng string, ifRange string) (*storedImage, error)
+}
+
+type storedImage struct {
+	Body        io.Reader // seekable if the store supports range requests
+	Size        int64     // -1 if unknown
+	Range       string    // "Content-Range" of the partial image, empty if it's the whole one
+	ContentType string
+	Modified    time.Time
+	closer      io.Closer
+}
+
+func (img *storedImage) Close() error {
+	if img.closer == nil {
+		return nil
+	}
+	return img.closer.Close()
+}
+
+var store imageStore // image store
+
+// create the image store by "imageStore" config
+func newImageStore() imageStore {
+	switch viper.GetString("imageStore") {
+	case "local":
+		return &localStore{dir: viper.GetString("imageDir")}
+	case "s3":
+		return &s3Store{
+			client:    http.DefaultClient,
+			endpoint:  strings.TrimSuffix(viper.GetString("s3Endpoint"), "/"),
+			bucket:    viper.GetString("s3Bucket"),
+			region:    viper.GetString("s3Region"),
+			accessKey: viper.GetString("s3AccessKey"),
+			secretKey: viper.GetString("s3SecretKey"),
+		}
+	default:
+		panic("unknown image store: " + viper.GetString("imageStore"))
+	}
+}
+
+func storeHandlers() {
+	r.GET("/api/images/:key", jwtAuth, imageHandler)
+}
+
+func imageNotFound(c *gin.Context) {
+	c.JSON(http.StatusNotFound, gin.H{
+		"ok":  false,
+		"msg": errImageNotFound.Error(),
+	})
+}
+
+// serve the image with caching headers and range support,
+// only the images of the dreams which the user can see are served
+func imageHandler(c *gin.Context) {
+	key := c.Param("key")
+	if !validImageKey(key) {
+		badRequest(c, errors.New("image.invalid.key"))
+		return
+	}
+
+	uid := c.GetString("uuid")
+	d, err := getVisibleDream(imageDreamId(key), uid)
+	if err == errDreamNotFound {
+		imageNotFound(c)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	usr, err := getUserById(uid)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	// the originals of the flagged dream are replaced by the blurred ones by user's preference
+	if !usr.ShowSensitive {
+		censorDream(d)
+	}
+	if !contains(dreamImageKeys(d), key) {
+		imageNotFound(c)
+		return
+	}
+
+	// keys are never reused, so the images can be cached forever, but only by the user's browser
+	etag := `"` + key + `"`
+	c.Header("Cache-Control", "private, max-age="+viper.GetString("imageMaxAge")+", immutable")
+	c.Header("ETag", etag)
+
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	serveImage(c, key, etag)
+}
+
+// serve the image from the store, the range requests are served by the store if it can't be seeked
+func serveImage(c *gin.Context, key string, etag string) {
+	ctx := c.Request.Context()
+
+	var img *storedImage
+	var err error
+	if rs, ok := store.(rangeStore); ok {
+		// the etag is not the store's, so it's checked here, the dates are checked by the store
+		rng, ifRange := c.GetHeader("Range"), c.GetHeader("If-Range")
+		if ifRange == etag {
+			ifRange = ""
+		} else if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, `W/`) {
+			rng, ifRange = "", ""
+		}
+		img, err = rs.GetRange(ctx, key, rng, ifRange)
+	} else {
+		img, err = store.Get(ctx, key)
+	}
+
+	if err == errImageNotFound {
+		imageNotFound(c)
+		return
+	} else if err == errImageRange {
+		c.Status(http.StatusRequestedRangeNotSatisfiable)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+	defer img.Close()
+
+	c.Header("Content-Type", img.ContentType)
+
+	if rs, ok := img.Body.(io.ReadSeeker); ok {
+		http.ServeContent(c.Writer, c.Request, key, img.Modified, rs)
+		return
+	}
+
+	// stream the image which can't be seeked
+	if !img.Modified.IsZero() {
+		c.Header("Last-Modified", img.Modified.UTC().Format(http.TimeFormat))
+	}
+
+	status := http.StatusOK
+	headers := map[string]string{}
+	if _, ok := store.(rangeStore); ok {
+		headers["Accept-Ranges"] = "bytes"
+	}
+	if len(img.Range) > 0 {
+		status = http.StatusPartialContent
+		headers["Content-Range"] = img.Range
+	}
+	c.DataFromReader(status, img.Size, img.ContentType, img.Body, headers)
+}
+
+// images are named after their dreams, eg: "<dream id>_<suffix>.png"
+func imageDreamId(key string) string {
+	if i := strings.Index(key, "_"); i > 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// keys are flat file names, no path allowed
+func validImageKey(key string) bool {
+	return len(key) > 0 && !strings.ContainsAny(key, `/\`) && key != "." && key != ".."
+}
+
+// content type by the key's extension, or sniff it from the data
+func imageContentType(key string, data []byte) string {
+	if t := mime.TypeByExtension(filepath.Ext(key)); len(t) > 0 {
+		return t
+	}
+	return http.DetectContentType(data)
+}
+
+// localStore saves the images in a directory of the local disk
+type localStore struct {
+	dir string
+}
+
+func (s *localStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	// write to a temp file first, so no partial image will be served
+	tmp := filepath.Join(s.dir, "."+key+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, key))
+}
+
+func (s *localStore) Get(ctx context.Context, key string) (*storedImage, error) {
+	f, err := os.Open(filepath.Join(s.dir, key))
+	if os.IsNotExist(err) {
+		return nil, errImageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// sniff the content type if the extension is unknown
+	contentType := mime.TypeByExtension(filepath.Ext(key))
+	if len(contentType) == 0 {
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(f, head)
+		contentType = http.DetectContentType(head[:n])
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return &storedImage{Body: f, Size: info.Size(), ContentType: contentType, Modified: info.ModTime(), closer: f}, nil
+}
+
+func (s *localStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(filepath.Join(s.dir, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,279 @@
+package dream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var testPNG = []byte("\x89PNG\r\n\x1a\n0123456789")
+
+var testModified = time.Unix(1700000000, 0).UTC()
+
+// a minimal S3 compatible server, objects are saved in memory
+type fakeS3 struct {
+	sync.Mutex
+	store   *s3Store
+	objects map[string][]byte
+	types   map[string]string
+}
+
+func newFakeS3() (*fakeS3, *httptest.Server) {
+	f := &fakeS3{objects: map[string][]byte{}, types: map[string]string{}}
+	srv := httptest.NewServer(f)
+
+	f.store = &s3Store{
+		client:    srv.Client(),
+		endpoint:  srv.URL,
+		bucket:    "dreams",
+		region:    "us-east-1",
+		accessKey: "tester",
+		secretKey: "tester-secret",
+	}
+	return f, srv
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	body, _ := io.ReadAll(req.Body)
+
+	// verify the signature
+	at, err := time.Parse("20060102T150405Z", req.Header.Get("X-Amz-Date"))
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	check, _ := http.NewRequest(req.Method, "http://"+req.Host+req.URL.RequestURI(), nil)
+	f.store.sign(check, body, at)
+	if check.Header.Get("Authorization") != req.Header.Get("Authorization") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !strings.HasPrefix(req.URL.Path, "/dreams/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	key := req.URL.Path
+	switch req.Method {
+	case http.MethodPut:
+		f.objects[key] = body
+		f.types[key] = req.Header.Get("Content-Type")
+	case http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", f.types[key])
+		http.ServeContent(w, req, key, testModified, bytes.NewReader(data))
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func testImageStore(t *testing.T, s imageStore) {
+	ctx := context.TODO()
+
+	_, err := s.Get(ctx, "missing.png")
+	assert.Equal(t, errImageNotFound, err)
+
+	assert.Nil(t, s.Put(ctx, "tester.png", testPNG, "image/png"))
+
+	img, err := s.Get(ctx, "tester.png")
+	assert.Nil(t, err)
+	assert.Equal(t, "image/png", img.ContentType)
+
+	data, err := io.ReadAll(img.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, testPNG, data)
+	assert.Nil(t, img.Close())
+
+	assert.Nil(t, s.Delete(ctx, "tester.png"))
+	_, err = s.Get(ctx, "tester.png")
+	assert.Equal(t, errImageNotFound, err)
+
+	// delete twice
+	assert.Nil(t, s.Delete(ctx, "tester.png"))
+}
+
+func TestLocalStore(t *testing.T) {
+	testImageStore(t, &localStore{dir: t.TempDir()})
+}
+
+func TestS3Store(t *testing.T) {
+	f, srv := newFakeS3()
+	defer srv.Close()
+
+	testImageStore(t, f.store)
+
+	// the body is streamed
+	assert.Nil(t, f.store.Put(context.TODO(), "tester.png", testPNG, "image/png"))
+	img, err := f.store.Get(context.TODO(), "tester.png")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(testPNG)), img.Size)
+	_, seekable := img.Body.(io.Seeker)
+	assert.False(t, seekable)
+	assert.Nil(t, img.Close())
+
+	// wrong secret
+	s := *f.store
+	s.secretKey = "wrong"
+	assert.NotNil(t, s.Put(context.TODO(), "tester.png", testPNG, "image/png"))
+}
+
+func TestServeImageRange(t *testing.T) {
+	f, srv := newFakeS3()
+	defer srv.Close()
+
+	saved := store
+	store = f.store
+	defer func() { store = saved }()
+
+	assert.Nil(t, f.store.Put(context.TODO(), "tester.png", testPNG, "image/png"))
+
+	serve := func(headers map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request, _ = http.NewRequest("GET", "/api/images/tester.png", nil)
+		for k, v := range headers {
+			c.Request.Header.Set(k, v)
+		}
+		serveImage(c, "tester.png", `"tester.png"`)
+		c.Writer.WriteHeaderNow()
+		return w
+	}
+
+	w := serve(nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+	assert.Equal(t, testPNG, w.Body.Bytes())
+
+	// partial content
+	w = serve(map[string]string{"Range": "bytes=8-11"})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, fmt.Sprintf("bytes 8-11/%d", len(testPNG)), w.Header().Get("Content-Range"))
+	assert.Equal(t, "0123", w.Body.String())
+
+	// the range is served only if the image is not changed
+	w = serve(map[string]string{"Range": "bytes=8-11", "If-Range": `"tester.png"`})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	w = serve(map[string]string{"Range": "bytes=8-11", "If-Range": `"changed"`})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, testPNG, w.Body.Bytes())
+	w = serve(map[string]string{"Range": "bytes=8-11", "If-Range": testModified.Format(http.TimeFormat)})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+
+	w = serve(map[string]string{"Range": "bytes=100-"})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+}
+
+func TestValidImageKey(t *testing.T) {
+	assert.True(t, validImageKey("abc_123.png"))
+	assert.False(t, validImageKey(""))
+	assert.False(t, validImageKey(".."))
+	assert.False(t, validImageKey("../config.yaml"))
+	assert.False(t, validImageKey(`..\config.yaml`))
+}
+
+func TestImageDreamId(t *testing.T) {
+	assert.Equal(t, "abc", imageDreamId("abc_123.png"))
+	assert.Equal(t, "abc", imageDreamId("abc_123_thumb.jpg"))
+	assert.Equal(t, "abc.png", imageDreamId("abc.png"))
+}
+
+func TestImageHandler(t *testing.T) {
+	testSetup()
+
+	defer func() {
+		for _, name := range []string{"tester049", "tester050"} {
+			if err := delUsrByName(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}()
+
+	w := testLogin(t, "tester049")
+	author, ac := testJwtToken(t, w)
+	w = testLogin(t, "tester050")
+	other, _ := testJwtToken(t, w)
+
+	ctx := context.TODO()
+	d := &dream{ID: uuid.New().String(), AuthorID: ac.ID, Status: dsDone, Visibility: visPublic, Created: time.Now()}
+	key := d.ID + "_1.png"
+	blurred := d.ID + "_1_blur.jpg"
+	d.Images = []string{key}
+	d.Blurred = []string{blurred}
+	if _, err := dreams.InsertOne(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	defer dreams.DeleteOne(ctx, bson.M{"_id": d.ID})
+
+	for _, k := range []string{key, blurred} {
+		assert.Nil(t, store.Put(ctx, k, testPNG, "image/png"))
+		defer store.Delete(ctx, k)
+	}
+
+	get := func(token *http.Cookie, k string, header ...string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/api/images/"+k, nil)
+		if token != nil {
+			req.AddCookie(token)
+		}
+		if len(header) == 2 {
+			req.Header.Set(header[0], header[1])
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w = get(other, key)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Cache-Control"), "private")
+	assert.Equal(t, testPNG, w.Body.Bytes())
+
+	// range request
+	w = get(other, key, "Range", "bytes=0-7")
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, testPNG[:8], w.Body.Bytes())
+
+	// cached by the browser
+	w = get(other, key, "If-None-Match", `"`+key+`"`)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	// login required
+	assert.NotEqual(t, http.StatusOK, get(nil, key).Code)
+
+	// not found
+	assert.Equal(t, http.StatusNotFound, get(other, "missing.png").Code)
+	assert.Equal(t, http.StatusNotFound, get(other, d.ID+"_2.png").Code)
+
+	// the originals of the flagged dream are hidden by the preference
+	assert.Nil(t, setDreamStatus(d.ID, dsNsfw))
+	assert.Equal(t, http.StatusNotFound, get(other, key).Code)
+	assert.Equal(t, http.StatusOK, get(other, blurred).Code)
+
+	// private dream
+	_, err := dreams.UpdateByID(ctx, d.ID, bson.M{"$set": bson.M{"status": dsDone, "visibility": visPrivate}})
+	assert.Nil(t, err)
+	assert.Nil(t, expires("d:"+d.ID))
+	assert.Equal(t, http.StatusNotFound, get(other, key).Code)
+	assert.Equal(t, http.StatusOK, get(author, key).Code)
+}
@@ -0,0 +1,136 @@
+package dream
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// dream events published by redis, so that every api instance can stream them
+type dreamEvent struct {
+	Type    string      `json:"type"` // "status" or "progress"
+	Status  dreamStatus `json:"status"`
+	Step    int         `json:"step,omitempty"`
+	Total   int         `json:"total,omitempty"`
+	Preview string      `json:"preview,omitempty"` // low resolution preview as data url
+}
+
+func streamHandlers() {
+	r.GET("/api/dream/stream/:id", jwtAuth, dreamStreamHandler)
+}
+
+func eventsChannel(id string) string {
+	return "d:" + id + ":events"
+}
+
+// no more events after these status
+func isFinished(status dreamStatus) bool {
+	return status == dsDone || status == dsFailed || status == dsNsfw || status == dsCancelled
+}
+
+func publishDreamEvent(id string, e *dreamEvent) error {
+	p, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return rdb.Publish(context.TODO(), eventsChannel(id), p).Err()
+}
+
+// notify the streaming clients of the status change
+func publishStatus(id string, status dreamStatus) error {
+	return publishDreamEvent(id, &dreamEvent{Type: "status", Status: status})
+}
+
+// encode the preview image as data url
+func previewDataURL(fh *multipart.FileHeader) (string, error) {
+	if fh.Size > viper.GetInt64("previewMaxSize") {
+		return "", errors.New("worker.preview.tooLarge")
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	p, err := io.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+
+	return "data:" + http.DetectContentType(p) + ";base64," + base64.StdEncoding.EncodeToString(p), nil
+}
+
+// stream the status changes and progress of the dream as server-sent events,
+// the stream ends when the dream is finished
+func dreamStreamHandler(c *gin.Context) {
+	dreamId := c.Param("id")
+	ctx := c.Request.Context()
+
+	// subscribe before loading the dream, so no event will be missed
+	sub := rdb.Subscribe(ctx, eventsChannel(dreamId))
+	defer sub.Close()
+
+	if _, err := sub.Receive(ctx); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	d, err := getVisibleDream(dreamId, c.GetString("uuid"))
+	if err == errDreamNotFound {
+		badRequest(c, err)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	// send current status first
+	current := &dreamEvent{Type: "status", Status: d.Status}
+	if d.Status == dsProcessing {
+		if current.Step, current.Total, err = getProgress(d.ID); err != nil {
+			internalError(c, err)
+			return
+		}
+	}
+	c.SSEvent(current.Type, current)
+
+	if isFinished(d.Status) {
+		return
+	}
+
+	ch := sub.Channel()
+	ticker := time.NewTicker(viper.GetDuration("streamKeepAlive"))
+	defer ticker.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+			c.SSEvent("ping", time.Now().Unix())
+			return true
+		case msg, ok := <-ch:
+			if !ok {
+				return false
+			}
+
+			var e dreamEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+				l.Errorln("invalid dream event", err)
+				return true
+			}
+
+			c.SSEvent(e.Type, msg.Payload)
+			return e.Type != "status" || !isFinished(e.Status)
+		}
+	})
+}
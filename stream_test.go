@@ -0,0 +1,143 @@
+package dream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDreamStream(t *testing.T) {
+	testWorkerSetup()
+
+	defer func() {
+		err := delUsrByName("tester022")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	rdb.Del(context.TODO(), queueOf(testModel))
+
+	// ping the client quickly, so the keep-alive is tested too
+	viper.Set("streamKeepAlive", time.Millisecond*50)
+	defer viper.Set("streamKeepAlive", time.Second*15)
+
+	w := testLogin(t, "tester022")
+	token, _ := testJwtToken(t, w)
+
+	id := testPostDream(t, token, newTestDream())
+
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/api/dream/stream/"+id, nil)
+	req.AddCookie(token)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	events := make(chan string, 16)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.HasPrefix(line, "event:") {
+				events <- strings.TrimPrefix(line, "event:")
+			}
+		}
+	}()
+
+	pings := 0
+	next := func() string {
+		for {
+			select {
+			case e := <-events:
+				if e == "ping" {
+					pings++
+					continue
+				}
+				return e
+			case <-time.After(time.Second * 3):
+				t.Fatal("stream event timeout")
+				return ""
+			}
+		}
+	}
+
+	// current status
+	assert.Equal(t, "status", next())
+
+	// claimed by worker
+	w = claimReq()
+	assertOK(t, w)
+	assert.Equal(t, "status", next())
+
+	// progress
+	w = workerReq("POST", "/api/worker/progress/"+id, bytes.NewBufferString("step=23&total=51"), "application/x-www-form-urlencoded")
+	assertOK(t, w)
+	assert.Equal(t, "progress", next())
+
+	// pinged while waiting
+	time.Sleep(time.Millisecond * 200)
+
+	// progress with preview
+	w = previewReq("/api/worker/progress/"+id, 24, make([]byte, 1024))
+	assertOK(t, w)
+	assert.Equal(t, "progress", next())
+	assert.Greater(t, pings, 0)
+
+	// too large preview, the progress is not recorded
+	w = previewReq("/api/worker/progress/"+id, 25, make([]byte, viper.GetInt("previewMaxSize")+1))
+	assertNotOK(t, w)
+	step, _, err := getProgress(id)
+	assert.Nil(t, err)
+	assert.Equal(t, 24, step)
+
+	// done
+	w = uploadReq("/api/worker/upload/"+id, "0.png")
+	assertOK(t, w)
+	w = workerReq("POST", "/api/worker/done/"+id, nil, "")
+	assertOK(t, w)
+
+	var rest []string
+	for e := range events {
+		if e != "ping" {
+			rest = append(rest, e)
+		}
+	}
+	assert.Equal(t, "status", rest[len(rest)-1])
+
+	// finished dream's stream ends immediately
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/dream/stream/"+id, nil)
+	req.AddCookie(token)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.True(t, strings.HasPrefix(w.Body.String(), "event:status"))
+}
+
+// report the progress with a preview image
+func previewReq(addr string, step int, preview []byte) *httptest.ResponseRecorder {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	mw.WriteField("step", strconv.Itoa(step))
+	mw.WriteField("total", "51")
+	fw, _ := mw.CreateFormFile("preview", "preview.png")
+	fw.Write(append([]byte("\x89PNG\r\n\x1a\n"), preview...))
+	mw.Close()
+
+	return workerReq("POST", addr, buf, mw.FormDataContentType())
+}
@@ -0,0 +1,383 @@
+package dream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v9"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sorted set of the tags scored by the number of the dreams tagged
+const tagsPopularKey = "tags:popular"
+
+var errInvalidTag = errors.New("tag.invalid.name")
+
+func tagsHandlers() {
+	r.GET("/api/tags/popular", jwtAuth, popularTagsHandler)
+	r.GET("/api/tags/follow/:tag", jwtAuth, followTagHandler)
+	r.GET("/api/tags/unfollow/:tag", jwtAuth, unfollowTagHandler)
+	r.GET("/api/tags/dreams/:tag", jwtAuth, tagDreamsHandler)
+}
+
+// recent public dreams of the tag, scored by the generated time in ms
+func tagOutboxKey(tag string) string {
+	return "tag:" + tag + ":outbox"
+}
+
+func isTagRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// extractTags finds the hashtags like "#cyberpunk" or "#赛博朋克" in the prompt,
+// tags are normalized like the prompt rules, so "#CyberPunk" and "#ｃｙｂｅｒｐｕｎｋ" are the same
+func extractTags(prompt string) []string {
+	seen := map[string]bool{}
+	tags := make([]string, 0)
+
+	rs := []rune(normalizePrompt(prompt))
+	for i := 0; i < len(rs); i++ {
+		if rs[i] != '#' {
+			continue
+		}
+
+		j := i + 1
+		for j < len(rs) && isTagRune(rs[j]) {
+			j++
+		}
+
+		tag := string(rs[i+1 : j])
+		if validTag(tag) && !seen[tag] && len(tags) < viper.GetInt("tagsMax") {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+		i = j - 1
+	}
+	return tags
+}
+
+func validTag(tag string) bool {
+	n := len([]rune(tag))
+	if n == 0 || n > viper.GetInt("tagMaxLen") {
+		return false
+	}
+
+	for _, r := range tag {
+		if !isTagRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalize the tag in the url, the leading "#" is optional
+func tagParam(c *gin.Context) (string, error) {
+	tag := normalizePrompt(c.Param("tag"))
+	if len(tag) > 0 && tag[0] == '#' {
+		tag = tag[1:]
+	}
+
+	if !validTag(tag) {
+		return "", errInvalidTag
+	}
+	return tag, nil
+}
+
+// push the public dream into its tags' outboxes, its tags are counted in the popular tags only once
+func addTagFeeds(ctx context.Context, d *dream, generated time.Time) error {
+	if len(d.Tags) == 0 || !isPublic(d) {
+		return nil
+	}
+
+	// flag it first, so the tags won't be counted twice
+	res, err := dreams.UpdateOne(ctx, bson.M{"_id": d.ID, "tagsCounted": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"tagsCounted": true}})
+	if err != nil {
+		return err
+	}
+	d.TagsCounted = true
+
+	limit := int64(viper.GetInt("outboxLimit"))
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, tag := range d.Tags {
+			key := tagOutboxKey(tag)
+			pipe.ZAdd(ctx, key, redis.Z{Score: float64(generated.UnixMilli()), Member: d.ID})
+			pipe.ZRemRangeByRank(ctx, key, 0, -limit-1)
+			if res.ModifiedCount > 0 {
+				pipe.ZIncrBy(ctx, tagsPopularKey, 1, tag)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// remove the dream from its tags' outboxes, and uncount its tags if they were counted
+func removeTagFeeds(ctx context.Context, d *dream) error {
+	if len(d.Tags) == 0 {
+		return nil
+	}
+
+	// unflag it first, so the tags won't be uncounted twice
+	res, err := dreams.UpdateOne(ctx, bson.M{"_id": d.ID, "tagsCounted": true},
+		bson.M{"$unset": bson.M{"tagsCounted": ""}})
+	if err != nil {
+		return err
+	}
+	d.TagsCounted = false
+
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipeRemoveTagFeeds(ctx, pipe, d, res.ModifiedCount > 0)
+		return nil
+	})
+	return err
+}
+
+func pipeRemoveTagFeeds(ctx context.Context, pipe redis.Pipeliner, d *dream, counted bool) {
+	for _, tag := range d.Tags {
+		pipe.ZRem(ctx, tagOutboxKey(tag), d.ID)
+	}
+	if counted {
+		for _, tag := range d.Tags {
+			pipe.ZIncrBy(ctx, tagsPopularKey, -1, tag)
+		}
+		pipe.ZRemRangeByScore(ctx, tagsPopularKey, "-inf", "0")
+	}
+}
+
+// whether the finished dream is pushed into the feeds
+func isFeedable(d *dream) bool {
+	return d.Status == dsDone || (d.Status == dsNsfw && len(d.Images) > 0)
+}
+
+// get the tag's outbox, the newest first
+func getTagOutbox(ctx context.Context, tag string) ([]feed, error) {
+	zs, err := rdb.ZRevRangeWithScores(ctx, tagOutboxKey(tag), 0, int64(viper.GetInt("outboxLimit"))-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	feeds := make([]feed, len(zs))
+	for i, z := range zs {
+		feeds[i] = feed{Dream: z.Member.(string), Generated: time.UnixMilli(int64(z.Score))}
+	}
+	return feeds, nil
+}
+
+func popularTagsHandler(c *gin.Context) {
+	zs, err := rdb.ZRevRangeWithScores(c.Request.Context(), tagsPopularKey, 0, int64(viper.GetInt("popularTagsLimit"))-1).Result()
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	tags := make([]gin.H, len(zs))
+	for i, z := range zs {
+		tags[i] = gin.H{"tag": z.Member, "dreams": int64(z.Score)}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":   true,
+		"tags": tags,
+	})
+}
+
+func followTagHandler(c *gin.Context) {
+	tag, err := tagParam(c)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	usr, err := getUserById(c.GetString("uuid"))
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if len(usr.FollowingTags) >= viper.GetInt("followingTagsMax") {
+		badRequest(c, errors.New("tag.follow.tooMany"))
+		return
+	}
+
+	if err = setFollowingTag(usr.ID, tag, true); err != nil {
+		internalError(c, err)
+		return
+	}
+	ok(c)
+}
+
+func unfollowTagHandler(c *gin.Context) {
+	tag, err := tagParam(c)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	if err = setFollowingTag(c.GetString("uuid"), tag, false); err != nil {
+		internalError(c, err)
+		return
+	}
+	ok(c)
+}
+
+func setFollowingTag(uid string, tag string, follow bool) error {
+	op := "$addToSet"
+	if !follow {
+		op = "$pull"
+	}
+
+	if _, err := users.UpdateByID(context.TODO(), uid, bson.M{op: bson.M{"followingTags": tag}}); err != nil {
+		return err
+	}
+
+	// the new feeds will be changed
+	for _, key := range []string{"u:" + uid, "u:" + uid + ":feed:new"} {
+		if err := expires(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// list the public dreams of the tag, eg: /api/tags/dreams/cyberpunk?cursor=xxx
+func tagDreamsHandler(c *gin.Context) {
+	tag, err := tagParam(c)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	var gc *galleryCursor
+	if cursor := c.Query("cursor"); len(cursor) > 0 {
+		if gc, err = parseGalleryCursor(cursor); err != nil {
+			badRequest(c, err)
+			return
+		}
+	}
+
+	ds, next, err := getTagDreams(c.Request.Context(), tag, gc)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	viewer, err := censorDreams(c.GetString("uuid"), ds)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":        true,
+		"tag":       tag,
+		"following": contains(viewer.FollowingTags, tag),
+		"dreams":    ds,
+		"next":      next,
+	})
+}
+
+// getTagDreams returns a page of the finished public dreams of the tag, the newest first
+func getTagDreams(ctx context.Context, tag string, gc *galleryCursor) (ds []*dream, next string, err error) {
+	filter := bson.M{
+		"tags":       tag,
+		"status":     bson.M{"$in": bson.A{dsDone, dsNsfw}},
+		"visibility": bson.M{"$nin": bson.A{visUnlisted, visPrivate}},
+	}
+
+	if gc != nil {
+		filter["$or"] = bson.A{
+			bson.M{"created": bson.M{"$lt": gc.Created}},
+			bson.M{"created": gc.Created, "_id": bson.M{"$lt": gc.ID}},
+		}
+	}
+
+	limit := viper.GetInt64("tagDreamsPerPage")
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(limit + 1) // fetch one more to know if there is a next page
+
+	cursor, err := dreams.Find(ctx, filter, opts)
+	if err != nil {
+		return
+	}
+
+	ds = make([]*dream, 0)
+	if err = cursor.All(ctx, &ds); err != nil {
+		return
+	}
+
+	if int64(len(ds)) > limit {
+		ds = ds[:limit]
+		last := ds[len(ds)-1]
+		next = (&galleryCursor{Created: last.Created, ID: last.ID}).String()
+	}
+	return
+}
+
+// fill the tags of the dreams saved before the tags were introduced,
+// and count the finished public ones in the popular tags
+func indexTags(ctx context.Context) {
+	cursor, err := dreams.Find(ctx, bson.M{"tags": nil},
+		options.Find().SetProjection(bson.M{"prompt": 1, "status": 1, "visibility": 1, "image": 1}))
+	if err != nil {
+		l.Errorln("index tags failed:", err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	n := 0
+	for cursor.Next(ctx) {
+		var d dream
+		if err := cursor.Decode(&d); err != nil {
+			l.Errorln("index tags failed:", err)
+			return
+		}
+
+		d.Tags = extractTags(d.Prompt)
+		counted := isFeedable(&d) && isPublic(&d) && len(d.Tags) > 0
+		set := bson.M{"tags": d.Tags}
+		if counted {
+			set["tagsCounted"] = true
+		}
+
+		res, err := dreams.UpdateOne(ctx, bson.M{"_id": d.ID, "tags": nil}, bson.M{"$set": set})
+		if err != nil {
+			l.Errorln("index tags failed:", d.ID, err)
+			return
+		}
+
+		// tagged by others already
+		if res.ModifiedCount == 0 {
+			continue
+		}
+
+		if err = expires("d:" + d.ID); err != nil {
+			l.Errorln("index tags failed:", d.ID, err)
+			return
+		}
+
+		if counted {
+			if _, err = rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for _, tag := range d.Tags {
+					pipe.ZIncrBy(ctx, tagsPopularKey, 1, tag)
+				}
+				return nil
+			}); err != nil {
+				l.Errorln("index tags failed:", d.ID, err)
+				return
+			}
+		}
+		n++
+	}
+
+	if n > 0 {
+		l.Infoln("INDEX_TAGS", n)
+	}
+}
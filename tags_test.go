@@ -0,0 +1,179 @@
+package dream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestExtractTags(t *testing.T) {
+	viper.SetDefault("tagsMax", 10)
+	viper.SetDefault("tagMaxLen", 32)
+
+	assert.Equal(t, []string{"cyberpunk", "neon_city", "赛博朋克"},
+		extractTags("a #CyberPunk street, #neon_city at night #cyberpunk #赛博朋克。"))
+	assert.Equal(t, []string{"4k"}, extractTags("#４Ｋ # ## #!"))
+	assert.Empty(t, extractTags("no tags here"))
+
+	viper.Set("tagsMax", 2)
+	defer viper.Set("tagsMax", 10)
+	assert.Equal(t, []string{"a", "b"}, extractTags("#a #b #c"))
+
+	assert.False(t, validTag(""))
+	assert.False(t, validTag("no-dash"))
+	assert.False(t, validTag("abcdefghijklmnopqrstuvwxyz0123456789"))
+}
+
+func TestUniqueFeeds(t *testing.T) {
+	now := time.Now()
+	list := []feed{{Dream: "a", Generated: now}, {Dream: "b"}, {Dream: "a"}}
+	assert.Equal(t, []feed{{Dream: "a", Generated: now}, {Dream: "b"}}, uniqueFeeds(list))
+}
+
+func TestTags(t *testing.T) {
+	testSetup()
+
+	defer func() {
+		for _, name := range []string{"tester042", "tester043"} {
+			if err := delUsrByName(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}()
+
+	w := testLogin(t, "tester042")
+	follower, fc := testJwtToken(t, w)
+	w = testLogin(t, "tester043")
+	author, ac := testJwtToken(t, w)
+
+	ctx := context.TODO()
+	tag := "tester_" + uuid.New().String()[:8]
+	defer rdb.Del(ctx, tagOutboxKey(tag))
+	defer rdb.ZRem(ctx, tagsPopularKey, tag)
+
+	newDream := func(vis string) *dream {
+		now := time.Now()
+		d := &dream{
+			ID: uuid.New().String(), AuthorID: ac.ID, Author: "tester043",
+			Prompt: "a cat #" + tag, Tags: extractTags("a cat #" + tag),
+			Status: dsDone, Visibility: vis, Created: now, Finished: now,
+			Likes: make([]string, 0), Images: make([]string, 0),
+		}
+		if _, err := dreams.InsertOne(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+		if err := addFeed(d); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	public := newDream(visPublic)
+	unlisted := newDream(visUnlisted)
+	defer dreams.DeleteMany(ctx, bson.M{"authorId": ac.ID})
+
+	get := func(addr string) map[string]interface{} {
+		req, _ := http.NewRequest("GET", addr, nil)
+		req.AddCookie(follower)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return assertOK(t, w)
+	}
+
+	// only the public dreams go to the tag's outbox
+	tf, err := getTagOutbox(ctx, tag)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(tf))
+	assert.Equal(t, public.ID, tf[0].Dream)
+
+	// tag page
+	body := get("/api/tags/dreams/%23" + tag)
+	assert.Equal(t, false, body["following"])
+	ds := body["dreams"].([]interface{})
+	assert.Equal(t, 1, len(ds))
+	assert.Equal(t, public.ID, ds[0].(map[string]interface{})["_id"])
+
+	// popularity
+	score, err := rdb.ZScore(ctx, tagsPopularKey, tag).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, float64(1), score)
+
+	// the tagged dreams show up in the feeds after following the tag
+	assert.Nil(t, getFeedsIds(t, fc.ID))
+	get("/api/tags/follow/" + tag)
+	assert.Equal(t, true, get("/api/tags/dreams/" + tag)["following"])
+	assert.Equal(t, []string{public.ID}, getFeedsIds(t, fc.ID))
+
+	get("/api/tags/unfollow/" + tag)
+	usr, err := getUserById(fc.ID)
+	assert.Nil(t, err)
+	assert.Empty(t, usr.FollowingTags)
+
+	// listed and counted once after it's made public, and removed after it's hidden again
+	setVisibility := func(vis string) {
+		req, _ := postFormReq("/api/dream/visibility/"+unlisted.ID, map[string]string{"visibility": vis})
+		req.AddCookie(author)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assertOK(t, w)
+	}
+	for _, vis := range []string{visPublic, visPublic} {
+		setVisibility(vis)
+		tf, err = getTagOutbox(ctx, tag)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(tf))
+		score, err = rdb.ZScore(ctx, tagsPopularKey, tag).Result()
+		assert.Nil(t, err)
+		assert.Equal(t, float64(2), score)
+	}
+
+	setVisibility(visPrivate)
+	tf, err = getTagOutbox(ctx, tag)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(tf))
+	score, err = rdb.ZScore(ctx, tagsPopularKey, tag).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, float64(1), score)
+
+	// the old dreams are tagged and counted
+	old := uuid.New().String()
+	if _, err = dreams.InsertOne(ctx, bson.M{
+		"_id": old, "authorId": ac.ID, "prompt": "a dog #" + tag, "status": dsDone, "visibility": visPublic,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	indexTags(ctx)
+	score, err = rdb.ZScore(ctx, tagsPopularKey, tag).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, float64(2), score)
+
+	// the deleted dreams are not counted any more
+	assert.Nil(t, deleteDream(ctx, public))
+	score, err = rdb.ZScore(ctx, tagsPopularKey, tag).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, float64(1), score)
+
+	req, _ := http.NewRequest("GET", "/api/tags/follow/no-dash", nil)
+	req.AddCookie(follower)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertNotOK(t, w)
+}
+
+func getFeedsIds(t *testing.T, uid string) []string {
+	ds, err := getFeeds(uid, time.Now().Add(-time.Hour))
+	assert.Nil(t, err)
+
+	var ids []string
+	for _, d := range ds {
+		ids = append(ids, d.ID)
+	}
+	return ids
+}
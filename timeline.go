@@ -0,0 +1,203 @@
+package dream
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// set of the users whose followers are too many to fan out, their outboxes are merged on read
+const celebritiesKey = "celebrities"
+
+// user's precomputed timeline, the dreams' ids scored by the generated time in ms
+func timelineKey(uid string) string {
+	return "u:" + uid + ":timeline"
+}
+
+// flag of the timeline which has been built from the outboxes
+func timelineBuiltKey(uid string) string {
+	return "u:" + uid + ":timeline:built"
+}
+
+func isCelebrity(usr *user) bool {
+	return len(usr.Followers) > viper.GetInt("fanoutMaxFollowers")
+}
+
+// push the feeds into the timelines, and trim them
+func pushTimelines(ctx context.Context, uids []string, feeds ...feed) error {
+	if len(uids) == 0 || len(feeds) == 0 {
+		return nil
+	}
+
+	zs := make([]redis.Z, len(feeds))
+	for i, f := range feeds {
+		zs[i] = redis.Z{Score: float64(f.Generated.UnixMilli()), Member: f.Dream}
+	}
+
+	limit := int64(viper.GetInt("timelineLimit"))
+	_, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, uid := range uids {
+			pipe.ZAdd(ctx, timelineKey(uid), zs...)
+			pipe.ZRemRangeByRank(ctx, timelineKey(uid), 0, -limit-1)
+		}
+		return nil
+	})
+	return err
+}
+
+// fanOutFeed pushes the new feed into the timelines of the author and the followers,
+// unless the author has too many followers, then the followers will read the author's outbox instead
+func fanOutFeed(ctx context.Context, author *user, f feed) error {
+	if isCelebrity(author) {
+		if err := rdb.SAdd(ctx, celebritiesKey, author.ID).Err(); err != nil {
+			return err
+		}
+		return pushTimelines(ctx, []string{author.ID}, f)
+	}
+
+	// the outbox was merged on read before, so push it all when the author is not a celebrity any more
+	n, err := rdb.SRem(ctx, celebritiesKey, author.ID).Result()
+	if err != nil {
+		return err
+	}
+
+	feeds := []feed{f}
+	if n > 0 {
+		feeds = append(feeds, author.Outbox...)
+	}
+
+	uids := append([]string{author.ID}, author.Followers...)
+	return pushTimelines(ctx, uids, feeds...)
+}
+
+// get the user's timeline since the time, the newest first
+func getTimeline(ctx context.Context, usr *user, since time.Time) ([]feed, error) {
+	if err := ensureTimeline(ctx, usr); err != nil {
+		return nil, err
+	}
+
+	zs, err := rdb.ZRevRangeByScoreWithScores(ctx, timelineKey(usr.ID), &redis.ZRangeBy{
+		Min:   "(" + formatMs(since),
+		Max:   "+inf",
+		Count: int64(viper.GetInt("timelineLimit")),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	feeds := make([]feed, len(zs))
+	for i, z := range zs {
+		feeds[i] = feed{Dream: z.Member.(string), Generated: time.UnixMilli(int64(z.Score))}
+	}
+	return feeds, nil
+}
+
+// build the timeline from the outboxes for the first time, eg: the users before the timelines were introduced,
+// it's built again if the timeline was evicted, the empty timeline is never stored, so it's always built
+func ensureTimeline(ctx context.Context, usr *user) error {
+	n, err := rdb.Exists(ctx, timelineBuiltKey(usr.ID), timelineKey(usr.ID)).Result()
+	if err != nil || n == 2 {
+		return err
+	}
+
+	feeds := make([]feed, len(usr.Outbox))
+	copy(feeds, usr.Outbox)
+
+	if len(usr.Following) > 0 {
+		// only the outboxes are loaded, so the users are not cached, the removed ones are skipped
+		cursor, err := users.Find(ctx, bson.M{"_id": bson.M{"$in": usr.Following}},
+			options.Find().SetProjection(bson.M{"outbox": 1}))
+		if err != nil {
+			return err
+		}
+
+		var us []*user
+		if err = cursor.All(ctx, &us); err != nil {
+			return err
+		}
+
+		for _, u := range us {
+			feeds = append(feeds, u.Outbox...)
+		}
+	}
+
+	zs := make([]redis.Z, len(feeds))
+	for i, f := range feeds {
+		zs[i] = redis.Z{Score: float64(f.Generated.UnixMilli()), Member: f.Dream}
+	}
+
+	// the flag is set with the timeline, so it's never built without being flagged
+	limit := int64(viper.GetInt("timelineLimit"))
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if len(zs) > 0 {
+			pipe.ZAdd(ctx, timelineKey(usr.ID), zs...)
+			pipe.ZRemRangeByRank(ctx, timelineKey(usr.ID), 0, -limit-1)
+		}
+		pipe.Set(ctx, timelineBuiltKey(usr.ID), 1, 0)
+		return nil
+	})
+	return err
+}
+
+// the outboxes of the followed celebrities, which are not pushed into the timeline
+func celebrityFeeds(ctx context.Context, following []string) ([]feed, error) {
+	if len(following) == 0 {
+		return nil, nil
+	}
+
+	members := make([]interface{}, len(following))
+	for i, uid := range following {
+		members[i] = uid
+	}
+
+	is, err := rdb.SMIsMember(ctx, celebritiesKey, members...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var feeds []feed
+	for i, uid := range following {
+		if !is[i] {
+			continue
+		}
+
+		u, err := getUserById(uid)
+		if err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, u.Outbox...)
+	}
+	return feeds, nil
+}
+
+// copy the followed user's outbox into the timeline
+func followTimeline(ctx context.Context, uid string, following string) error {
+	u, err := getUserById(following)
+	if err != nil {
+		return err
+	}
+	return pushTimelines(ctx, []string{uid}, u.Outbox...)
+}
+
+// remove the unfollowed user's outbox from the timeline
+func unfollowTimeline(ctx context.Context, uid string, following string) error {
+	u, err := getUserById(following)
+	if err != nil || len(u.Outbox) == 0 {
+		return err
+	}
+
+	members := make([]interface{}, len(u.Outbox))
+	for i, f := range u.Outbox {
+		members[i] = f.Dream
+	}
+	return rdb.ZRem(ctx, timelineKey(uid), members...).Err()
+}
+
+func formatMs(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
@@ -0,0 +1,116 @@
+package dream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestTimeline(t *testing.T) {
+	testSetup()
+
+	defer func() {
+		for _, name := range []string{"tester047", "tester048"} {
+			if err := delUsrByName(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}()
+
+	w := testLogin(t, "tester047")
+	_, ac := testJwtToken(t, w)
+	w = testLogin(t, "tester048")
+	follower, fc := testJwtToken(t, w)
+
+	ctx := context.TODO()
+	defer rdb.Del(ctx, timelineKey(ac.ID), timelineKey(fc.ID), timelineBuiltKey(ac.ID), timelineBuiltKey(fc.ID))
+	defer rdb.SRem(ctx, celebritiesKey, ac.ID)
+
+	newDream := func() string {
+		time.Sleep(time.Millisecond * 2) // scored by the time in ms
+		now := time.Now()
+		d := &dream{
+			ID: uuid.New().String(), AuthorID: ac.ID, Author: "tester047",
+			Status: dsDone, Visibility: visPublic, Created: now, Finished: now,
+			Likes: make([]string, 0), Images: make([]string, 0),
+		}
+		if _, err := dreams.InsertOne(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+		if err := addFeed(d); err != nil {
+			t.Fatal(err)
+		}
+		return d.ID
+	}
+	defer dreams.DeleteMany(ctx, bson.M{"authorId": ac.ID})
+
+	timeline := func(uid string) []string {
+		ids, err := rdb.ZRevRange(ctx, timelineKey(uid), 0, -1).Result()
+		assert.Nil(t, err)
+		return ids
+	}
+
+	sub := func(action string) {
+		req, _ := http.NewRequest("GET", "/api/"+action+"/"+ac.ID, nil)
+		req.AddCookie(follower)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assertOK(t, w)
+	}
+
+	// the outbox is copied into the timeline when following
+	before := newDream()
+	sub("sub")
+	assert.Equal(t, []string{before}, timeline(fc.ID))
+
+	// fanned out when the dream is finished
+	fanned := newDream()
+	assert.Equal(t, []string{fanned, before}, timeline(fc.ID))
+	assert.Equal(t, []string{fanned, before}, timeline(ac.ID))
+
+	// the celebrity's feeds are merged on read
+	viper.Set("fanoutMaxFollowers", 0)
+	celebrity := newDream()
+	assert.Equal(t, []string{fanned, before}, timeline(fc.ID))
+	assert.Equal(t, []string{celebrity, fanned, before}, timeline(ac.ID))
+	assert.True(t, rdb.SIsMember(ctx, celebritiesKey, ac.ID).Val())
+
+	feeds, err := getFeeds(fc.ID, time.Now().Add(-time.Hour))
+	assert.Nil(t, err)
+	var ids []string
+	for _, d := range feeds {
+		ids = append(ids, d.ID)
+	}
+	assert.Equal(t, []string{celebrity, fanned, before}, ids)
+
+	// the whole outbox is fanned out when it's not a celebrity any more
+	viper.Set("fanoutMaxFollowers", 1000)
+	after := newDream()
+	assert.Equal(t, []string{after, celebrity, fanned, before}, timeline(fc.ID))
+	assert.False(t, rdb.SIsMember(ctx, celebritiesKey, ac.ID).Val())
+
+	// built again from the outboxes after the timeline is evicted, the missing users are skipped
+	assert.Nil(t, rdb.Del(ctx, timelineKey(fc.ID)).Err())
+	usr, err := getUserById(fc.ID)
+	assert.Nil(t, err)
+	usr.Following = append(usr.Following, uuid.New().String())
+	assert.Nil(t, ensureTimeline(ctx, &usr))
+	assert.Equal(t, []string{after, celebrity, fanned, before}, timeline(fc.ID))
+
+	// trimmed
+	viper.Set("timelineLimit", 2)
+	newDream()
+	assert.Equal(t, 2, len(timeline(fc.ID)))
+	viper.Set("timelineLimit", 500)
+
+	// removed when unfollowing
+	sub("unsub")
+	assert.Empty(t, timeline(fc.ID))
+}
@@ -9,12 +9,16 @@ type user struct {
 	HPwd    string    `json:"password" bson:"password"` // hashed password
 	Created time.Time `json:"created" bson:"created"`   // created time
 
-	Following []string `json:"following" bson:"following"` // subscriptions of the user
-	Followers []string `json:"followers" bson:"followers"` // subscriptions of the user
+	Following     []string `json:"following" bson:"following"`         // subscriptions of the user
+	FollowingTags []string `json:"followingTags" bson:"followingTags"` // tags followed by the user
+	Followers     []string `json:"followers" bson:"followers"`         // subscriptions of the user
 
 	Outbox  []feed    `json:"outbox" bson:"outbox"`   // subscriptions of the user
-	Inbox   []feed    `json:"inbox" bson:"inbox"`     // subscriptions of the user
 	Updated time.Time `json:"updated" bson:"updated"` // created time
 
 	Likes []like `json:"likes" bson:"likes"` // dreams which user liked
+
+	Credits int64 `json:"credits" bson:"credits"` // balance of the generation credits
+
+	ShowSensitive bool `json:"showSensitive" bson:"showSensitive"` // show the nsfw dreams without blurring
 }
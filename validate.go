@@ -0,0 +1,188 @@
+package dream
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	errInvalidPrompt = errors.New("dream.invalid.prompt")
+	errInvalidSteps  = errors.New("dream.invalid.steps")
+	errInvalidScale  = errors.New("dream.invalid.scale")
+	errInvalidWidth  = errors.New("dream.invalid.width")
+	errInvalidHeight = errors.New("dream.invalid.height")
+	errInvalidSeed   = errors.New("dream.invalid.seed")
+
+	errInvalidNegativePrompt = errors.New("dream.invalid.negativePrompt")
+	errInvalidModel          = errors.New("dream.invalid.model")
+	errInvalidSampler        = errors.New("dream.invalid.sampler")
+	errInvalidClipSkip       = errors.New("dream.invalid.clipSkip")
+	errInvalidBatch          = errors.New("dream.invalid.batch")
+	errInvalidVisibility     = errors.New("dream.invalid.visibility")
+)
+
+// get the enabled model
+func getEnabledModel(name string) (*sdModel, error) {
+	m, err := getModel(name)
+	if err == errModelNotFound || (err == nil && !m.Enabled) {
+		return nil, errInvalidModel
+	}
+	return m, err
+}
+
+// fillDefaults sets the omitted params of the dream,
+// zero values are treated as omitted, and a random seed will be generated
+func fillDefaults(d *dream) error {
+	d.Prompt = strings.TrimSpace(d.Prompt)
+	d.NegativePrompt = strings.TrimSpace(d.NegativePrompt)
+
+	if len(d.Model) == 0 {
+		d.Model = viper.GetString("modelDefault")
+	}
+	if d.ClipSkip == 0 {
+		d.ClipSkip = 1
+	}
+	if d.Batch == 0 {
+		d.Batch = 1
+	}
+
+	// the model's defaults go first
+	m, err := getEnabledModel(d.Model)
+	if err == nil {
+		if len(d.Sampler) == 0 && len(m.Samplers) > 0 {
+			d.Sampler = m.Samplers[0]
+		}
+		if d.Steps == 0 {
+			d.Steps = m.Steps
+		}
+		if d.Scale == 0 {
+			d.Scale = m.Scale
+		}
+		if d.Width == 0 {
+			d.Width = m.Width
+		}
+		if d.Height == 0 {
+			d.Height = m.Height
+		}
+	} else if err != errInvalidModel {
+		return err
+	}
+
+	if d.Steps == 0 {
+		d.Steps = viper.GetInt("stepsDefault")
+	}
+	if d.Scale == 0 {
+		d.Scale = float32(viper.GetFloat64("scaleDefault"))
+	}
+	if d.Width == 0 {
+		d.Width = viper.GetInt("sizeDefault")
+	}
+	if d.Height == 0 {
+		d.Height = viper.GetInt("sizeDefault")
+	}
+
+	if len(d.Visibility) == 0 {
+		d.Visibility = visPublic
+	}
+
+	if d.Seed == 0 {
+		seed, err := randomSeed()
+		if err != nil {
+			return err
+		}
+		d.Seed = seed
+	}
+	return nil
+}
+
+// random seed between [seedMin, seedMax]
+func randomSeed() (int64, error) {
+	min := viper.GetInt64("seedMin")
+	if min < 1 {
+		min = 1 // zero means omitted
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(viper.GetInt64("seedMax")-min+1))
+	if err != nil {
+		return 0, err
+	}
+	return n.Int64() + min, nil
+}
+
+// validateDream checks the params of the dream with the configured limits,
+// and the limits of its model
+func validateDream(d *dream) error {
+	if len(d.Prompt) == 0 || utf8.RuneCountInString(d.Prompt) > viper.GetInt("promptMaxLen") {
+		return errInvalidPrompt
+	}
+
+	if utf8.RuneCountInString(d.NegativePrompt) > viper.GetInt("promptMaxLen") {
+		return errInvalidNegativePrompt
+	}
+
+	if !validVisibility(d.Visibility) {
+		return errInvalidVisibility
+	}
+
+	m, err := getEnabledModel(d.Model)
+	if err != nil {
+		return err
+	}
+
+	if d.Steps < viper.GetInt("stepsMin") || d.Steps > viper.GetInt("stepsMax") {
+		return errInvalidSteps
+	}
+
+	if float64(d.Scale) < viper.GetFloat64("scaleMin") || float64(d.Scale) > viper.GetFloat64("scaleMax") {
+		return errInvalidScale
+	}
+
+	if !validSize(d.Width, m.MaxWidth) {
+		return errInvalidWidth
+	}
+
+	if !validSize(d.Height, m.MaxHeight) {
+		return errInvalidHeight
+	}
+
+	if d.Seed < viper.GetInt64("seedMin") || d.Seed > viper.GetInt64("seedMax") {
+		return errInvalidSeed
+	}
+
+	if !contains(m.Samplers, d.Sampler) {
+		return errInvalidSampler
+	}
+
+	if d.ClipSkip < 1 || d.ClipSkip > m.ClipSkipMax {
+		return errInvalidClipSkip
+	}
+
+	if d.Batch < 1 || d.Batch > m.BatchMax {
+		return errInvalidBatch
+	}
+
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func validSize(size int, max int) bool {
+	if size < viper.GetInt("sizeMin") || size > viper.GetInt("sizeMax") || size > max {
+		return false
+	}
+
+	multiple := viper.GetInt("sizeMultiple")
+	return multiple <= 1 || size%multiple == 0
+}
@@ -0,0 +1,108 @@
+package dream
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFillDefaults(t *testing.T) {
+	testSetup()
+
+	d := &dream{Prompt: "  Hello, World!  "}
+	assert.Nil(t, fillDefaults(d))
+
+	assert.Equal(t, "Hello, World!", d.Prompt)
+	assert.Equal(t, 50, d.Steps)
+	assert.Equal(t, float32(7.5), d.Scale)
+	assert.Equal(t, 512, d.Width)
+	assert.Equal(t, 512, d.Height)
+	assert.True(t, d.Seed >= 1 && d.Seed <= 4294967295)
+	assert.Nil(t, validateDream(d))
+
+	assert.Equal(t, "sd-v1-5", d.Model)
+	assert.Equal(t, "euler_a", d.Sampler)
+	assert.Equal(t, 1, d.ClipSkip)
+	assert.Equal(t, 1, d.Batch)
+
+	// keep the given params
+	d = newTestDream()
+	d.Sampler = "ddim"
+	d.Batch = 2
+	assert.Nil(t, fillDefaults(d))
+	assert.Equal(t, 51, d.Steps)
+	assert.Equal(t, int64(1024), d.Seed)
+	assert.Equal(t, "ddim", d.Sampler)
+	assert.Equal(t, 2, d.Batch)
+}
+
+func TestValidateDream(t *testing.T) {
+	testSetup()
+
+	cases := []struct {
+		modify func(d *dream)
+		err    error
+	}{
+		{func(d *dream) {}, nil},
+		{func(d *dream) { d.Prompt = "" }, errInvalidPrompt},
+		{func(d *dream) { d.Prompt = strings.Repeat("梦", 1001) }, errInvalidPrompt},
+		{func(d *dream) { d.Prompt = strings.Repeat("梦", 1000) }, nil},
+		{func(d *dream) { d.Steps = 100000 }, errInvalidSteps},
+		{func(d *dream) { d.Steps = -1 }, errInvalidSteps},
+		{func(d *dream) { d.Scale = -7.5 }, errInvalidScale},
+		{func(d *dream) { d.Scale = 31 }, errInvalidScale},
+		{func(d *dream) { d.Width = 8192 }, errInvalidWidth},
+		{func(d *dream) { d.Width = 500 }, errInvalidWidth},
+		{func(d *dream) { d.Width = 768 }, nil},
+		{func(d *dream) { d.Height = 128 }, errInvalidHeight},
+		{func(d *dream) { d.Height = 520 }, errInvalidHeight},
+		{func(d *dream) { d.Seed = -1 }, errInvalidSeed},
+		{func(d *dream) { d.Seed = 4294967296 }, errInvalidSeed},
+		{func(d *dream) { d.NegativePrompt = strings.Repeat("a", 1001) }, errInvalidNegativePrompt},
+		{func(d *dream) { d.Model = "unknown" }, errInvalidModel},
+		{func(d *dream) { d.Sampler = "unknown" }, errInvalidSampler},
+		{func(d *dream) { d.Sampler = "dpm++_2m" }, nil},
+		{func(d *dream) { d.ClipSkip = 3 }, errInvalidClipSkip},
+		{func(d *dream) { d.ClipSkip = 2 }, nil},
+		{func(d *dream) { d.Batch = 5 }, errInvalidBatch},
+		{func(d *dream) { d.Batch = -1 }, errInvalidBatch},
+		{func(d *dream) { d.Batch = 4 }, nil},
+	}
+
+	for idx, c := range cases {
+		d := newTestDream()
+		assert.Nil(t, fillDefaults(d))
+		c.modify(d)
+		assert.Equal(t, c.err, validateDream(d), "case %d", idx)
+	}
+}
+
+func TestNewDreamInvalid(t *testing.T) {
+	testSetup()
+
+	defer func() {
+		err := delUsrByName("tester025")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	w := testLogin(t, "tester025")
+	token, _ := testJwtToken(t, w)
+
+	d := newTestDream()
+	d.Width = 8192
+
+	req, err := postJsonReq("/api/dream/new", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(token)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	body := assertNotOK(t, w)
+	assert.Equal(t, errInvalidWidth.Error(), body["msg"])
+}
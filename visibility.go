@@ -0,0 +1,295 @@
+package dream
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v9"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// visibility of the dream
+const (
+	visPublic   = "public"   // listed in the feeds
+	visUnlisted = "unlisted" // anyone with the link can see it, but it's never listed
+	visPrivate  = "private"  // only the author can see it
+)
+
+var errDreamNotFound = errors.New("dream.invalid.notFound")
+
+func visibilityHandlers() {
+	r.POST("/api/dream/visibility/:id", jwtAuth, visibilityHandler)
+	r.DELETE("/api/dream/:id", jwtAuth, deleteDreamHandler)
+}
+
+func validVisibility(v string) bool {
+	return v == visPublic || v == visUnlisted || v == visPrivate
+}
+
+// the dreams saved before visibility was introduced are public
+func isPublic(d *dream) bool {
+	return len(d.Visibility) == 0 || d.Visibility == visPublic
+}
+
+// whether the user can see the dream by its id
+func canViewDream(d *dream, uid string) bool {
+	return d.Visibility != visPrivate || d.AuthorID == uid
+}
+
+// whether the dream can be listed to the user, eg: in the feeds
+func canListDream(d *dream, uid string) bool {
+	return isPublic(d) || d.AuthorID == uid
+}
+
+// getVisibleDream loads the dream which the user can see,
+// private dreams of the others are treated as not found, so their existence won't leak
+func getVisibleDream(id string, uid string) (*dream, error) {
+	d, err := getDreamById(id)
+	if err == redis.Nil || err == mongo.ErrNoDocuments {
+		return nil, errDreamNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !canViewDream(d, uid) {
+		return nil, errDreamNotFound
+	}
+	return d, nil
+}
+
+// only keep the id and the lineage of the dream which the user can't see
+func hideDream(d *dream) *dream {
+	return &dream{ID: d.ID, Visibility: visPrivate, ParentID: d.ParentID, RootID: d.RootID}
+}
+
+// change the visibility of the dream by its author
+func visibilityHandler(c *gin.Context) {
+	v := c.PostForm("visibility")
+	if !validVisibility(v) {
+		badRequest(c, errInvalidVisibility)
+		return
+	}
+
+	d, err := getVisibleDream(c.Param("id"), c.GetString("uuid"))
+	if err == errDreamNotFound {
+		badRequest(c, err)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if d.AuthorID != c.GetString("uuid") {
+		permissionError(c, errors.New("dream.visibility.notAuthor"))
+		return
+	}
+
+	if _, err = dreams.UpdateByID(context.TODO(), d.ID, bson.M{"$set": bson.M{"visibility": v}}); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if err = expires("d:" + d.ID); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	// only the public dreams are explored
+	if err = addExplore(c.Request.Context(), d.ID); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	// only the public finished dreams are listed in their tags, and counted in the popular tags
+	d.Visibility = v
+	if isPublic(d) && isFeedable(d) {
+		err = addTagFeeds(c.Request.Context(), d, d.Finished)
+	} else {
+		err = removeTagFeeds(c.Request.Context(), d)
+	}
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	// the followers' new feeds may be changed
+	if err = expireFollowersFeeds(d.AuthorID); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	l.Infoln("DREAM_VISIBILITY", d.ID, v)
+	ok(c)
+}
+
+// delete the dream by its author
+func deleteDreamHandler(c *gin.Context) {
+	d, err := getVisibleDream(c.Param("id"), c.GetString("uuid"))
+	if err == errDreamNotFound {
+		badRequest(c, err)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if d.AuthorID != c.GetString("uuid") {
+		permissionError(c, errors.New("dream.delete.notAuthor"))
+		return
+	}
+
+	if err = deleteDream(c.Request.Context(), d); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	ok(c)
+}
+
+// deleteDream removes the dream and everything about it:
+// the queue, outbox, caches, seen sets, comments and the images, its remixes are moved to its parent
+func deleteDream(ctx context.Context, d *dream) error {
+	// stop generating it first, unfinished dreams will be refunded
+	if d.Status == dsPending || d.Status == dsProcessing || d.Status == dsReview {
+		if err := cancelDream(d); err != nil {
+			return err
+		}
+	}
+
+	if _, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, queuesKey, d.ID)
+		pipe.LRem(ctx, deadKey, 0, d.ID)
+		pipe.ZRem(ctx, delayedKey, d.ID)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// the flag is read from the deleted one, the cached dream may be stale
+	var deleted dream
+	err := dreams.FindOneAndDelete(ctx, bson.M{"_id": d.ID},
+		options.FindOneAndDelete().SetProjection(bson.M{"tagsCounted": 1})).Decode(&deleted)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	d.TagsCounted = deleted.TagsCounted
+
+	if _, err = users.UpdateOne(ctx, bson.M{"_id": d.AuthorID}, bson.M{
+		"$pull": bson.M{"outbox": bson.M{"dream": d.ID}},
+	}); err != nil {
+		return err
+	}
+
+	res, err := comments.DeleteMany(ctx, bson.M{"dream": d.ID})
+	if err != nil {
+		return err
+	}
+
+	if err := reparentRemixes(ctx, d); err != nil {
+		return err
+	}
+
+	if err := removeFromCollections(ctx, d.ID); err != nil {
+		return err
+	}
+
+	if err := removeBookmarks(ctx, d.ID); err != nil {
+		return err
+	}
+
+	if err := removeExplore(ctx, d.ID); err != nil {
+		return err
+	}
+
+	if err := clearDreamCaches(ctx, d, res.DeletedCount); err != nil {
+		return err
+	}
+
+	// the images can't be served any more, so failures are only logged
+	for _, key := range dreamImageKeys(d) {
+		if err := store.Delete(ctx, key); err != nil {
+			l.Errorln("delete image failed", key, err)
+		}
+	}
+
+	l.Infoln("DELETE_DREAM", d.ID, "by", d.Author)
+	return nil
+}
+
+// remove the dream's caches, and the dream from the seen sets of its author and followers
+func clearDreamCaches(ctx context.Context, d *dream, commentCount int64) error {
+	// dream, progress and comment pages, only the non-empty pages are cached,
+	// the cancel signal is kept until it expires, so the worker can still stop the deleted dream
+	keys := []string{"d:" + d.ID, "d:" + d.ID + ":progress"}
+	cpp := int64(viper.GetInt("commentsPerPage"))
+	for i := int64(0); i*cpp < commentCount; i++ {
+		keys = append(keys, "d:"+d.ID+":comments:"+strconv.FormatInt(i, 10))
+	}
+
+	usr, err := getUserById(d.AuthorID)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, keys...)
+		pipe.Del(ctx, "u:"+d.AuthorID, "u:"+d.AuthorID+":feed:new")
+		pipe.SRem(ctx, "u:"+d.AuthorID+":seen", d.ID)
+		pipe.ZRem(ctx, timelineKey(d.AuthorID), d.ID)
+		pipeRemoveTagFeeds(ctx, pipe, d, d.TagsCounted)
+		for _, f := range usr.Followers {
+			pipe.Del(ctx, "u:"+f+":feed:new")
+			pipe.SRem(ctx, "u:"+f+":seen", d.ID)
+			pipe.ZRem(ctx, timelineKey(f), d.ID)
+		}
+		return nil
+	})
+	return err
+}
+
+// expire the new feeds of the user's followers
+func expireFollowersFeeds(uid string) error {
+	usr, err := getUserById(uid)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range append(usr.Followers, uid) {
+		if err = expires("u:" + f + ":feed:new"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keys of all the images of the dream: originals, renditions and blurred ones
+func dreamImageKeys(d *dream) []string {
+	seen := map[string]bool{}
+	var keys []string
+	add := func(key string) {
+		if len(key) > 0 && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range d.Images {
+		add(key)
+	}
+	for _, rd := range d.Renditions {
+		if rd.Name == "original" {
+			add(rd.Image)
+		} else {
+			add(renditionKey(rd.Image, rd.Name))
+		}
+	}
+	for _, key := range d.Blurred {
+		add(key)
+	}
+	return keys
+}
@@ -0,0 +1,128 @@
+package dream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestCanViewDream(t *testing.T) {
+	legacy := &dream{AuthorID: "a"}
+	public := &dream{AuthorID: "a", Visibility: visPublic}
+	unlisted := &dream{AuthorID: "a", Visibility: visUnlisted}
+	private := &dream{AuthorID: "a", Visibility: visPrivate}
+
+	for _, d := range []*dream{legacy, public, unlisted} {
+		assert.True(t, canViewDream(d, "a"))
+		assert.True(t, canViewDream(d, "b"))
+	}
+	assert.True(t, canViewDream(private, "a"))
+	assert.False(t, canViewDream(private, "b"))
+
+	assert.True(t, canListDream(legacy, "b"))
+	assert.True(t, canListDream(public, "b"))
+	assert.False(t, canListDream(unlisted, "b"))
+	assert.True(t, canListDream(unlisted, "a"))
+	assert.False(t, canListDream(private, "b"))
+	assert.True(t, canListDream(private, "a"))
+
+	hidden := hideDream(&dream{ID: "x", Prompt: "secret", ParentID: "p", RootID: "r"})
+	assert.Equal(t, "x", hidden.ID)
+	assert.Equal(t, "p", hidden.ParentID)
+	assert.Empty(t, hidden.Prompt)
+}
+
+func TestDreamImageKeys(t *testing.T) {
+	d := &dream{
+		Images: []string{"a.png", "b.png"},
+		Renditions: []rendition{
+			{Image: "a.png", Name: "original"},
+			{Image: "a.png", Name: "thumb"},
+		},
+		Blurred: []string{"a_blurred.jpg"},
+	}
+	assert.Equal(t, []string{"a.png", "b.png", renditionKey("a.png", "thumb"), "a_blurred.jpg"}, dreamImageKeys(d))
+}
+
+func TestDreamVisibility(t *testing.T) {
+	testSetup()
+
+	ctx := context.TODO()
+	rdb.Del(ctx, queueOf(testModel))
+
+	defer func() {
+		for _, name := range []string{"tester035", "tester036"} {
+			if err := delUsrByName(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}()
+
+	w := testLogin(t, "tester035")
+	author, _ := testJwtToken(t, w)
+	w = testLogin(t, "tester036")
+	other, _ := testJwtToken(t, w)
+
+	request := func(method string, addr string, token *http.Cookie, form map[string]string) *httptest.ResponseRecorder {
+		var req *http.Request
+		if form != nil {
+			req, _ = postFormReq(addr, form)
+		} else {
+			req, _ = http.NewRequest(method, addr, nil)
+		}
+		req.AddCookie(token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// invalid visibility
+	d := newTestDream()
+	d.Visibility = "secret"
+	req, _ := postJsonReq("/api/dream/new", d)
+	req.AddCookie(author)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	body := assertNotOK(t, w)
+	assert.Equal(t, errInvalidVisibility.Error(), body["msg"])
+
+	d = newTestDream()
+	d.Visibility = visPrivate
+	id := testPostDream(t, author, d)
+	defer dreams.DeleteOne(ctx, bson.M{"_id": id})
+
+	// private dreams are hidden from the others
+	assertOK(t, request("GET", "/api/dream/status/"+id, author, nil))
+	body = assertNotOK(t, request("GET", "/api/dream/status/"+id, other, nil))
+	assert.Equal(t, errDreamNotFound.Error(), body["msg"])
+	assertNotOK(t, request("GET", "/api/likes/add/"+id, other, nil))
+	assertNotOK(t, request("POST", "/api/comments/add/"+id, other, map[string]string{"text": "hello"}))
+
+	// changed by the author only
+	assertNotOK(t, request("POST", "/api/dream/visibility/"+id, other, map[string]string{"visibility": visUnlisted}))
+	assertNotOK(t, request("POST", "/api/dream/visibility/"+id, author, map[string]string{"visibility": "secret"}))
+	assertOK(t, request("POST", "/api/dream/visibility/"+id, author, map[string]string{"visibility": visUnlisted}))
+	assertOK(t, request("GET", "/api/dream/status/"+id, other, nil))
+
+	// the cached comment pages are removed with the dream
+	assertOK(t, request("POST", "/api/comments/add/"+id, other, map[string]string{"text": "hello"}))
+	cs, err := getCommentsById(id, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(cs))
+	assert.Equal(t, int64(1), rdb.Exists(ctx, "d:"+id+":comments:0").Val())
+
+	// deleted by the author only
+	assertNotOK(t, request("DELETE", "/api/dream/"+id, other, nil))
+	assertOK(t, request("DELETE", "/api/dream/"+id, author, nil))
+
+	_, err = getDreamById(id)
+	assert.Equal(t, mongo.ErrNoDocuments, err)
+	assert.False(t, rdb.HExists(ctx, queuesKey, id).Val())
+	assert.Equal(t, int64(0), rdb.Exists(ctx, "d:"+id+":comments:0").Val())
+	assertNotOK(t, request("GET", "/api/dream/status/"+id, author, nil))
+}
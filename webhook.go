@@ -0,0 +1,765 @@
+package dream
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// redis keys of the webhook events
+const (
+	webhookQueueKey      = "WH"            // list of the dream events to be delivered
+	webhookProcessingKey = "WH:processing" // events being dispatched by the workers
+	webhookClaimsKey     = "WH:claims"     // zset of the dispatching events, scored by the deadline in ms
+	webhookRetryKey      = "WH:retry"      // zset of the deliveries to be retried, scored by the time in ms
+)
+
+// delivery status
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+var webhookEvents = map[dreamStatus]string{
+	dsDone:   "dream.done",
+	dsFailed: "dream.failed",
+	dsNsfw:   "dream.nsfw",
+}
+
+var (
+	errWebhookNotFound = errors.New("webhook.notFound")
+	errWebhookAddress  = errors.New("webhook.forbidden.address") // private or reserved ip
+)
+
+// networks which the webhooks can't reach, besides the loopback, private, link-local and multicast ones
+var reservedNets = parseCIDRs(
+	"0.0.0.0/8",       // "this" network
+	"100.64.0.0/10",   // carrier-grade nat
+	"192.0.0.0/24",    // ietf protocol assignments
+	"192.0.2.0/24",    // documentation
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"240.0.0.0/4",     // reserved, and the broadcast
+	"64:ff9b::/96",    // nat64, maps to the ipv4 addresses
+	"64:ff9b:1::/48",  // local-use nat64
+	"100::/64",        // discard-only
+	"2001::/23",       // ietf protocol assignments
+	"2001:db8::/32",   // documentation
+	"2002::/16",       // 6to4, maps to the ipv4 addresses
+	"fec0::/10",       // deprecated site-local
+)
+
+// user's webhook, notified when the user's dream is finished
+type webhook struct {
+	ID      string    `json:"_id" bson:"_id"`
+	User    string    `json:"user" bson:"user"`
+	URL     string    `json:"url" bson:"url"`
+	Secret  string    `json:"secret,omitempty" bson:"secret"` // only returned when it's created
+	Events  []string  `json:"events" bson:"events"`           // subscribed events, all if empty
+	Created time.Time `json:"created" bson:"created"`
+}
+
+// delivery log of the webhook event
+type delivery struct {
+	ID       string            `json:"_id" bson:"_id"`
+	Webhook  string            `json:"webhook" bson:"webhook"`
+	User     string            `json:"user" bson:"user"`
+	Dream    string            `json:"dream" bson:"dream"`
+	Event    string            `json:"event" bson:"event"`
+	Payload  string            `json:"payload" bson:"payload"` // the same body is sent for every attempt
+	Status   string            `json:"status" bson:"status"`   // "pending", "delivered" or "failed"
+	Attempts []deliveryAttempt `json:"attempts" bson:"attempts"`
+	Created  time.Time         `json:"created" bson:"created"`
+}
+
+type deliveryAttempt struct {
+	At         time.Time     `json:"at" bson:"at"`
+	StatusCode int           `json:"statusCode" bson:"statusCode"`
+	Error      string        `json:"error,omitempty" bson:"error,omitempty"`
+	Duration   time.Duration `json:"duration" bson:"duration"`
+}
+
+// body of the webhook request
+type webhookPayload struct {
+	ID      string        `json:"id"` // delivery id, the receiver may use it for deduplication
+	Event   string        `json:"event"`
+	Created time.Time     `json:"created"`
+	Dream   *webhookDream `json:"dream"`
+}
+
+// public fields of the dream sent to the webhooks, the attempts and the likes are never included
+type webhookDream struct {
+	ID             string      `json:"_id"`
+	Prompt         string      `json:"prompt"`
+	NegativePrompt string      `json:"negativePrompt"`
+	Steps          int         `json:"steps"`
+	Scale          float32     `json:"scale"`
+	Width          int         `json:"width"`
+	Height         int         `json:"height"`
+	Seed           int64       `json:"seed"`
+	Sampler        string      `json:"sampler"`
+	Model          string      `json:"model"`
+	ClipSkip       int         `json:"clipSkip"`
+	Batch          int         `json:"batch"`
+	Visibility     string      `json:"visibility"`
+	Author         string      `json:"author"`
+	AuthorID       string      `json:"authorId"`
+	Status         dreamStatus `json:"status"`
+	Images         []string    `json:"image"`
+	Renditions     []rendition `json:"renditions"`
+	Blurred        []string    `json:"blurred"`
+	Created        time.Time   `json:"created"`
+	Finished       time.Time   `json:"finished"`
+	FailReason     string      `json:"failReason"`
+	Cost           int64       `json:"cost"`
+	Tags           []string    `json:"tags"`
+	ParentID       string      `json:"parentId"`
+	RootID         string      `json:"rootId"`
+}
+
+func newWebhookDream(d *dream) *webhookDream {
+	return &webhookDream{
+		ID:             d.ID,
+		Prompt:         d.Prompt,
+		NegativePrompt: d.NegativePrompt,
+		Steps:          d.Steps,
+		Scale:          d.Scale,
+		Width:          d.Width,
+		Height:         d.Height,
+		Seed:           d.Seed,
+		Sampler:        d.Sampler,
+		Model:          d.Model,
+		ClipSkip:       d.ClipSkip,
+		Batch:          d.Batch,
+		Visibility:     d.Visibility,
+		Author:         d.Author,
+		AuthorID:       d.AuthorID,
+		Status:         d.Status,
+		Images:         d.Images,
+		Renditions:     d.Renditions,
+		Blurred:        d.Blurred,
+		Created:        d.Created,
+		Finished:       d.Finished,
+		FailReason:     d.FailReason,
+		Cost:           d.Cost,
+		Tags:           d.Tags,
+		ParentID:       d.ParentID,
+		RootID:         d.RootID,
+	}
+}
+
+type webhookJob struct {
+	ID     string      `json:"id"` // unique, so the same event can be claimed and dispatched only once
+	Dream  string      `json:"dream"`
+	Status dreamStatus `json:"status"`
+}
+
+// webhookClient never follows the redirects, nor connects to the private or reserved addresses,
+// the addresses are checked after they are resolved, so a public host can't be rebound to them
+var webhookClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 nil,
+		DialContext:           (&net.Dialer{Timeout: time.Second * 10, Control: webhookDialControl}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       time.Second * 90,
+		TLSHandshakeTimeout:   time.Second * 10,
+		ExpectContinueTimeout: time.Second * 1,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse // the 3xx response is treated as failed
+	},
+}
+
+// pushes the jobs of the processing list back to the queue after their deadlines,
+// shared by the webhook and rendition workers
+// KEYS[1] queue, KEYS[2] processing list, KEYS[3] claims
+// ARGV[1] now, ARGV[2] deadline of the jobs which are not claimed yet
+var requeueJobsScript = redis.NewScript(`
+for _, job in ipairs(redis.call('LRANGE', KEYS[2], 0, -1)) do
+	redis.call('ZADD', KEYS[3], 'NX', ARGV[2], job)
+end
+local jobs = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, job in ipairs(jobs) do
+	if redis.call('LREM', KEYS[2], 1, job) > 0 then
+		redis.call('RPUSH', KEYS[1], job)
+	end
+	redis.call('ZREM', KEYS[3], job)
+end
+return #jobs
+`)
+
+func webhookHandlers() {
+	r.GET("/api/webhooks", jwtAuth, listWebhooksHandler)
+	r.POST("/api/webhooks", jwtAuth, addWebhookHandler)
+	r.DELETE("/api/webhooks/:id", jwtAuth, removeWebhookHandler)
+	r.GET("/api/webhooks/:id/deliveries", jwtAuth, deliveriesHandler)
+}
+
+func listWebhooksHandler(c *gin.Context) {
+	cur, err := webhooks.Find(context.TODO(), bson.M{"user": c.GetString("uuid")},
+		options.Find().SetSort(bson.M{"created": 1}).SetProjection(bson.M{"secret": 0}))
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	whs := make([]*webhook, 0)
+	if err = cur.All(context.TODO(), &whs); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":       true,
+		"webhooks": whs,
+	})
+}
+
+// register a webhook, the secret will be generated if it's omitted
+func addWebhookHandler(c *gin.Context) {
+	var wh webhook
+	if err := c.ShouldBindJSON(&wh); err != nil {
+		badRequest(c, errors.New("webhook.invalid.params"))
+		return
+	}
+
+	if err := validateWebhook(&wh); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	uid := c.GetString("uuid")
+	n, err := webhooks.CountDocuments(context.TODO(), bson.M{"user": uid})
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if n >= viper.GetInt64("webhooksMax") {
+		badRequest(c, errors.New("webhook.tooMany"))
+		return
+	}
+
+	if wh.Events == nil {
+		wh.Events = make([]string, 0)
+	}
+
+	if len(wh.Secret) == 0 {
+		p := make([]byte, 32)
+		if _, err = rand.Read(p); err != nil {
+			internalError(c, err)
+			return
+		}
+		wh.Secret = hex.EncodeToString(p)
+	}
+
+	wh.ID = uuid.New().String()
+	wh.User = uid
+	wh.Created = time.Now()
+
+	if _, err = webhooks.InsertOne(context.TODO(), &wh); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	l.Infoln("ADD_WEBHOOK", wh.ID, "by", c.GetString("username"))
+	c.JSON(http.StatusOK, gin.H{
+		"ok":      true,
+		"webhook": &wh,
+	})
+}
+
+func validateWebhook(wh *webhook) error {
+	u, err := url.Parse(wh.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return errors.New("webhook.invalid.url")
+	}
+
+	// the resolved addresses are checked again when it's delivered
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errWebhookAddress
+	}
+	if ip := net.ParseIP(host); ip != nil && !webhookAllowedIP(ip) {
+		return errWebhookAddress
+	}
+
+	if len(wh.Secret) > 0 && len(wh.Secret) < 16 {
+		return errors.New("webhook.invalid.secret")
+	}
+
+	for _, e := range wh.Events {
+		valid := false
+		for _, we := range webhookEvents {
+			if e == we {
+				valid = true
+			}
+		}
+		if !valid {
+			return errors.New("webhook.invalid.events")
+		}
+	}
+	return nil
+}
+
+func removeWebhookHandler(c *gin.Context) {
+	res, err := webhooks.DeleteOne(context.TODO(), bson.M{"_id": c.Param("id"), "user": c.GetString("uuid")})
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if res.DeletedCount == 0 {
+		badRequest(c, errWebhookNotFound)
+		return
+	}
+
+	l.Infoln("REMOVE_WEBHOOK", c.Param("id"), "by", c.GetString("username"))
+	ok(c)
+}
+
+// delivery logs of the webhook, the newest first
+func deliveriesHandler(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "0"))
+	if err != nil || page < 0 {
+		badRequest(c, errors.New("invalid.input"))
+		return
+	}
+
+	n, err := webhooks.CountDocuments(context.TODO(), bson.M{"_id": c.Param("id"), "user": c.GetString("uuid")})
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if n == 0 {
+		badRequest(c, errWebhookNotFound)
+		return
+	}
+
+	perPage := int64(viper.GetInt("deliveriesPerPage"))
+	opts := options.Find().
+		SetSort(bson.M{"created": -1}).
+		SetSkip(perPage * int64(page)).
+		SetLimit(perPage)
+
+	cur, err := deliveries.Find(context.TODO(), bson.M{"webhook": c.Param("id")}, opts)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	ds := make([]*delivery, 0)
+	if err = cur.All(context.TODO(), &ds); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":         true,
+		"deliveries": ds,
+	})
+}
+
+// push the finished dream into the webhook queue
+func enqueueWebhookEvent(id string, status dreamStatus) error {
+	if _, found := webhookEvents[status]; !found {
+		return nil
+	}
+
+	p, err := json.Marshal(&webhookJob{ID: uuid.New().String(), Dream: id, Status: status})
+	if err != nil {
+		return err
+	}
+	return rdb.RPush(context.TODO(), webhookQueueKey, p).Err()
+}
+
+// deadline of the dispatching event, every webhook of the author may take the whole timeout
+func webhookClaimDeadline() string {
+	d := viper.GetDuration("webhookTimeout") * time.Duration(viper.GetInt("webhooksMax")+1)
+	return strconv.FormatInt(time.Now().Add(d).UnixMilli(), 10)
+}
+
+// webhookWorker delivers the new events until the context is done,
+// the events are kept in the processing list until they are dispatched,
+// so they will be requeued by webhookRetrier if the worker crashed
+func webhookWorker(ctx context.Context) {
+	for {
+		job, err := rdb.BLMove(ctx, webhookQueueKey, webhookProcessingKey, "LEFT", "RIGHT", time.Second*5).Result()
+		if err == redis.Nil {
+			continue
+		} else if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			l.Errorln("webhook queue failed", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		// NX, since the requeuer may have claimed it already
+		if err = claimWebhookJob(ctx, job); err != nil {
+			l.Errorln("claim webhook job failed", err)
+		}
+
+		if err = dispatchWebhookJob(ctx, job); err != nil {
+			// keep it in the processing list, it will be dispatched again after the deadline
+			l.Errorln("dispatch webhooks failed", err)
+			continue
+		}
+
+		if err = ackWebhookJob(ctx, job); err != nil {
+			l.Errorln("ack webhook job failed", err)
+		}
+	}
+}
+
+// set the deadline of the job which is moved into the processing list
+func claimWebhookJob(ctx context.Context, job string) error {
+	deadline, err := strconv.ParseFloat(webhookClaimDeadline(), 64)
+	if err != nil {
+		return err
+	}
+	return rdb.ZAddNX(ctx, webhookClaimsKey, redis.Z{Score: deadline, Member: job}).Err()
+}
+
+// remove the dispatched job from the processing list
+func ackWebhookJob(ctx context.Context, job string) error {
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, webhookProcessingKey, 1, job)
+		pipe.ZRem(ctx, webhookClaimsKey, job)
+		return nil
+	})
+	return err
+}
+
+// push the jobs which are not dispatched before their deadlines back to the queue
+func requeueWebhookJobs(ctx context.Context) (int, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	keys := []string{webhookQueueKey, webhookProcessingKey, webhookClaimsKey}
+	return requeueJobsScript.Run(ctx, rdb, keys, now, webhookClaimDeadline()).Int()
+}
+
+// decode the job, and dispatch it, the invalid jobs are dropped
+func dispatchWebhookJob(ctx context.Context, p string) error {
+	var job webhookJob
+	if err := json.Unmarshal([]byte(p), &job); err != nil {
+		l.Errorln("invalid webhook job", err)
+		return nil
+	}
+
+	err := dispatchWebhooks(ctx, &job)
+	if err == redis.Nil || err == mongo.ErrNoDocuments {
+		return nil // the dream is deleted
+	}
+	return err
+}
+
+// webhookRetrier delivers the failed events again when they are due,
+// and requeues the events which the crashed workers failed to dispatch
+func webhookRetrier(ctx context.Context) {
+	ticker := time.NewTicker(viper.GetDuration("webhookPoll"))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := requeueWebhookJobs(ctx); err != nil {
+				l.Errorln("requeue webhook jobs failed", err)
+			} else if n > 0 {
+				l.Infoln("REQUEUE_WEBHOOKS", n)
+			}
+
+			if err := retryDeliveries(ctx); err != nil {
+				l.Errorln("retry deliveries failed", err)
+			}
+		}
+	}
+}
+
+// dispatchWebhooks creates a delivery for each webhook of the dream's author, then delivers them,
+// a failed webhook won't stop the others, but the job will be dispatched again,
+// the delivered ones are skipped since their delivery ids are the same
+func dispatchWebhooks(ctx context.Context, job *webhookJob) error {
+	d, err := getDreamById(job.Dream)
+	if err != nil {
+		return err
+	}
+
+	event := webhookEvents[job.Status]
+	cur, err := webhooks.Find(ctx, bson.M{
+		"user": d.AuthorID,
+		"$or":  bson.A{bson.M{"events": bson.M{"$size": 0}}, bson.M{"events": event}},
+	})
+	if err != nil {
+		return err
+	}
+
+	var whs []*webhook
+	if err = cur.All(ctx, &whs); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, wh := range whs {
+		if err = dispatchWebhook(ctx, job, wh, d, event); err != nil {
+			l.Errorln("dispatch webhook failed", wh.ID, d.ID, err)
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("dispatch %d of %d webhooks failed: %v", len(errs), len(whs), errs)
+	}
+	return nil
+}
+
+// create the delivery of the event for the webhook, then deliver it
+func dispatchWebhook(ctx context.Context, job *webhookJob, wh *webhook, d *dream, event string) error {
+	// the same job always creates the same delivery, so it's never dispatched twice
+	id := uuid.New().String()
+	if len(job.ID) > 0 {
+		id = uuid.NewSHA1(uuid.NameSpaceURL, []byte(job.ID+"/"+wh.ID)).String()
+	}
+
+	dl := &delivery{
+		ID:       id,
+		Webhook:  wh.ID,
+		User:     wh.User,
+		Dream:    d.ID,
+		Event:    event,
+		Status:   deliveryPending,
+		Attempts: make([]deliveryAttempt, 0),
+		Created:  time.Now(),
+	}
+
+	p, err := json.Marshal(&webhookPayload{ID: dl.ID, Event: event, Created: dl.Created, Dream: newWebhookDream(d)})
+	if err != nil {
+		return err
+	}
+	dl.Payload = string(p)
+
+	if _, err = deliveries.InsertOne(ctx, dl); mongo.IsDuplicateKeyError(err) {
+		// dispatched before the worker crashed, deliver it only if it was never attempted,
+		// the attempted ones are retried by webhookRetrier
+		if err = deliveries.FindOne(ctx, bson.M{"_id": id}).Decode(dl); err != nil {
+			return err
+		}
+		if dl.Status != deliveryPending || len(dl.Attempts) > 0 {
+			return nil
+		}
+	} else if err != nil {
+		return err
+	}
+
+	return deliver(ctx, wh, dl)
+}
+
+func retryDeliveries(ctx context.Context) error {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	ids, err := rdb.ZRangeByScore(ctx, webhookRetryKey, &redis.ZRangeBy{Min: "-inf", Max: now, Count: 100}).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		// claim the delivery, other instances may be retrying it
+		n, err := rdb.ZRem(ctx, webhookRetryKey, id).Result()
+		if err != nil {
+			return err
+		} else if n == 0 {
+			continue
+		}
+
+		var dl delivery
+		if err = deliveries.FindOne(ctx, bson.M{"_id": id}).Decode(&dl); err == mongo.ErrNoDocuments {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		var wh webhook
+		err = webhooks.FindOne(ctx, bson.M{"_id": dl.Webhook}).Decode(&wh)
+		if err == mongo.ErrNoDocuments {
+			// removed by the user, give up
+			_, err = deliveries.UpdateByID(ctx, id, bson.M{"$set": bson.M{"status": deliveryFailed}})
+			if err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err = deliver(ctx, &wh, &dl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver posts the payload to the webhook, records the attempt,
+// and schedules a retry if it failed
+func deliver(ctx context.Context, wh *webhook, dl *delivery) error {
+	att := postWebhook(ctx, wh, dl)
+	dl.Attempts = append(dl.Attempts, att)
+
+	status := deliveryDelivered
+	if len(att.Error) > 0 {
+		status = deliveryPending
+		if len(dl.Attempts) > viper.GetInt("webhookRetries") {
+			status = deliveryFailed
+		}
+	}
+	dl.Status = status
+
+	_, err := deliveries.UpdateByID(ctx, dl.ID, bson.M{
+		"$set":  bson.M{"status": status},
+		"$push": bson.M{"attempts": &att},
+	})
+	if err != nil {
+		return err
+	}
+
+	if status == deliveryPending {
+		next := time.Now().Add(webhookBackoff(len(dl.Attempts)))
+		return rdb.ZAdd(ctx, webhookRetryKey, redis.Z{Score: float64(next.UnixMilli()), Member: dl.ID}).Err()
+	}
+
+	l.Infoln("DELIVER_WEBHOOK", dl.ID, "to", wh.URL, "status:", status)
+	return nil
+}
+
+// postWebhook sends the signed payload, only 2xx responses are treated as delivered
+func postWebhook(ctx context.Context, wh *webhook, dl *delivery) deliveryAttempt {
+	start := time.Now()
+	att := deliveryAttempt{At: start}
+
+	ctx, cancel := context.WithTimeout(ctx, viper.GetDuration("webhookTimeout"))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewBufferString(dl.Payload))
+	if err != nil {
+		att.Error = err.Error()
+		return att
+	}
+
+	ts := strconv.FormatInt(start.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "DreamWalker-Webhook")
+	req.Header.Set("X-Dream-Event", dl.Event)
+	req.Header.Set("X-Dream-Delivery", dl.ID)
+	req.Header.Set("X-Dream-Timestamp", ts)
+	req.Header.Set("X-Dream-Signature", "sha256="+signWebhook(wh.Secret, ts, []byte(dl.Payload)))
+
+	res, err := webhookClient.Do(req)
+	att.Duration = time.Since(start)
+	if err != nil {
+		att.Error = err.Error()
+		return att
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+
+	att.StatusCode = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		att.Error = "unexpected status: " + res.Status
+	}
+	return att
+}
+
+// signWebhook signs "<timestamp>.<body>" with the webhook's secret,
+// the timestamp is signed too, so the receiver can reject the replayed requests
+func signWebhook(secret string, ts string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// backoff of the n-th retry, doubled every time
+func webhookBackoff(n int) time.Duration {
+	d := viper.GetDuration("webhookBackoff")
+	max := viper.GetDuration("webhookBackoffMax")
+
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// webhookDialControl refuses to connect to the private or reserved addresses
+func webhookDialControl(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !webhookAllowedIP(ip) {
+		return errWebhookAddress
+	}
+	return nil
+}
+
+// whether the webhooks can reach the ip, the networks of "webhookAllowedNets" are always allowed, eg: for tests
+func webhookAllowedIP(ip net.IP) bool {
+	for _, n := range parseCIDRs(viper.GetStringSlice("webhookAllowedNets")...) {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// parse the cidrs, the invalid ones are skipped
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if _, n, err := net.ParseCIDR(cidr); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
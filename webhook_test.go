@@ -0,0 +1,225 @@
+package dream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSignWebhook(t *testing.T) {
+	sig := signWebhook("tester-secret", "1700000000", []byte(`{"id":"1"}`))
+	assert.Equal(t, 64, len(sig))
+	assert.Equal(t, sig, signWebhook("tester-secret", "1700000000", []byte(`{"id":"1"}`)))
+	assert.NotEqual(t, sig, signWebhook("tester-secret", "1700000001", []byte(`{"id":"1"}`)))
+	assert.NotEqual(t, sig, signWebhook("wrong-secret", "1700000000", []byte(`{"id":"1"}`)))
+}
+
+func TestValidateWebhook(t *testing.T) {
+	assert.Nil(t, validateWebhook(&webhook{URL: "https://example.com/hook"}))
+	assert.Nil(t, validateWebhook(&webhook{URL: "http://example.com:8080/hook", Events: []string{"dream.done"}}))
+	assert.NotNil(t, validateWebhook(&webhook{URL: "http://localhost:8080/hook"}))
+	assert.NotNil(t, validateWebhook(&webhook{URL: "http://127.0.0.1:8080/hook"}))
+	assert.NotNil(t, validateWebhook(&webhook{URL: "http://169.254.169.254/latest/meta-data"}))
+	assert.NotNil(t, validateWebhook(&webhook{URL: "http://[::1]/hook"}))
+	assert.NotNil(t, validateWebhook(&webhook{URL: "ftp://example.com/hook"}))
+	assert.NotNil(t, validateWebhook(&webhook{URL: "/hook"}))
+	assert.NotNil(t, validateWebhook(&webhook{URL: "https://example.com/hook", Secret: "short"}))
+	assert.NotNil(t, validateWebhook(&webhook{URL: "https://example.com/hook", Events: []string{"dream.liked"}}))
+}
+
+func TestWebhookAllowedIP(t *testing.T) {
+	for _, ip := range []string{"93.184.216.34", "2606:2800:220:1::"} {
+		assert.True(t, webhookAllowedIP(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254",
+		"0.0.0.0", "100.64.0.1", "255.255.255.255", "::1", "fe80::1", "fc00::1", "64:ff9b::7f00:1"} {
+		assert.False(t, webhookAllowedIP(net.ParseIP(ip)), ip)
+	}
+
+	viper.Set("webhookAllowedNets", []string{"127.0.0.1/32"})
+	defer viper.Set("webhookAllowedNets", []string{})
+	assert.True(t, webhookAllowedIP(net.ParseIP("127.0.0.1")))
+	assert.False(t, webhookAllowedIP(net.ParseIP("127.0.0.2")))
+}
+
+func TestWebhookClient(t *testing.T) {
+	srv := httptest.NewServer(http.RedirectHandler("http://example.com/", http.StatusFound))
+	defer srv.Close()
+
+	// the local receiver can't be reached
+	_, err := webhookClient.Get(srv.URL)
+	assert.ErrorIs(t, err, errWebhookAddress)
+
+	// the redirect is never followed
+	viper.Set("webhookAllowedNets", []string{"127.0.0.1/32"})
+	defer viper.Set("webhookAllowedNets", []string{})
+
+	res, err := webhookClient.Get(srv.URL)
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	viper.SetDefault("webhookBackoff", time.Second*10)
+	viper.SetDefault("webhookBackoffMax", time.Hour*1)
+
+	assert.Equal(t, time.Second*10, webhookBackoff(1))
+	assert.Equal(t, time.Second*40, webhookBackoff(3))
+	assert.Equal(t, time.Hour*1, webhookBackoff(20))
+}
+
+// a local receiver which fails the first request
+type testReceiver struct {
+	sync.Mutex
+	secret   string
+	requests int
+	bodies   [][]byte
+}
+
+func (rc *testReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rc.Lock()
+	defer rc.Unlock()
+
+	body, _ := io.ReadAll(req.Body)
+	rc.requests++
+
+	sig := "sha256=" + signWebhook(rc.secret, req.Header.Get("X-Dream-Timestamp"), body)
+	if sig != req.Header.Get("X-Dream-Signature") {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if rc.requests == 1 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	rc.bodies = append(rc.bodies, body)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	testSetup()
+
+	ctx := context.TODO()
+	rdb.Del(ctx, queueOf(testModel))
+
+	viper.Set("webhookBackoff", time.Millisecond*100)
+	defer viper.Set("webhookBackoff", time.Second*10)
+
+	// the receiver is local
+	viper.Set("webhookAllowedNets", []string{"127.0.0.1/32"})
+	defer viper.Set("webhookAllowedNets", []string{})
+
+	defer func() {
+		if err := delUsrByName("tester034"); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	w := testLogin(t, "tester034")
+	token, c := testJwtToken(t, w)
+	defer webhooks.DeleteMany(ctx, bson.M{"user": c.ID})
+	defer deliveries.DeleteMany(ctx, bson.M{"user": c.ID})
+
+	rc := &testReceiver{secret: "tester-webhook-secret"}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	// invalid url
+	p, _ := json.Marshal(&webhook{URL: "not a url"})
+	req, _ := http.NewRequest("POST", "/api/webhooks", bytes.NewReader(p))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertNotOK(t, w)
+
+	p, _ = json.Marshal(&webhook{URL: srv.URL, Secret: rc.secret, Events: []string{"dream.done"}})
+	req, _ = http.NewRequest("POST", "/api/webhooks", bytes.NewReader(p))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	body := assertOK(t, w)
+	whId := body["webhook"].(map[string]interface{})["_id"].(string)
+
+	// the secret is never listed
+	req, _ = http.NewRequest("GET", "/api/webhooks", nil)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	body = assertOK(t, w)
+	listed := body["webhooks"].([]interface{})
+	assert.Equal(t, 1, len(listed))
+	assert.Nil(t, listed[0].(map[string]interface{})["secret"])
+
+	id := testPostDream(t, token, newTestDream())
+	defer dreams.DeleteOne(ctx, bson.M{"_id": id})
+	assert.Nil(t, dequeueDream(ctx, id))
+
+	// not subscribed
+	for _, status := range []dreamStatus{dsFailed, dsDone} {
+		assert.Nil(t, setDreamStatus(id, status))
+		d, err := getDreamById(id)
+		assert.Nil(t, err)
+		assert.Nil(t, onDreamFinished(d))
+	}
+
+	var dls []*delivery
+	for i := 0; i < 50; i++ {
+		time.Sleep(time.Millisecond * 100)
+
+		cur, err := deliveries.Find(ctx, bson.M{"webhook": whId})
+		assert.Nil(t, err)
+		dls = nil
+		assert.Nil(t, cur.All(ctx, &dls))
+		if len(dls) == 1 && dls[0].Status != deliveryPending {
+			break
+		}
+	}
+
+	assert.Equal(t, 1, len(dls))
+	assert.Equal(t, deliveryDelivered, dls[0].Status)
+	assert.Equal(t, "dream.done", dls[0].Event)
+	assert.Equal(t, 2, len(dls[0].Attempts))
+	assert.Equal(t, http.StatusServiceUnavailable, dls[0].Attempts[0].StatusCode)
+	assert.Equal(t, http.StatusNoContent, dls[0].Attempts[1].StatusCode)
+
+	rc.Lock()
+	var payload webhookPayload
+	assert.Nil(t, json.Unmarshal(rc.bodies[0], &payload))
+	var raw map[string]map[string]interface{}
+	assert.Nil(t, json.Unmarshal(rc.bodies[0], &raw))
+	rc.Unlock()
+	assert.NotContains(t, raw["dream"], "attempts") // the worker ids are never sent
+	assert.Equal(t, dls[0].ID, payload.ID)
+	assert.Equal(t, id, payload.Dream.ID)
+	assert.Equal(t, dsDone, payload.Dream.Status)
+
+	// delivery logs
+	req, _ = http.NewRequest("GET", "/api/webhooks/"+whId+"/deliveries", nil)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	body = assertOK(t, w)
+	assert.Equal(t, 1, len(body["deliveries"].([]interface{})))
+
+	req, _ = http.NewRequest("DELETE", "/api/webhooks/"+whId, nil)
+	req.AddCookie(token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertOK(t, w)
+}
@@ -0,0 +1,448 @@
+package dream
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v9"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	errWorkerInvalidParams = errors.New("worker.invalid.params")
+	errDreamNotPending     = errors.New("dream.notPending") // cancelled after it's claimed
+)
+
+func workerHandlers() {
+	r.POST("/api/worker/claim", workerAuth, claimJobHandler)
+	r.POST("/api/worker/progress/:id", workerAuth, progressJobHandler)
+	r.POST("/api/worker/upload/:id", workerAuth, uploadJobHandler)
+	r.POST("/api/worker/done/:id", workerAuth, finishJobHandler(dsDone))
+	r.POST("/api/worker/failed/:id", workerAuth, failJobHandler)
+	r.POST("/api/worker/nsfw/:id", workerAuth, finishJobHandler(dsNsfw))
+}
+
+// workerAuth authenticates the worker by the bearer token,
+// tokens are configured by "workers" as a map of worker id -> token
+func workerAuth(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if len(token) == 0 {
+		permissionError(c, errAuthFailed)
+		c.Abort()
+		return
+	}
+
+	for id, t := range viper.GetStringMapString("workers") {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			c.Set("worker", id)
+			c.Next()
+			return
+		}
+	}
+
+	permissionError(c, errAuthFailed)
+	c.Abort()
+}
+
+// claim the next pending dream of the models advertised by the worker
+func claimJobHandler(c *gin.Context) {
+	worker := c.GetString("worker")
+
+	// the models which the worker can serve
+	models := c.PostFormArray("models")
+	if len(models) == 1 {
+		models = strings.Split(models[0], ",")
+	}
+	if len(models) == 0 || len(models[0]) == 0 {
+		badRequest(c, errors.New("worker.models.required"))
+		return
+	}
+
+	id, err := claimJob(c.Request.Context(), worker, models, viper.GetDuration("workerClaimWait"))
+	if err == redis.Nil {
+		c.JSON(http.StatusOK, gin.H{
+			"ok":  true,
+			"job": nil,
+		})
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	d, err := getDreamById(id)
+	if err == nil && d.Status == dsCancelled {
+		err = errDreamNotPending
+	} else if err == nil {
+		err = startAttempt(id, worker)
+	}
+
+	// cancelled or deleted right before claimed
+	if err == errDreamNotPending || err == redis.Nil || err == mongo.ErrNoDocuments {
+		if err = completeJob(c.Request.Context(), worker, id); err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ok":  true,
+			"job": nil,
+		})
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+	d.Status = dsProcessing
+
+	l.Infoln("CLAIM_DREAM", id, "by", worker)
+	c.JSON(http.StatusOK, gin.H{
+		"ok":  true,
+		"job": d,
+	})
+}
+
+// report the generating progress, it also works as the heartbeat of the job,
+// an optional low resolution "preview" image can be uploaded with it
+func progressJobHandler(c *gin.Context) {
+	id := c.Param("id")
+	step, err1 := strconv.Atoi(c.DefaultPostForm("step", "0"))
+	total, err2 := strconv.Atoi(c.DefaultPostForm("total", "0"))
+	if err1 != nil || err2 != nil || step < 0 || total < 0 {
+		badRequest(c, errWorkerInvalidParams)
+		return
+	}
+
+	// check the preview before the heartbeat is recorded
+	var preview string
+	if fh, err := c.FormFile("preview"); err == nil {
+		if preview, err = previewDataURL(fh); err != nil {
+			badRequest(c, err)
+			return
+		}
+	}
+
+	err := heartbeatJob(c.Request.Context(), c.GetString("worker"), id)
+	if err == errJobNotOwned {
+		permissionError(c, err)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	// tell the worker to stop, if the dream was cancelled by its author
+	cancelled, err := isCancelled(id)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	if cancelled {
+		if err = completeJob(c.Request.Context(), c.GetString("worker"), id); err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ok":        true,
+			"cancelled": true,
+		})
+		return
+	}
+
+	if err = setProgress(id, step, total); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	e := &dreamEvent{Type: "progress", Status: dsProcessing, Step: step, Total: total, Preview: preview}
+	if err = publishDreamEvent(id, e); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	ok(c)
+}
+
+// upload the generated images of the job
+func uploadJobHandler(c *gin.Context) {
+	id := c.Param("id")
+	worker := c.GetString("worker")
+
+	owned, err := isJobOwner(c.Request.Context(), worker, id)
+	if err != nil {
+		internalError(c, err)
+		return
+	} else if !owned {
+		permissionError(c, errJobNotOwned)
+		return
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil || len(form.File["images"]) == 0 {
+		badRequest(c, errWorkerInvalidParams)
+		return
+	}
+
+	var images []string
+	for _, fh := range form.File["images"] {
+		data, contentType, err := readUploadedImage(fh)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+
+		name := id + "_" + strconv.FormatInt(time.Now().UnixNano(), 36) + strings.ToLower(filepath.Ext(fh.Filename))
+		if err = store.Put(c.Request.Context(), name, data, contentType); err != nil {
+			internalError(c, err)
+			return
+		}
+		images = append(images, name)
+	}
+
+	if err = addDreamImages(id, images); err != nil {
+		internalError(c, err)
+		return
+	}
+
+	// renditions are generated in background, so the upload won't be blocked
+	for _, name := range images {
+		if err = enqueueRendition(id, name); err != nil {
+			l.Errorln("enqueue rendition failed", name, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":     true,
+		"images": images,
+	})
+}
+
+// finish the job with the given status
+func finishJobHandler(status dreamStatus) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		worker := c.GetString("worker")
+		ctx := c.Request.Context()
+
+		owned, err := isJobOwner(ctx, worker, id)
+		if err != nil {
+			internalError(c, err)
+			return
+		} else if !owned {
+			permissionError(c, errJobNotOwned)
+			return
+		}
+
+		// the deleted dream was cancelled before it's deleted
+		d, err := getDreamById(id)
+		if err != nil && err != redis.Nil && err != mongo.ErrNoDocuments {
+			internalError(c, err)
+			return
+		}
+
+		if err != nil || d.Status == dsCancelled {
+			if err = completeJob(ctx, worker, id); err != nil {
+				internalError(c, err)
+				return
+			}
+
+			badRequest(c, errors.New("dream.cancelled"))
+			return
+		}
+
+		if status == dsDone && (len(d.Images) == 0 || len(d.Images) < d.Batch) {
+			badRequest(c, errors.New("worker.images.notFound"))
+			return
+		}
+
+		// the worker reported nsfw, or let the moderator decide
+		if status == dsNsfw {
+			d.Moderation = &moderation{Flagged: true, Labels: []string{"worker"}, Score: 1, By: worker, Updated: time.Now()}
+		} else {
+			m, err := moderateDream(ctx, d)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+
+			d.Moderation = m
+			if m != nil && m.Flagged {
+				status = dsNsfw
+			}
+		}
+
+		d.Status = status
+		d.Finished = time.Now()
+
+		set := bson.M{"status": d.Status, "finished": d.Finished}
+		if d.Moderation != nil {
+			set["moderation"] = d.Moderation
+		}
+		if n := len(d.Attempts); n > 0 {
+			d.Attempts[n-1].Ended = d.Finished
+			set["attempts."+strconv.Itoa(n-1)+".ended"] = d.Finished
+		}
+
+		if err = updateDream(d, set, false); err != nil {
+			internalError(c, err)
+			return
+		}
+
+		if err = completeJob(ctx, worker, id); err != nil {
+			internalError(c, err)
+			return
+		}
+
+		if err = onDreamFinished(d); err != nil {
+			internalError(c, err)
+			return
+		}
+
+		if n := len(d.Attempts); n > 0 {
+			started := d.Attempts[n-1].Started
+			if err = recordThroughput(ctx, d.Model, d.Finished.Sub(started), workUnits(d)); err != nil {
+				internalError(c, err)
+				return
+			}
+		}
+
+		// flagged images are blurred for the users who don't want to see them
+		if status == dsNsfw {
+			if err = blurDreamImages(d); err != nil {
+				internalError(c, err)
+				return
+			}
+		}
+
+		// push dream to user's outbox
+		if status == dsDone || (status == dsNsfw && len(d.Images) > 0) {
+			if err = addFeed(d); err != nil {
+				internalError(c, err)
+				return
+			}
+		}
+
+		l.Infoln("FINISH_DREAM", id, "by", worker, "status:", status)
+		ok(c)
+	}
+}
+
+// report the failure of the job, the dream will be retried later
+func failJobHandler(c *gin.Context) {
+	id := c.Param("id")
+	reason := strings.TrimSpace(c.DefaultPostForm("reason", "unknown"))
+
+	err := failJob(c.Request.Context(), c.GetString("worker"), id, reason)
+	if err == errJobNotOwned {
+		permissionError(c, err)
+		return
+	} else if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	l.Infoln("FAIL_DREAM", id, "by", c.GetString("worker"), "reason:", reason)
+	ok(c)
+}
+
+// mark the pending dream as processing, and start a new attempt,
+// returns errDreamNotPending if it was cancelled after it's claimed
+func startAttempt(id string, worker string) error {
+	res, err := dreams.UpdateOne(context.TODO(), bson.M{"_id": id, "status": dsPending}, bson.M{
+		"$set":  bson.M{"status": dsProcessing},
+		"$push": bson.M{"attempts": &attempt{Worker: worker, Started: time.Now()}},
+	})
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		return errDreamNotPending
+	}
+
+	if err = expires("d:" + id); err != nil {
+		return err
+	}
+	return publishStatus(id, dsProcessing)
+}
+
+// save the generating progress of the dream
+func setProgress(id string, step int, total int) error {
+	ctx := context.TODO()
+	key := "d:" + id + ":progress"
+
+	if err := rdb.HSet(ctx, key, "step", step, "total", total).Err(); err != nil {
+		return err
+	}
+	return rdb.Expire(ctx, key, viper.GetDuration("queueVisibility")).Err()
+}
+
+// read the uploaded png or jpeg image, and detect its content type
+func readUploadedImage(fh *multipart.FileHeader) ([]byte, string, error) {
+	ext := strings.ToLower(filepath.Ext(fh.Filename))
+	if ext != ".png" && ext != ".jpg" && ext != ".jpeg" {
+		return nil, "", errors.New("worker.invalid.imageType")
+	}
+
+	if fh.Size > viper.GetInt64("imageMaxSize") {
+		return nil, "", errors.New("worker.image.tooLarge")
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, "", err
+	}
+
+	contentType := http.DetectContentType(data)
+	if contentType != "image/png" && contentType != "image/jpeg" {
+		return nil, "", errors.New("worker.invalid.imageType")
+	}
+	return data, contentType, nil
+}
+
+// get the generating progress of the dream
+func getProgress(id string) (step int, total int, err error) {
+	vals, err := rdb.HMGet(context.TODO(), "d:"+id+":progress", "step", "total").Result()
+	if err != nil {
+		return
+	}
+
+	if s, ok := vals[0].(string); ok {
+		step, _ = strconv.Atoi(s)
+	}
+	if t, ok := vals[1].(string); ok {
+		total, _ = strconv.Atoi(t)
+	}
+	return
+}
+
+// append images to the dream, and clear its cache
+func addDreamImages(id string, images []string) error {
+	_, err := dreams.UpdateByID(context.TODO(), id, bson.M{
+		"$push": bson.M{"image": bson.M{"$each": images}},
+	})
+	if err != nil {
+		return err
+	}
+
+	return expires("d:" + id)
+}
@@ -0,0 +1,142 @@
+package dream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const testWorkerToken = "tester-worker-token"
+
+func testWorkerSetup() {
+	testSetup()
+	viper.Set("workers", map[string]string{"tester-worker": testWorkerToken})
+}
+
+func workerReq(method string, addr string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, addr, body)
+	req.Header.Set("Authorization", "Bearer "+testWorkerToken)
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func claimReq() *httptest.ResponseRecorder {
+	return workerReq("POST", "/api/worker/claim", bytes.NewBufferString("models="+testModel), "application/x-www-form-urlencoded")
+}
+
+func uploadReq(addr string, names ...string) *httptest.ResponseRecorder {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	for _, name := range names {
+		fw, _ := mw.CreateFormFile("images", name)
+		fw.Write([]byte("\x89PNG\r\n\x1a\n"))
+	}
+	mw.Close()
+
+	return workerReq("POST", addr, buf, mw.FormDataContentType())
+}
+
+func TestWorkerAuth(t *testing.T) {
+	testWorkerSetup()
+
+	// without token
+	req, _ := http.NewRequest("POST", "/api/worker/claim", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertNotOK(t, w)
+
+	// with wrong token
+	req, _ = http.NewRequest("POST", "/api/worker/claim", nil)
+	req.Header.Set("Authorization", "Bearer wrong-token")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assertNotOK(t, w)
+}
+
+func TestWorkerJob(t *testing.T) {
+	testWorkerSetup()
+
+	defer func() {
+		err := delUsrByName("tester020")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	rdb.Del(context.TODO(), queueOf(testModel))
+
+	w := testLogin(t, "tester020")
+	token, c := testJwtToken(t, w)
+
+	dr := newTestDream()
+	dr.NegativePrompt = "blurry"
+	dr.Batch = 2
+	id := testPostDream(t, token, dr)
+
+	// claim the job
+	w = claimReq()
+	body := assertOK(t, w)
+	job := body["job"].(map[string]interface{})
+	assert.Equal(t, id, job["_id"])
+	assert.Equal(t, "blurry", job["negativePrompt"])
+	assert.Equal(t, "sd-v1-5", job["model"])
+	assert.Equal(t, "euler_a", job["sampler"])
+	assert.Equal(t, float64(2), job["batch"])
+
+	d, err := getDreamById(id)
+	assert.Nil(t, err)
+	assert.Equal(t, dsProcessing, d.Status)
+
+	// report progress
+	w = workerReq("POST", "/api/worker/progress/"+id, bytes.NewBufferString("step=23&total=51"), "application/x-www-form-urlencoded")
+	assertOK(t, w)
+
+	// can't be done without images
+	w = workerReq("POST", "/api/worker/done/"+id, nil, "")
+	assertNotOK(t, w)
+
+	// invalid image type
+	w = uploadReq("/api/worker/upload/"+id, "result.exe")
+	assertNotOK(t, w)
+
+	// not enough images for the batch
+	w = uploadReq("/api/worker/upload/"+id, "0.png")
+	assertOK(t, w)
+	w = workerReq("POST", "/api/worker/done/"+id, nil, "")
+	assertNotOK(t, w)
+
+	// upload images
+	w = uploadReq("/api/worker/upload/"+id, "1.png")
+	body = assertOK(t, w)
+	assert.Equal(t, 1, len(body["images"].([]interface{})))
+
+	// done
+	w = workerReq("POST", "/api/worker/done/"+id, nil, "")
+	assertOK(t, w)
+
+	d, err = getDreamById(id)
+	assert.Nil(t, err)
+	assert.Equal(t, dsDone, d.Status)
+	assert.Equal(t, 2, len(d.Images))
+	assert.False(t, d.Finished.IsZero())
+
+	usr, err := getUserById(c.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(usr.Outbox))
+
+	// the job is not owned by the worker any more
+	w = workerReq("POST", "/api/worker/progress/"+id, nil, "")
+	assertNotOK(t, w)
+}